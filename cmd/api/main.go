@@ -1,39 +1,151 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
-	"strconv"
 
+	"fetchrewards.com/points-api/internal/config"
 	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/metrics"
 	"fetchrewards.com/points-api/internal/services"
 	"fetchrewards.com/points-api/internal/web"
 )
 
-const DefaultPort = 8090
-
 // Run the following from the root of the project
 // go cmd/api/main.go
 //
 // Optional: provide a port for which to run the server
 // go cmd/api/main.go 8080
+//
+// Optional: read the configuration from a YAML file, overridden by POINTS_API_* environment
+// variables and then by flags
+// go cmd/api/main.go -config ./config.yaml
+//
+// Optional: print the effective configuration without starting the server
+// go cmd/api/main.go -config ./config.yaml -print-config
+//
+// Optional: persist points to disk between restarts
+// go cmd/api/main.go -storage file -data-dir ./data
+//
+// Optional: register payers as points are added for them, for backfills
+// go cmd/api/main.go -payer-mode permissive
+//
+// Optional: require clients to authenticate with one of the API keys in a file
+// go cmd/api/main.go -api-keys ./api-keys.json
+//
+// Optional: accept user tokens signed with the secret in the environment
+// POINTS_API_USER_TOKEN_SECRET=secret go cmd/api/main.go
+//
+// Optional: reject points beyond what payers have prepaid for
+// go cmd/api/main.go -payer-budgets
 func main() {
-	db := db.NewInMemoryDB()
-	service := services.NewPointService(db)
-	server := web.NewServer(service)
+	cfg, printConfig, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	server.Start(getPort())
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Shut down cleanly")
 }
 
-func getPort() int {
-	port := DefaultPort
-	if len(os.Args) > 1 {
-		requestedPort, err := strconv.Atoi(os.Args[1])
+// run serves the API until the process is signalled to stop. Cleanup runs once in-flight
+// requests have drained, so the storage backend is closed after its last write.
+func run(cfg config.Config) error {
+	var service *services.PointService
+	var payers *services.PayerRegistry
+	var budgets *services.BudgetLedger
+	var idempotency web.IdempotencyStore
+	var storageReady, closeStorage func() error
+	switch cfg.Storage.Backend {
+	case config.StorageMemory:
+		memoryDB := db.NewInMemoryDB()
+		service = services.NewPointService(memoryDB)
+		payers = services.NewPayerRegistry(memoryDB)
+		budgets = services.NewBudgetLedger(memoryDB)
+		idempotency = memoryDB
+		storageReady = memoryDB.Ready
+	case config.StorageFile:
+		fileDB, err := db.NewFileDB(cfg.Storage.DataDir)
+		if err != nil {
+			return fmt.Errorf("unable to open file database: %w", err)
+		}
+		storageReady = fileDB.Ready
+		closeStorage = fileDB.Close
+		service = services.NewPointService(fileDB)
+		payers = services.NewPayerRegistry(fileDB)
+		budgets = services.NewBudgetLedger(fileDB)
+		idempotency = fileDB
+	}
+
+	payers.Permissive = cfg.Payers.Mode == config.PayersPermissive
+	service.Payers = payers
+	if cfg.Payers.Budgets {
+		service.Budgets = budgets
+	}
+
+	strategy, err := cfg.SpendStrategy()
+	if err != nil {
+		return err
+	}
+	service.DefaultStrategy = strategy
+	service.HoldDuration = cfg.Spend.HoldDuration
+	if service.ExpirationPolicies, err = cfg.ExpirationPolicies(); err != nil {
+		return err
+	}
+
+	metrics.Default.NewGaugeFunc("points_api_points_outstanding", "Points owed to users that have not been spent or swept as expired", func() float64 {
+		return float64(service.OutstandingPoints())
+	})
+
+	server := web.NewServer(service, payers, budgets, idempotency)
+	server.IdempotencyWindow = cfg.Idempotency.Window
+	server.IdempotencyLease = cfg.Idempotency.Lease
+	if cfg.Auth.APIKeysFile != "" {
+		keys, err := web.LoadAPIKeys(cfg.Auth.APIKeysFile)
 		if err != nil {
-			log.Printf("Invalid port number %s, falling back to default", os.Args[1])
-		} else {
-			port = requestedPort
+			return fmt.Errorf("unable to load API keys: %w", err)
+		}
+		server.APIKeys = keys
+	}
+	if cfg.Auth.UserTokenSecret != "" {
+		server.UserTokenSecret = []byte(cfg.Auth.UserTokenSecret)
+	}
+	server.TokenLeeway = cfg.Auth.TokenLeeway
+	server.RateLimits = web.RateLimits(cfg.RateLimits)
+	server.ReadTimeout = cfg.Listen.ReadTimeout
+	server.WriteTimeout = cfg.Listen.WriteTimeout
+	server.IdleTimeout = cfg.Listen.IdleTimeout
+	server.ShutdownTimeout = cfg.Listen.ShutdownTimeout
+	server.TLSCertFile = cfg.Listen.TLS.CertFile
+	server.TLSKeyFile = cfg.Listen.TLS.KeyFile
+	server.StorageReady = storageReady
+	if len(server.APIKeys) == 0 && len(server.UserTokenSecret) == 0 {
+		log.Printf("No API keys or user token secret configured, the API is open to anyone who can reach it")
+	}
+
+	stopSweeper := service.StartExpirationSweeper(cfg.Expiration.SweepInterval)
+	err = server.Start(cfg.Listen.Address)
+	stopSweeper()
+	if closeStorage != nil {
+		if closeErr := closeStorage(); closeErr != nil && err == nil {
+			err = fmt.Errorf("unable to close file database: %w", closeErr)
 		}
 	}
-	return port
+	return err
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"fetchrewards.com/points-api/internal/web"
+)
+
+var (
+	userID = flag.String("user", "", "ID of the user the token is for")
+	ttl    = flag.Duration("ttl", time.Hour, "how long the token is valid for")
+)
+
+// Mints a user token for local development, signed with the same secret the server uses
+// POINTS_API_USER_TOKEN_SECRET=secret go run ./cmd/token -user 1
+func main() {
+	flag.Parse()
+
+	secret := os.Getenv(web.UserTokenSecretEnv)
+	if secret == "" {
+		log.Fatalf("%s must be set to the secret the server verifies tokens with", web.UserTokenSecretEnv)
+	}
+	token, err := web.MintUserToken([]byte(secret), *userID, time.Now(), *ttl)
+	if err != nil {
+		log.Fatalf("Unable to mint token: %v", err)
+	}
+	fmt.Println(token)
+}
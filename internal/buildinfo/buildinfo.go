@@ -0,0 +1,59 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version, Revision and Time describe the build and are set by the linker, for example
+//
+//	go build -ldflags "-X fetchrewards.com/points-api/internal/buildinfo.Version=v1.2.0
+//	  -X fetchrewards.com/points-api/internal/buildinfo.Revision=$(git rev-parse HEAD)
+//	  -X fetchrewards.com/points-api/internal/buildinfo.Time=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/api
+//
+// Version defaults to the module version recorded in the binary, or DevVersion for binaries
+// built from a source tree. Revision and Time default to Unknown.
+var (
+	Version  string
+	Revision string
+	Time     string
+)
+
+const (
+	// DevVersion is the Version of binaries built from a source tree without a version set
+	DevVersion = "dev"
+	// Unknown is the Revision and Time of binaries built without them set
+	Unknown = "unknown"
+)
+
+// Info describes the build of the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the Info of the running binary
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Revision:  Revision,
+		BuildTime: Time,
+		GoVersion: runtime.Version(),
+	}
+	if info.Version == "" {
+		info.Version = DevVersion
+		// Binaries built from a source tree record the module version as "(devel)"
+		if build, ok := debug.ReadBuildInfo(); ok && build.Main.Version != "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+	}
+	if info.Revision == "" {
+		info.Revision = Unknown
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = Unknown
+	}
+	return info
+}
@@ -0,0 +1,36 @@
+package buildinfo_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/buildinfo"
+)
+
+func TestGet(t *testing.T) {
+	tests := map[string]struct {
+		version, revision, time string
+		expected                buildinfo.Info
+	}{
+		"without ldflags": {
+			expected: buildinfo.Info{Version: buildinfo.DevVersion, Revision: buildinfo.Unknown, BuildTime: buildinfo.Unknown},
+		},
+		"with ldflags": {
+			version:  "v1.2.0",
+			revision: "8d6d8b6",
+			time:     "2020-11-02T14:00:00Z",
+			expected: buildinfo.Info{Version: "v1.2.0", Revision: "8d6d8b6", BuildTime: "2020-11-02T14:00:00Z"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			buildinfo.Version, buildinfo.Revision, buildinfo.Time = tc.version, tc.revision, tc.time
+			defer func() { buildinfo.Version, buildinfo.Revision, buildinfo.Time = "", "", "" }()
+
+			tc.expected.GoVersion = runtime.Version()
+			assert.Equal(t, tc.expected, buildinfo.Get())
+		})
+	}
+}
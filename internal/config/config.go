@@ -0,0 +1,269 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/web"
+)
+
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+)
+
+const (
+	PayersStrict     = "strict"
+	PayersPermissive = "permissive"
+)
+
+const (
+	// ExpireMonths expires points a number of months after they were earned
+	ExpireMonths = "months"
+	// ExpireQuarter expires points at the end of a calendar quarter
+	ExpireQuarter = "end-of-quarter"
+)
+
+// DefaultAddress is the address the server listens on when none is configured
+const DefaultAddress = ":8090"
+
+// Config is everything the API server can be configured with
+type Config struct {
+	Listen      Listen      `yaml:"listen"`
+	Storage     Storage     `yaml:"storage"`
+	Auth        Auth        `yaml:"auth"`
+	RateLimits  RateLimits  `yaml:"rateLimits"`
+	Payers      Payers      `yaml:"payers"`
+	Spend       Spend       `yaml:"spend"`
+	Expiration  Expiration  `yaml:"expiration"`
+	Idempotency Idempotency `yaml:"idempotency"`
+}
+
+// Listen configures where and how the server accepts connections
+type Listen struct {
+	Address         string        `yaml:"address"`
+	TLS             TLS           `yaml:"tls"`
+	ReadTimeout     time.Duration `yaml:"readTimeout"`
+	WriteTimeout    time.Duration `yaml:"writeTimeout"`
+	IdleTimeout     time.Duration `yaml:"idleTimeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+// TLS names the certificate and key files to serve HTTPS with. Both are empty to serve HTTP.
+type TLS struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// Storage selects the storage backend
+type Storage struct {
+	Backend string `yaml:"backend"`
+	DataDir string `yaml:"dataDir"`
+}
+
+// Auth configures how clients and users authenticate. With neither API keys nor a user token
+// secret the API is open to anyone who can reach it.
+type Auth struct {
+	APIKeysFile     string        `yaml:"apiKeysFile"`
+	UserTokenSecret string        `yaml:"userTokenSecret"`
+	TokenLeeway     time.Duration `yaml:"tokenLeeway"`
+}
+
+// RateLimits mirrors web.RateLimits with the names used in config files
+type RateLimits struct {
+	ClientReads  web.RateLimit `yaml:"clientReads"`
+	ClientWrites web.RateLimit `yaml:"clientWrites"`
+	UserReads    web.RateLimit `yaml:"userReads"`
+	UserWrites   web.RateLimit `yaml:"userWrites"`
+}
+
+// Payers configures how points from payers are accepted
+type Payers struct {
+	Mode    string `yaml:"mode"`
+	Budgets bool   `yaml:"budgets"`
+}
+
+// Spend configures the defaults for spends and holds
+type Spend struct {
+	Strategy      string        `yaml:"strategy"`
+	PayerPriority []string      `yaml:"payerPriority,omitempty"`
+	HoldDuration  time.Duration `yaml:"holdDuration"`
+}
+
+// Expiration configures when points expire, keyed by payer. Payer names are canonicalized, so
+// "Dannon" sets the policy of DANNON.
+type Expiration struct {
+	SweepInterval time.Duration               `yaml:"sweepInterval"`
+	Policies      map[string]ExpirationPolicy `yaml:"policies,omitempty"`
+}
+
+// ExpirationPolicy describes a services.ExpirationPolicy. Months is used by the months kind
+// and QuartersAfter by the end-of-quarter kind.
+type ExpirationPolicy struct {
+	Kind          string `yaml:"kind"`
+	Months        int    `yaml:"months,omitempty"`
+	QuartersAfter int    `yaml:"quartersAfter,omitempty"`
+}
+
+// Idempotency configures how long responses are kept for replay and how long a request in
+// progress holds its key
+type Idempotency struct {
+	Window time.Duration `yaml:"window"`
+	Lease  time.Duration `yaml:"lease"`
+}
+
+// Default returns the configuration used for anything not set in a file, the environment or
+// on the command line
+func Default() Config {
+	return Config{
+		Listen: Listen{
+			Address:         DefaultAddress,
+			ReadTimeout:     web.DefaultReadTimeout,
+			WriteTimeout:    web.DefaultWriteTimeout,
+			IdleTimeout:     web.DefaultIdleTimeout,
+			ShutdownTimeout: web.DefaultShutdownTimeout,
+		},
+		Storage: Storage{
+			Backend: StorageMemory,
+			DataDir: "data",
+		},
+		Auth: Auth{
+			TokenLeeway: web.DefaultTokenLeeway,
+		},
+		RateLimits: RateLimits(web.DefaultRateLimits),
+		Payers: Payers{
+			Mode: PayersStrict,
+		},
+		Spend: Spend{
+			Strategy:     services.StrategyFIFO,
+			HoldDuration: services.DefaultHoldDuration,
+		},
+		Expiration: Expiration{
+			SweepInterval: time.Hour,
+		},
+		Idempotency: Idempotency{
+			Window: web.DefaultIdempotencyWindow,
+			Lease:  web.DefaultIdempotencyLease,
+		},
+	}
+}
+
+// Validate checks the whole configuration, including that the files it names can be read, and
+// reports every problem found rather than just the first
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen.Address); err != nil {
+		problems = append(problems, fmt.Sprintf("listen.address: %v", err))
+	}
+	check((c.Listen.TLS.CertFile == "") == (c.Listen.TLS.KeyFile == ""), "listen.tls: certFile and keyFile must be set together")
+	for _, file := range []string{c.Listen.TLS.CertFile, c.Listen.TLS.KeyFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "listen.tls: %v", err)
+		}
+	}
+	check(c.Listen.ReadTimeout > 0, "listen.readTimeout must be positive")
+	check(c.Listen.WriteTimeout > 0, "listen.writeTimeout must be positive")
+	check(c.Listen.IdleTimeout > 0, "listen.idleTimeout must be positive")
+	check(c.Listen.ShutdownTimeout > 0, "listen.shutdownTimeout must be positive")
+
+	switch c.Storage.Backend {
+	case StorageMemory:
+	case StorageFile:
+		check(c.Storage.DataDir != "", "storage.dataDir is required by the %s backend", StorageFile)
+	default:
+		check(false, "storage.backend: unknown backend %q, expected %s or %s", c.Storage.Backend, StorageMemory, StorageFile)
+	}
+
+	if c.Auth.APIKeysFile != "" {
+		_, err := web.LoadAPIKeys(c.Auth.APIKeysFile)
+		check(err == nil, "auth.apiKeysFile: %v", err)
+	}
+	check(c.Auth.TokenLeeway >= 0, "auth.tokenLeeway must not be negative")
+
+	check(c.Payers.Mode == PayersStrict || c.Payers.Mode == PayersPermissive,
+		"payers.mode: unknown mode %q, expected %s or %s", c.Payers.Mode, PayersStrict, PayersPermissive)
+
+	if _, err := c.SpendStrategy(); err != nil {
+		problems = append(problems, fmt.Sprintf("spend.strategy: %v", err))
+	}
+	check(c.Spend.HoldDuration > 0, "spend.holdDuration must be positive")
+
+	check(c.Expiration.SweepInterval > 0, "expiration.sweepInterval must be positive")
+	payers := make([]string, 0, len(c.Expiration.Policies))
+	for payer := range c.Expiration.Policies {
+		payers = append(payers, payer)
+	}
+	sort.Strings(payers)
+	canonical := make(map[string]string, len(payers))
+	for _, payer := range payers {
+		if _, err := c.Expiration.Policies[payer].Build(); err != nil {
+			problems = append(problems, fmt.Sprintf("expiration.policies.%s: %v", payer, err))
+		}
+		id := services.CanonicalPayerID(payer)
+		if other, ok := canonical[id]; ok {
+			problems = append(problems, fmt.Sprintf("expiration.policies: %q and %q name the same payer %s", other, payer, id))
+		}
+		canonical[id] = payer
+	}
+
+	check(c.Idempotency.Window > 0, "idempotency.window must be positive")
+	check(c.Idempotency.Lease > 0, "idempotency.lease must be positive")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// SpendStrategy returns the default services.SpendStrategy
+func (c Config) SpendStrategy() (services.SpendStrategy, error) {
+	return services.NewSpendStrategy(c.Spend.Strategy, c.Spend.PayerPriority)
+}
+
+// ExpirationPolicies returns the services.ExpirationPolicy of each payer that has one, keyed by
+// the payer's canonical ID
+func (c Config) ExpirationPolicies() (map[string]services.ExpirationPolicy, error) {
+	policies := make(map[string]services.ExpirationPolicy, len(c.Expiration.Policies))
+	for payer, config := range c.Expiration.Policies {
+		policy, err := config.Build()
+		if err != nil {
+			return nil, fmt.Errorf("expiration policy for %s: %w", payer, err)
+		}
+		id := services.CanonicalPayerID(payer)
+		if _, ok := policies[id]; ok {
+			return nil, fmt.Errorf("more than one expiration policy for %s", id)
+		}
+		policies[id] = policy
+	}
+	return policies, nil
+}
+
+// Build returns the services.ExpirationPolicy the config describes
+func (p ExpirationPolicy) Build() (services.ExpirationPolicy, error) {
+	switch p.Kind {
+	case ExpireMonths:
+		if p.Months < 1 {
+			return nil, fmt.Errorf("months must be at least 1")
+		}
+		return services.ExpireAfterMonths{Months: p.Months}, nil
+	case ExpireQuarter:
+		if p.QuartersAfter < 0 {
+			return nil, fmt.Errorf("quartersAfter must not be negative")
+		}
+		return services.ExpireEndOfQuarter{QuartersAfter: p.QuartersAfter}, nil
+	default:
+		return nil, fmt.Errorf("unknown kind %q, expected %s or %s", p.Kind, ExpireMonths, ExpireQuarter)
+	}
+}
@@ -0,0 +1,246 @@
+package config_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/config"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/web"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+listen:
+  address: ":9000"
+  shutdownTimeout: 5s
+storage:
+  backend: file
+  dataDir: ./from-file
+rateLimits:
+  userWrites: "2:4"
+spend:
+  strategy: payer-priority
+  payerPriority: [DANNON]
+  holdDuration: 10m
+expiration:
+  policies:
+    DANNON: {kind: end-of-quarter, quartersAfter: 1}
+    UNILEVER: {kind: months, months: 12}
+`
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, testConfig)
+
+	tests := map[string]struct {
+		args     []string
+		env      map[string]string
+		expected func(c *config.Config)
+	}{
+		"defaults": {
+			expected: func(c *config.Config) {},
+		},
+		"port argument": {
+			args:     []string{"9090"},
+			expected: func(c *config.Config) { c.Listen.Address = ":9090" },
+		},
+		"file": {
+			args: []string{"-config", path},
+			expected: func(c *config.Config) {
+				c.Listen.Address = ":9000"
+				c.Listen.ShutdownTimeout = 5 * time.Second
+				c.Storage = config.Storage{Backend: config.StorageFile, DataDir: "./from-file"}
+				c.RateLimits.UserWrites = web.RateLimit{Rate: 2, Burst: 4}
+				c.Spend = config.Spend{Strategy: services.StrategyPayerPriority, PayerPriority: []string{"DANNON"}, HoldDuration: 10 * time.Minute}
+				c.Expiration.Policies = map[string]config.ExpirationPolicy{
+					"DANNON":   {Kind: config.ExpireQuarter, QuartersAfter: 1},
+					"UNILEVER": {Kind: config.ExpireMonths, Months: 12},
+				}
+			},
+		},
+		"environment overrides file": {
+			env: map[string]string{
+				"POINTS_API_CONFIG":            path,
+				"POINTS_API_DATA_DIR":          "./from-env",
+				"POINTS_API_USER_WRITE_LIMIT":  "1:1",
+				"POINTS_API_USER_TOKEN_SECRET": "secret",
+			},
+			expected: func(c *config.Config) {
+				c.Listen.Address = ":9000"
+				c.Listen.ShutdownTimeout = 5 * time.Second
+				c.Storage = config.Storage{Backend: config.StorageFile, DataDir: "./from-env"}
+				c.Auth.UserTokenSecret = "secret"
+				c.RateLimits.UserWrites = web.RateLimit{Rate: 1, Burst: 1}
+				c.Spend = config.Spend{Strategy: services.StrategyPayerPriority, PayerPriority: []string{"DANNON"}, HoldDuration: 10 * time.Minute}
+				c.Expiration.Policies = map[string]config.ExpirationPolicy{
+					"DANNON":   {Kind: config.ExpireQuarter, QuartersAfter: 1},
+					"UNILEVER": {Kind: config.ExpireMonths, Months: 12},
+				}
+			},
+		},
+		"flags override environment": {
+			args: []string{"-data-dir", "./from-flag", "-payer-priority", "UNILEVER, DANNON", "-listen", "127.0.0.1:9001"},
+			env:  map[string]string{"POINTS_API_DATA_DIR": "./from-env", "POINTS_API_LISTEN": ":9002"},
+			expected: func(c *config.Config) {
+				c.Listen.Address = "127.0.0.1:9001"
+				c.Storage.DataDir = "./from-flag"
+				c.Spend.PayerPriority = []string{"UNILEVER", "DANNON"}
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			expected := config.Default()
+			tc.expected(&expected)
+
+			actual, printConfig, err := config.Load(tc.args, getenv(tc.env))
+			assert.NoError(t, err)
+			assert.False(t, printConfig)
+			assert.Equal(t, expected, actual)
+			assert.NoError(t, actual.Validate())
+		})
+	}
+}
+
+func TestLoad_errors(t *testing.T) {
+	tests := map[string]struct {
+		args []string
+		env  map[string]string
+	}{
+		"unknown key in file": {args: []string{"-config", writeConfig(t, "storge: {backend: file}")}},
+		"missing file":        {args: []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}},
+		"invalid rate limit":  {args: []string{"-config", writeConfig(t, "rateLimits: {userReads: fast}")}},
+		"invalid environment": {env: map[string]string{"POINTS_API_HOLD_DURATION": "forever"}},
+		"invalid flag":        {args: []string{"-hold-duration", "forever"}},
+		"invalid port":        {args: []string{"http"}},
+		"too many arguments":  {args: []string{"9090", "9091"}},
+		"unknown flag":        {args: []string{"-verbose"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := config.Load(tc.args, getenv(tc.env))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		modify   func(c *config.Config)
+		expected string
+	}{
+		"listen address": {
+			modify:   func(c *config.Config) { c.Listen.Address = "8090" },
+			expected: "listen.address",
+		},
+		"TLS key without a certificate": {
+			modify:   func(c *config.Config) { c.Listen.TLS.KeyFile = "key.pem" },
+			expected: "certFile and keyFile must be set together",
+		},
+		"storage backend": {
+			modify:   func(c *config.Config) { c.Storage.Backend = "postgres" },
+			expected: `unknown backend "postgres"`,
+		},
+		"API keys file": {
+			modify:   func(c *config.Config) { c.Auth.APIKeysFile = "missing.json" },
+			expected: "auth.apiKeysFile",
+		},
+		"spend strategy": {
+			modify:   func(c *config.Config) { c.Spend.Strategy = services.StrategyPayerPriority },
+			expected: "spend.strategy",
+		},
+		"expiration policy": {
+			modify: func(c *config.Config) {
+				c.Expiration.Policies = map[string]config.ExpirationPolicy{"DANNON": {Kind: config.ExpireMonths}}
+			},
+			expected: "expiration.policies.DANNON: months must be at least 1",
+		},
+		"expiration policies for the same payer": {
+			modify: func(c *config.Config) {
+				c.Expiration.Policies = map[string]config.ExpirationPolicy{
+					"DANNON":  {Kind: config.ExpireMonths, Months: 1},
+					"Dannon ": {Kind: config.ExpireMonths, Months: 2},
+				}
+			},
+			expected: `"DANNON" and "Dannon " name the same payer DANNON`,
+		},
+		"timeouts": {
+			modify:   func(c *config.Config) { c.Listen.WriteTimeout = 0 },
+			expected: "listen.writeTimeout must be positive",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := config.Default()
+			tc.modify(&c)
+			err := c.Validate()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.expected)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	c := config.Default()
+	c.Storage.Backend = ""
+	c.Payers.Mode = ""
+	err := c.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "storage.backend")
+		assert.Contains(t, err.Error(), "payers.mode")
+	}
+}
+
+func TestPrint(t *testing.T) {
+	c, _, err := config.Load([]string{"-config", writeConfig(t, testConfig)}, getenv(map[string]string{"POINTS_API_USER_TOKEN_SECRET": "secret"}))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, c.Print(&out))
+	assert.NotContains(t, out.String(), "secret\n")
+	assert.Contains(t, out.String(), "userTokenSecret: REDACTED")
+
+	// The printed config can be read back
+	printed, _, err := config.Load([]string{"-config", writeConfig(t, out.String())}, getenv(nil))
+	assert.NoError(t, err)
+	c.Auth.UserTokenSecret = "REDACTED"
+	assert.Equal(t, c, printed)
+}
+
+func TestExpirationPolicies(t *testing.T) {
+	c := config.Default()
+	c.Expiration.Policies = map[string]config.ExpirationPolicy{
+		"DANNON":        {Kind: config.ExpireQuarter, QuartersAfter: 1},
+		"Miller  Coors": {Kind: config.ExpireMonths, Months: 12},
+	}
+	policies, err := c.ExpirationPolicies()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]services.ExpirationPolicy{
+		"DANNON":       services.ExpireEndOfQuarter{QuartersAfter: 1},
+		"MILLER COORS": services.ExpireAfterMonths{Months: 12},
+	}, policies)
+
+	c.Expiration.Policies["dannon"] = config.ExpirationPolicy{Kind: config.ExpireMonths, Months: 1}
+	_, err = c.ExpirationPolicies()
+	assert.Error(t, err)
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func getenv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"fetchrewards.com/points-api/internal/web"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of the environment variable for each flag, so -data-dir can also be
+// set with POINTS_API_DATA_DIR
+const EnvPrefix = "POINTS_API_"
+
+const (
+	flagConfig      = "config"
+	flagPrintConfig = "print-config"
+)
+
+// Load builds the configuration from the defaults, then the YAML file named by -config or
+// POINTS_API_CONFIG, then the environment and finally the command line, each overriding the
+// ones before it. A single positional argument is the port to listen on. Load also reports
+// whether -print-config was given. The result is not validated.
+func Load(args []string, getenv func(string) string) (Config, bool, error) {
+	c := Default()
+	var file string
+	var printConfig bool
+	flags := newFlagSet(&c, &file, &printConfig)
+
+	// The first pass only finds the config file, the flags are applied again once the file
+	// and the environment have been
+	if err := flags.Parse(args); err != nil {
+		return c, false, err
+	}
+	if file == "" {
+		file = getenv(envName(flagConfig))
+	}
+	c = Default()
+	if file != "" {
+		if err := readFile(file, &c); err != nil {
+			return c, false, err
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == flagConfig || f.Name == flagPrintConfig {
+			return
+		}
+		if value := getenv(envName(f.Name)); value != "" {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return c, false, err
+	}
+	if secret := getenv(web.UserTokenSecretEnv); secret != "" {
+		c.Auth.UserTokenSecret = secret
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return c, false, err
+	}
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		port, err := strconv.Atoi(flags.Arg(0))
+		if err != nil || port < 0 || port > 65535 {
+			return c, false, fmt.Errorf("invalid port number %s", flags.Arg(0))
+		}
+		c.Listen.Address = fmt.Sprintf(":%d", port)
+	default:
+		return c, false, fmt.Errorf("expected at most one argument, the port, got %d", flags.NArg())
+	}
+	return c, printConfig, nil
+}
+
+// Print writes the configuration as YAML, in the format Load reads, with secrets redacted
+func (c Config) Print(w io.Writer) error {
+	if c.Auth.UserTokenSecret != "" {
+		c.Auth.UserTokenSecret = "REDACTED"
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// readFile overlays the YAML file at path onto c. Keys that do not match a setting are
+// rejected, so a typo does not silently leave the default in place.
+func readFile(path string, c *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+func newFlagSet(c *Config, file *string, printConfig *bool) *flag.FlagSet {
+	flags := flag.NewFlagSet("api", flag.ContinueOnError)
+	flags.StringVar(file, flagConfig, "", "YAML file to read the configuration from")
+	flags.BoolVar(printConfig, flagPrintConfig, false, "print the effective configuration as YAML and exit")
+
+	flags.StringVar(&c.Listen.Address, "listen", c.Listen.Address, "address to listen on")
+	flags.StringVar(&c.Listen.TLS.CertFile, "tls-cert", c.Listen.TLS.CertFile, "certificate file to serve HTTPS with, requires -tls-key")
+	flags.StringVar(&c.Listen.TLS.KeyFile, "tls-key", c.Listen.TLS.KeyFile, "private key file to serve HTTPS with, requires -tls-cert")
+	flags.DurationVar(&c.Listen.ReadTimeout, "read-timeout", c.Listen.ReadTimeout, "how long clients have to send a request")
+	flags.DurationVar(&c.Listen.WriteTimeout, "write-timeout", c.Listen.WriteTimeout, "how long a request can take before its response is written")
+	flags.DurationVar(&c.Listen.IdleTimeout, "idle-timeout", c.Listen.IdleTimeout, "how long idle keep-alive connections are kept open")
+	flags.DurationVar(&c.Listen.ShutdownTimeout, "shutdown-timeout", c.Listen.ShutdownTimeout, "how long in-flight requests are given to finish on SIGINT or SIGTERM")
+
+	flags.StringVar(&c.Storage.Backend, "storage", c.Storage.Backend, "storage backend to use, either memory or file")
+	flags.StringVar(&c.Storage.DataDir, "data-dir", c.Storage.DataDir, "directory used by the file storage backend")
+
+	flags.StringVar(&c.Auth.APIKeysFile, "api-keys", c.Auth.APIKeysFile, "JSON file of the API keys clients authenticate with, the API is open when not set")
+	flags.DurationVar(&c.Auth.TokenLeeway, "token-leeway", c.Auth.TokenLeeway, "clock skew allowed when checking when user tokens expire")
+
+	flags.Var(&c.RateLimits.ClientReads, "client-read-limit", "reads per second each API client can make, as rate:burst, 0 for no limit")
+	flags.Var(&c.RateLimits.ClientWrites, "client-write-limit", "writes per second each API client can make, as rate:burst, 0 for no limit")
+	flags.Var(&c.RateLimits.UserReads, "user-read-limit", "reads per second that can be made for each user, as rate:burst, 0 for no limit")
+	flags.Var(&c.RateLimits.UserWrites, "user-write-limit", "writes per second that can be made for each user, as rate:burst, 0 for no limit")
+
+	flags.StringVar(&c.Payers.Mode, "payer-mode", c.Payers.Mode, "strict rejects points from unregistered payers, permissive registers them")
+	flags.BoolVar(&c.Payers.Budgets, "payer-budgets", c.Payers.Budgets, "draw the points added for a payer from its prepaid budget")
+
+	flags.StringVar(&c.Spend.Strategy, "spend-strategy", c.Spend.Strategy, "default order in which spends draw from a user's points")
+	flags.Var((*listValue)(&c.Spend.PayerPriority), "payer-priority", "comma separated payers to spend first with the payer-priority strategy")
+	flags.DurationVar(&c.Spend.HoldDuration, "hold-duration", c.Spend.HoldDuration, "how long held points stay earmarked before the hold expires")
+
+	flags.DurationVar(&c.Expiration.SweepInterval, "expiration-sweep-interval", c.Expiration.SweepInterval, "how often expired points are swept")
+
+	flags.DurationVar(&c.Idempotency.Window, "idempotency-window", c.Idempotency.Window, "how long responses to requests with an Idempotency-Key are kept for replay")
+	flags.DurationVar(&c.Idempotency.Lease, "idempotency-lease", c.Idempotency.Lease, "how long a request in progress holds its Idempotency-Key before a retry can take it over")
+	return flags
+}
+
+// envName returns the environment variable that sets the flag with the given name
+func envName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// listValue is a comma separated list flag
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
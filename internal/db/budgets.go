@@ -0,0 +1,288 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// budgetChange is a single change to a payer's budget: its new state and, if the balance
+// changed, the entry recording why
+type budgetChange struct {
+	Budget model.PayerBudget  `json:"budget"`
+	Entry  *model.BudgetEntry `json:"entry,omitempty"`
+}
+
+// budgetRecords holds the budget of every payer that has one, keyed by payer ID. Each payer's
+// budget has its own lock, so updates to the budgets of different payers do not contend with
+// each other. mu only guards the map.
+type budgetRecords struct {
+	mu     sync.RWMutex
+	payers map[string]*payerBudget
+}
+
+// payerBudget holds the budget of a single payer along with its entries. requests indexes the
+// entries written by requests with a RequestID. seq is the sequence number of the last log
+// record applied, when the budget is kept by a FileDB.
+type payerBudget struct {
+	mu       sync.Mutex
+	budget   model.PayerBudget
+	exists   bool
+	entries  []model.BudgetEntry
+	requests map[string]model.BudgetEntry
+	seq      uint64
+}
+
+// payer returns the budget of the payer with the given ID, if it has one
+func (r *budgetRecords) payer(payerID string) (*payerBudget, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	budget, ok := r.payers[payerID]
+	return budget, ok
+}
+
+// getOrCreatePayer returns the budget of the payer with the given ID, adding an empty one if
+// the payer has none. The empty budget is not reported by get until a change is applied to it.
+func (r *budgetRecords) getOrCreatePayer(payerID string) *payerBudget {
+	if budget, ok := r.payer(payerID); ok {
+		return budget
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another writer may have added the budget between the two locks
+	if budget, ok := r.payers[payerID]; ok {
+		return budget
+	}
+	budget := &payerBudget{budget: model.PayerBudget{PayerID: payerID}}
+	r.payers[payerID] = budget
+	return budget
+}
+
+// list returns the budgets of every payer
+func (r *budgetRecords) list() []*payerBudget {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	budgets := make([]*payerBudget, 0, len(r.payers))
+	for _, budget := range r.payers {
+		budgets = append(budgets, budget)
+	}
+	return budgets
+}
+
+// apply makes the change. Must be called while holding b.mu.
+func (b *payerBudget) apply(change budgetChange) {
+	change.Budget.Requests = nil
+	b.budget = change.Budget
+	b.exists = true
+	if change.Entry != nil {
+		b.entries = append(b.entries, *change.Entry)
+		b.indexRequest(*change.Entry)
+	}
+}
+
+// setEntries replaces the entries of the budget. Must be called while holding b.mu.
+func (b *payerBudget) setEntries(entries []model.BudgetEntry) {
+	b.entries = entries
+	b.requests = nil
+	for _, entry := range entries {
+		b.indexRequest(entry)
+	}
+}
+
+// indexRequest adds the entry to b.requests if it was written by a request with a RequestID.
+// Must be called while holding b.mu.
+func (b *payerBudget) indexRequest(entry model.BudgetEntry) {
+	if entry.RequestID == "" {
+		return
+	}
+	if b.requests == nil {
+		b.requests = make(map[string]model.BudgetEntry)
+	}
+	b.requests[entry.RequestID] = entry
+}
+
+// update runs fn against the budget of the payer, or an empty budget if the payer has none,
+// and applies the change it returns. If commit is not nil it is called with the change first
+// and returns the sequence number it was logged with, or an error to veto it.
+func (r *budgetRecords) update(payerID string, fn func(model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error), commit func(budgetChange) (uint64, error)) error {
+	payer := r.getOrCreatePayer(payerID)
+	payer.mu.Lock()
+	defer payer.mu.Unlock()
+
+	budget, entry, err := fn(payer.current())
+	if err != nil {
+		return err
+	}
+	budget.PayerID = payerID
+	change := budgetChange{Budget: budget, Entry: entry}
+	if commit != nil {
+		seq, err := commit(change)
+		if err != nil {
+			return err
+		}
+		payer.seq = seq
+	}
+	payer.apply(change)
+	return nil
+}
+
+// current returns a copy of the budget that fn can modify. Its Requests are not copied, so fn
+// must not modify them. Must be called while holding b.mu.
+func (b *payerBudget) current() model.PayerBudget {
+	budget := b.budget
+	budget.IssuedOnDayByUser = copyCounts(budget.IssuedOnDayByUser)
+	budget.Requests = b.requests
+	return budget
+}
+
+func (r *budgetRecords) get(payerID string) (model.PayerBudget, bool) {
+	payer, ok := r.payer(payerID)
+	if !ok {
+		return model.PayerBudget{}, false
+	}
+	payer.mu.Lock()
+	defer payer.mu.Unlock()
+
+	if !payer.exists {
+		return model.PayerBudget{}, false
+	}
+	budget := payer.budget
+	budget.IssuedOnDayByUser = copyCounts(budget.IssuedOnDayByUser)
+	return budget, true
+}
+
+func (r *budgetRecords) getEntries(payerID string) []model.BudgetEntry {
+	payer, ok := r.payer(payerID)
+	if !ok {
+		return []model.BudgetEntry{}
+	}
+	payer.mu.Lock()
+	defer payer.mu.Unlock()
+
+	entries := make([]model.BudgetEntry, len(payer.entries))
+	copy(entries, payer.entries)
+	return entries
+}
+
+// prune drops the entries created before the given time. The budget keeps its totals. Must be
+// called while holding b.mu.
+func (b *payerBudget) prune(before time.Time) {
+	kept := make([]model.BudgetEntry, 0, len(b.entries))
+	for _, entry := range b.entries {
+		if !entry.CreatedAt.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	b.setEntries(kept)
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	if counts == nil {
+		return nil
+	}
+	result := make(map[string]int, len(counts))
+	for key, count := range counts {
+		result[key] = count
+	}
+	return result
+}
+
+// GetBudget returns the budget of the payer with the given ID
+func (db *InMemoryDB) GetBudget(payerID string) (model.PayerBudget, bool) {
+	return db.budgets.get(payerID)
+}
+
+// GetBudgetEntries returns the entries of the payer's budget in the order they were written
+func (db *InMemoryDB) GetBudgetEntries(payerID string) []model.BudgetEntry {
+	return db.budgets.getEntries(payerID)
+}
+
+// UpdateBudget runs fn as a unit of work against the budget of the payer with the given ID,
+// which is empty if the payer has no budget yet, along with the entries of requests with a
+// RequestID in its Requests. fn returns the budget to store in its place and, if the balance
+// changed, the entry to append. Nothing is stored if fn returns an error.
+func (db *InMemoryDB) UpdateBudget(payerID string, fn func(model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error)) error {
+	return db.budgets.update(payerID, fn, nil)
+}
+
+// UpdateLedgerAndBudget runs fn as a single unit of work against the user's ledger, like
+// UpdateLedger, and the budget of the payer with the given ID, like UpdateBudget. The records,
+// budget and entry returned by fn are stored all together, or not at all if fn returns an
+// error, so points are never added without being drawn from the budget or the other way round.
+// Nothing is stored either if fn returns neither records nor an entry.
+func (db *InMemoryDB) UpdateLedgerAndBudget(userID, payerID string, fn func(model.Ledger, model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error)) error {
+	return db.updateLedgerAndBudget(userID, payerID, fn, nil)
+}
+
+// updateLedgerAndBudget implements UpdateLedgerAndBudget. If commit is not nil it is called
+// with the new records and the budget change before they are applied and returns the sequence
+// number they were logged with, or an error to veto them. The user's ledger is locked before
+// the payer's budget, which no other update holds while waiting for a ledger.
+func (db *InMemoryDB) updateLedgerAndBudget(userID, payerID string, fn func(model.Ledger, model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error), commit func(model.Ledger, budgetChange) (uint64, error)) error {
+	ledger := db.getOrCreateLedger(userID)
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	payer := db.budgets.getOrCreatePayer(payerID)
+	payer.mu.Lock()
+	defer payer.mu.Unlock()
+
+	added, budget, entry, err := fn(ledger.view(), payer.current())
+	if err != nil {
+		return err
+	}
+	if len(added.Transactions) == 0 && len(added.Allocations) == 0 && len(added.Holds) == 0 && entry == nil {
+		return nil
+	}
+	budget.PayerID = payerID
+	change := budgetChange{Budget: budget, Entry: entry}
+	if commit != nil {
+		seq, err := commit(added, change)
+		if err != nil {
+			return err
+		}
+		ledger.seq = seq
+		payer.seq = seq
+	}
+	ledger.apply(added)
+	payer.apply(change)
+	return nil
+}
+
+// GetBudget returns the budget of the payer with the given ID
+func (db *FileDB) GetBudget(payerID string) (model.PayerBudget, bool) {
+	return db.mem.GetBudget(payerID)
+}
+
+// GetBudgetEntries returns the entries of the payer's budget in the order they were written
+func (db *FileDB) GetBudgetEntries(payerID string) []model.BudgetEntry {
+	return db.mem.GetBudgetEntries(payerID)
+}
+
+// UpdateBudget durably stores the budget and entry returned by fn. See
+// InMemoryDB.UpdateBudget.
+func (db *FileDB) UpdateBudget(payerID string, fn func(model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error)) error {
+	return db.mem.budgets.update(payerID, fn, db.commitBudget)
+}
+
+// UpdateLedgerAndBudget durably stores the records, budget and entry returned by fn as a single
+// log record. See InMemoryDB.UpdateLedgerAndBudget.
+func (db *FileDB) UpdateLedgerAndBudget(userID, payerID string, fn func(model.Ledger, model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error)) error {
+	return db.mem.updateLedgerAndBudget(userID, payerID, fn, func(records model.Ledger, change budgetChange) (uint64, error) {
+		return db.commit(walRecord{
+			UserID:       userID,
+			Transactions: records.Transactions,
+			Allocations:  records.Allocations,
+			Holds:        records.Holds,
+			Budget:       &change,
+		})
+	})
+}
+
+func (db *FileDB) commitBudget(change budgetChange) (uint64, error) {
+	return db.commit(walRecord{Budget: &change})
+}
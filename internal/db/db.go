@@ -3,61 +3,196 @@ package db
 import (
 	"log"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"fetchrewards.com/points-api/internal/model"
 )
 
-// InMemoryDB holds all Transactions in memory and provides various accessors for the data
+// InMemoryDB holds all Transactions in memory and provides various accessors for the data.
+// It is safe for concurrent use. Each user's transactions are guarded by their own lock so
+// requests for different users do not contend with each other.
 type InMemoryDB struct {
-	UserTransactions map[string][]model.Transaction
+	mu    sync.RWMutex
+	users map[string]*userLedger
+	// totalPoints projects the sum of every user's transactions. It is updated atomically as
+	// transactions are inserted, under the lock of the user they belong to.
+	totalPoints *int64
+
+	idempotency idempotencyRecords
+	payers      payerRecords
+	budgets     budgetRecords
+}
+
+// userLedger holds the records of a single user. Transactions are kept in time ascending
+// order, allocations and holds in the order they were written. balances projects the sum of
+// the transactions per payer and lots the user's lots and holds. Both are kept up to date as
+// records are written, so reading them does not replay the whole history. requests indexes the
+// records written by requests with a RequestID. totalPoints is the database's
+// InMemoryDB.totalPoints. seq is the sequence number of the last log record applied, when the
+// ledger is kept by a FileDB.
+type userLedger struct {
+	mu           sync.RWMutex
+	transactions []model.Transaction
+	allocations  []model.Allocation
+	holds        []model.Hold
+	balances     map[string]int
+	lots         lotProjection
+	requests     map[string]model.Ledger
+	totalPoints  *int64
+	seq          uint64
 }
 
 // NewInMemoryDB returns a new InMemoryDB and initializes an empty slice of model.Transactions.
 // Because this is an in-memory implementation, state is not maintained between app restarts.
 func NewInMemoryDB() *InMemoryDB {
 	log.Println("Creating new in-memory database")
+	return newInMemoryDB()
+}
 
-	userTransactions := make(map[string][]model.Transaction)
+func newInMemoryDB() *InMemoryDB {
 	return &InMemoryDB{
-		UserTransactions: userTransactions,
+		users:       make(map[string]*userLedger),
+		totalPoints: new(int64),
+		idempotency: idempotencyRecords{
+			records: make(map[string]model.IdempotencyRecord),
+		},
+		payers: payerRecords{
+			payers: make(map[string]model.Payer),
+		},
+		budgets: budgetRecords{
+			payers: make(map[string]*payerBudget),
+		},
 	}
 }
 
-// GetTransactions returns all the model.Transaction records in time ascending order for the user
+// Ready always reports that the InMemoryDB can serve requests
+func (db *InMemoryDB) Ready() error {
+	return nil
+}
+
+// GetTransactions returns all the model.Transaction records in time ascending order for the user.
+// The returned slice is a copy and may be modified by the caller.
 func (db *InMemoryDB) GetTransactions(userID string) []model.Transaction {
-	if transactions, ok := db.UserTransactions[userID]; ok {
-		sort.Slice(transactions, func(i, j int) bool {
-			return transactions[i].Timestamp.Before(transactions[j].Timestamp)
-		})
-		return transactions
-	} else {
+	ledger, ok := db.getLedger(userID)
+	if !ok {
 		return []model.Transaction{}
 	}
+
+	ledger.mu.RLock()
+	defer ledger.mu.RUnlock()
+
+	transactions := make([]model.Transaction, len(ledger.transactions))
+	copy(transactions, ledger.transactions)
+	return transactions
 }
 
 // AddTransaction adds the given model.Transaction for this user. This function
 // makes no assumptions about business logic. For example it does no validation
-// that the sum of transactions should not be negative
-func (db *InMemoryDB) AddTransaction(userID string, transaction model.Transaction) {
-	if transactions, ok := db.UserTransactions[userID]; ok {
-		db.UserTransactions[userID] = append(transactions, transaction)
-	} else {
-		db.UserTransactions[userID] = []model.Transaction{transaction}
+// that the sum of transactions should not be negative. The in-memory implementation never
+// returns an error.
+func (db *InMemoryDB) AddTransaction(userID string, transaction model.Transaction) error {
+	ledger := db.getOrCreateLedger(userID)
+
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	ledger.apply(model.Ledger{Transactions: []model.Transaction{transaction}})
+	return nil
+}
+
+// GetLedger returns a copy of all the records stored for the user. The projections, Lots and
+// OpenHolds, are left out; see GetOpenLots.
+func (db *InMemoryDB) GetLedger(userID string) model.Ledger {
+	ledger, ok := db.getLedger(userID)
+	if !ok {
+		return model.Ledger{
+			Transactions: []model.Transaction{},
+			Allocations:  []model.Allocation{},
+			Holds:        []model.Hold{},
+		}
+	}
+
+	ledger.mu.RLock()
+	defer ledger.mu.RUnlock()
+
+	return ledger.copy()
+}
+
+// GetOpenLots returns the user's lots that have points remaining and the holds that are
+// authorized, as projected from the records. See model.Ledger. Unlike GetLedger it does not
+// copy the user's whole history.
+func (db *InMemoryDB) GetOpenLots(userID string) model.Ledger {
+	ledger, ok := db.getLedger(userID)
+	if !ok {
+		return model.Ledger{Lots: []model.Lot{}, OpenHolds: []model.Hold{}}
+	}
+
+	ledger.mu.RLock()
+	defer ledger.mu.RUnlock()
+
+	result := model.Ledger{
+		Lots:      make([]model.Lot, len(ledger.lots.open)),
+		OpenHolds: make([]model.Hold, len(ledger.lots.holds)),
+	}
+	copy(result.Lots, ledger.lots.open)
+	copy(result.OpenHolds, ledger.lots.holds)
+	return result
+}
+
+// UpdateLedger runs fn as a unit of work against the user's ledger. fn receives the user's
+// current records, with transactions in time ascending order, and their projections, and
+// returns the records to append. The records are not copied, so fn must not modify them; appending to the slices is
+// safe. The user's ledger is locked for the whole call, so updates for the same user are
+// serialized and fn sees every record committed before it, while updates for other users
+// proceed in parallel. The records returned by fn are appended all together, or not at all if
+// fn returns an error.
+func (db *InMemoryDB) UpdateLedger(userID string, fn func(model.Ledger) (model.Ledger, error)) error {
+	return db.update(userID, fn, nil)
+}
+
+// update implements UpdateLedger. If commit is not nil it is called with the new records
+// before they are applied and returns the sequence number they were logged with, or an error
+// to veto them.
+func (db *InMemoryDB) update(userID string, fn func(model.Ledger) (model.Ledger, error), commit func(model.Ledger) (uint64, error)) error {
+	ledger := db.getOrCreateLedger(userID)
+
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	added, err := fn(ledger.view())
+	if err != nil {
+		return err
 	}
+	if len(added.Transactions) == 0 && len(added.Allocations) == 0 && len(added.Holds) == 0 {
+		return nil
+	}
+	if commit != nil {
+		seq, err := commit(added)
+		if err != nil {
+			return err
+		}
+		ledger.seq = seq
+	}
+	ledger.apply(added)
+	return nil
 }
 
 // GetAccounts returns all model.Accounts, or payers, across all transactions for this user
 func (db *InMemoryDB) GetAccounts(userID string) []model.Account {
-	accountMap := db.getAccountMap(userID)
+	return sortedAccounts(db.getAccountMap(userID))
+}
 
-	result := make([]model.Account, 0)
-	for _, value := range accountMap {
-		result = append(result, value)
-	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].Payer < result[j].Payer
+// GetAccountsAsOf returns all model.Accounts for this user as they stood at the given time,
+// counting only the transactions at or before it
+func (db *InMemoryDB) GetAccountsAsOf(userID string, asOf time.Time) []model.Account {
+	transactions := db.GetTransactions(userID)
+	// Transactions are sorted by time, so the ones to count come first
+	n := sort.Search(len(transactions), func(i int) bool {
+		return transactions[i].Timestamp.After(asOf)
 	})
-	return result
+	return sortedAccounts(accountsOf(transactions[:n]))
 }
 
 // GetAccount returns the model.Account associated with the payer for this user
@@ -67,9 +202,26 @@ func (db *InMemoryDB) GetAccount(userID, payer string) (model.Account, bool) {
 	return account, found
 }
 
+// getAccountMap reads the user's accounts from the balances projection
 func (db *InMemoryDB) getAccountMap(userID string) map[string]model.Account {
+	accountMap := make(map[string]model.Account)
+	ledger, ok := db.getLedger(userID)
+	if !ok {
+		return accountMap
+	}
+
+	ledger.mu.RLock()
+	defer ledger.mu.RUnlock()
+
+	for payer, points := range ledger.balances {
+		accountMap[payer] = model.Account{Payer: payer, Points: points}
+	}
+	return accountMap
+}
+
+// accountsOf sums the transactions per payer
+func accountsOf(transactions []model.Transaction) map[string]model.Account {
 	var accountMap = make(map[string]model.Account)
-	transactions := db.GetTransactions(userID)
 	for _, tran := range transactions {
 		if account, ok := accountMap[tran.Payer]; ok {
 			account.Points += tran.Points
@@ -83,3 +235,139 @@ func (db *InMemoryDB) getAccountMap(userID string) map[string]model.Account {
 	}
 	return accountMap
 }
+
+// sortedAccounts returns the accounts ordered by payer
+func sortedAccounts(accountMap map[string]model.Account) []model.Account {
+	result := make([]model.Account, 0, len(accountMap))
+	for _, value := range accountMap {
+		result = append(result, value)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Payer < result[j].Payer
+	})
+	return result
+}
+
+// GetTotalPoints returns the sum of every user's balances, which is every point that has been
+// added and not spent or expired. It is kept up to date as transactions are written.
+func (db *InMemoryDB) GetTotalPoints() int {
+	return int(atomic.LoadInt64(db.totalPoints))
+}
+
+// GetUserIDs returns the IDs of every user with stored records, in ascending order
+func (db *InMemoryDB) GetUserIDs() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	userIDs := make([]string, 0, len(db.users))
+	for userID := range db.users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+func (db *InMemoryDB) getLedger(userID string) (*userLedger, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ledger, ok := db.users[userID]
+	return ledger, ok
+}
+
+func (db *InMemoryDB) getOrCreateLedger(userID string) *userLedger {
+	if ledger, ok := db.getLedger(userID); ok {
+		return ledger
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Another writer may have created the ledger between the two locks
+	if ledger, ok := db.users[userID]; ok {
+		return ledger
+	}
+	ledger := newUserLedger(db.totalPoints)
+	db.users[userID] = ledger
+	return ledger
+}
+
+func newUserLedger(totalPoints *int64) *userLedger {
+	return &userLedger{
+		balances:    make(map[string]int),
+		lots:        newLotProjection(),
+		requests:    make(map[string]model.Ledger),
+		totalPoints: totalPoints,
+	}
+}
+
+// copy returns a copy of the ledger's records. Must be called while holding l.mu.
+func (l *userLedger) copy() model.Ledger {
+	result := model.Ledger{
+		Transactions: make([]model.Transaction, len(l.transactions)),
+		Allocations:  make([]model.Allocation, len(l.allocations)),
+		Holds:        make([]model.Hold, len(l.holds)),
+	}
+	copy(result.Transactions, l.transactions)
+	copy(result.Allocations, l.allocations)
+	copy(result.Holds, l.holds)
+	return result
+}
+
+// view returns the ledger's records and projections without copying them. The slices are
+// capped at their length so appending to them never writes to the ledger. Must be called while
+// holding l.mu and the result must not be used after releasing it.
+func (l *userLedger) view() model.Ledger {
+	return model.Ledger{
+		Transactions: l.transactions[:len(l.transactions):len(l.transactions)],
+		Allocations:  l.allocations[:len(l.allocations):len(l.allocations)],
+		Holds:        l.holds[:len(l.holds):len(l.holds)],
+		Lots:         l.lots.open[:len(l.lots.open):len(l.lots.open)],
+		OpenHolds:    l.lots.holds[:len(l.lots.holds):len(l.lots.holds)],
+		Requests:     l.requests,
+	}
+}
+
+// apply appends the given records and updates the projections. Must be called while holding
+// l.mu.
+func (l *userLedger) apply(records model.Ledger) {
+	l.insert(records.Transactions...)
+	l.allocations = append(l.allocations, records.Allocations...)
+	l.holds = append(l.holds, records.Holds...)
+	l.lots.apply(records)
+	l.indexRequests(records)
+}
+
+// indexRequests adds the records written by requests with a RequestID to l.requests. Must be
+// called while holding l.mu.
+func (l *userLedger) indexRequests(records model.Ledger) {
+	for _, tran := range records.Transactions {
+		if tran.RequestID != "" {
+			written := l.requests[tran.RequestID]
+			written.Transactions = append(written.Transactions, tran)
+			l.requests[tran.RequestID] = written
+		}
+	}
+	for _, hold := range records.Holds {
+		if hold.RequestID != "" {
+			written := l.requests[hold.RequestID]
+			written.Holds = append(written.Holds, hold)
+			l.requests[hold.RequestID] = written
+		}
+	}
+}
+
+// insert adds each transaction after all transactions with an equal or earlier timestamp, so
+// the ledger stays sorted without re-sorting on every read. Must be called while holding l.mu.
+func (l *userLedger) insert(transactions ...model.Transaction) {
+	for _, transaction := range transactions {
+		i := sort.Search(len(l.transactions), func(i int) bool {
+			return l.transactions[i].Timestamp.After(transaction.Timestamp)
+		})
+		l.transactions = append(l.transactions, model.Transaction{})
+		copy(l.transactions[i+1:], l.transactions[i:])
+		l.transactions[i] = transaction
+		l.balances[transaction.Payer] += transaction.Points
+		atomic.AddInt64(l.totalPoints, int64(transaction.Points))
+	}
+}
@@ -0,0 +1,99 @@
+package db_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests are most useful when run with the race detector: go test -race ./...
+
+const (
+	stressWorkers    = 16
+	stressIterations = 200
+)
+
+func TestInMemoryDB_concurrent_access(t *testing.T) {
+	database := db.NewInMemoryDB()
+	runConcurrentAccess(t, database)
+}
+
+func TestFileDB_concurrent_access(t *testing.T) {
+	dir := t.TempDir()
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 50
+
+	runConcurrentAccess(t, database)
+	assert.NoError(t, database.Close())
+
+	// Writes that landed while snapshots were being taken are restored exactly once
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Equal(t, stressWorkers*stressIterations, database.GetTotalPoints())
+}
+
+func TestInMemoryDB_returned_transactions_are_isolated(t *testing.T) {
+	database := db.NewInMemoryDB()
+	assert.NoError(t, database.AddTransaction("1", test.Data[0]))
+
+	transactions := database.GetTransactions("1")
+	transactions[0].Points = 0
+
+	assert.Equal(t, 1000, database.GetTransactions("1")[0].Points)
+}
+
+type concurrentDB interface {
+	AddTransaction(userID string, transaction model.Transaction) error
+	GetTransactions(userID string) []model.Transaction
+	GetAccounts(userID string) []model.Account
+}
+
+// runConcurrentAccess writes to a small set of shared users from many goroutines while other
+// goroutines read, then checks that no write was lost and every ledger is still sorted
+func runConcurrentAccess(t *testing.T, database concurrentDB) {
+	users := []string{"1", "2", "3"}
+	start := test.ParseTime("2020-11-01T00:00:00Z")
+
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < stressIterations; i++ {
+				err := database.AddTransaction(users[i%len(users)], model.Transaction{
+					Payer:     fmt.Sprintf("PAYER %d", w%4),
+					Points:    1,
+					Timestamp: start.Add(time.Duration((i*stressWorkers+w)%97) * time.Minute),
+				})
+				assert.NoError(t, err)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < stressIterations; i++ {
+				userID := users[(i+w)%len(users)]
+				database.GetAccounts(userID)
+				database.GetTransactions(userID)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, userID := range users {
+		transactions := database.GetTransactions(userID)
+		for i := 1; i < len(transactions); i++ {
+			assert.False(t, transactions[i].Timestamp.Before(transactions[i-1].Timestamp))
+		}
+		for _, account := range database.GetAccounts(userID) {
+			total += account.Points
+		}
+	}
+	assert.Equal(t, stressWorkers*stressIterations, total)
+}
@@ -1,9 +1,13 @@
 package db_test
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
 	"fetchrewards.com/points-api/internal/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -69,4 +73,186 @@ func TestGetAccounts(t *testing.T) {
 		assert.Equal(t, 200, accounts[2].Points)
 	})
 
+	t.Run("returns accounts as of a point in time", func(t *testing.T) {
+		database := db.NewInMemoryDB()
+
+		userID := "1"
+		for _, tran := range test.Data {
+			database.AddTransaction(userID, tran)
+		}
+
+		accounts := database.GetAccountsAsOf(userID, test.ParseTime("2020-10-31T12:00:00Z"))
+		assert.Equal(t, []model.Account{{Payer: "DANNON", Points: 300}, {Payer: "UNILEVER", Points: 200}}, accounts)
+
+		// Transactions at exactly the given time are included
+		accounts = database.GetAccountsAsOf(userID, test.ParseTime("2020-11-01T14:00:00Z"))
+		assert.Equal(t, []model.Account{
+			{Payer: "DANNON", Points: 100},
+			{Payer: "MILLER COORS", Points: 10000},
+			{Payer: "UNILEVER", Points: 200},
+		}, accounts)
+
+		assert.Empty(t, database.GetAccountsAsOf(userID, test.ParseTime("2020-01-01T00:00:00Z")))
+	})
+}
+
+func TestUpdateLedger(t *testing.T) {
+
+	t.Run("appends the returned records", func(t *testing.T) {
+		database := db.NewInMemoryDB()
+
+		err := database.UpdateLedger("1", func(ledger model.Ledger) (model.Ledger, error) {
+			assert.Empty(t, ledger.Transactions)
+			return model.Ledger{
+				Transactions: []model.Transaction{test.Data[0], test.Data[1]},
+				Allocations:  []model.Allocation{{TransactionID: "2", LotID: "1", Payer: "DANNON", Points: 10}},
+			}, nil
+		})
+		assert.NoError(t, err)
+
+		ledger := database.GetLedger("1")
+		assert.Len(t, ledger.Transactions, 2)
+		assert.Len(t, ledger.Allocations, 1)
+	})
+
+	t.Run("writes nothing when the unit of work fails", func(t *testing.T) {
+		database := db.NewInMemoryDB()
+		assert.NoError(t, database.AddTransaction("1", test.Data[0]))
+
+		failure := errors.New("failure")
+		err := database.UpdateLedger("1", func(ledger model.Ledger) (model.Ledger, error) {
+			assert.Len(t, ledger.Transactions, 1)
+			return model.Ledger{Transactions: []model.Transaction{test.Data[1]}}, failure
+		})
+		assert.Equal(t, failure, err)
+		assert.Len(t, database.GetTransactions("1"), 1)
+	})
+
+}
+
+func TestGetOpenLots(t *testing.T) {
+	userID := "1"
+	lot := func(id, payer string, points, remaining int, timestamp string) model.Lot {
+		return model.Lot{ID: id, Payer: payer, Points: points, Remaining: remaining, Timestamp: test.ParseTime(timestamp)}
+	}
+	database := db.NewInMemoryDB()
+	for i, tran := range test.Data {
+		tran.ID = fmt.Sprintf("%d", i+1)
+		assert.NoError(t, database.AddTransaction(userID, tran))
+	}
+
+	// The adjustment was written before the older DANNON lot, which takes it over
+	assert.Equal(t, []model.Lot{
+		lot("5", "DANNON", 300, 100, "2020-10-31T10:00:00Z"),
+		lot("2", "UNILEVER", 200, 200, "2020-10-31T11:00:00Z"),
+		lot("4", "MILLER COORS", 10000, 10000, "2020-11-01T14:00:00Z"),
+		lot("1", "DANNON", 1000, 1000, "2020-11-02T14:00:00Z"),
+	}, database.GetOpenLots(userID).Lots)
+
+	hold := model.Hold{ID: "hold", Status: model.HoldAuthorized}
+	err := database.UpdateLedger(userID, func(model.Ledger) (model.Ledger, error) {
+		return model.Ledger{
+			Transactions: []model.Transaction{{ID: "6", Payer: "UNILEVER", Points: -200, Timestamp: test.ParseTime("2020-11-03T00:00:00Z")}},
+			Allocations:  []model.Allocation{{TransactionID: "6", LotID: "2", Payer: "UNILEVER", Points: 200}},
+			Holds:        []model.Hold{hold},
+		}, nil
+	})
+	assert.NoError(t, err)
+	ledger := database.GetOpenLots(userID)
+	assert.Len(t, ledger.Lots, 3)
+	assert.Equal(t, []model.Hold{hold}, ledger.OpenHolds)
+
+	// Giving points back reopens the lot, and a voided hold is no longer open
+	hold.Status = model.HoldVoided
+	err = database.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		assert.Len(t, ledger.Lots, 3)
+		return model.Ledger{
+			Transactions: []model.Transaction{{ID: "7", Payer: "UNILEVER", Points: 50, ReversalOf: "6", Timestamp: test.ParseTime("2020-11-04T00:00:00Z")}},
+			Allocations:  []model.Allocation{{TransactionID: "7", LotID: "2", Payer: "UNILEVER", Points: -50}},
+			Holds:        []model.Hold{hold},
+		}, nil
+	})
+	assert.NoError(t, err)
+	ledger = database.GetOpenLots(userID)
+	assert.Equal(t, lot("2", "UNILEVER", 200, 50, "2020-10-31T11:00:00Z"), ledger.Lots[1])
+	assert.Empty(t, ledger.OpenHolds)
+
+	// Debits beyond the payer's lots are drained from the lots added later
+	assert.NoError(t, database.AddTransaction(userID, model.Transaction{ID: "8", Payer: "DANNON", Points: -1500, Timestamp: test.ParseTime("2020-11-05T00:00:00Z")}))
+	assert.NoError(t, database.AddTransaction(userID, model.Transaction{ID: "9", Payer: "DANNON", Points: 500, Timestamp: test.ParseTime("2020-11-06T00:00:00Z")}))
+	assert.Equal(t, []model.Lot{
+		lot("2", "UNILEVER", 200, 50, "2020-10-31T11:00:00Z"),
+		lot("4", "MILLER COORS", 10000, 10000, "2020-11-01T14:00:00Z"),
+		lot("9", "DANNON", 500, 100, "2020-11-06T00:00:00Z"),
+	}, database.GetOpenLots(userID).Lots)
+}
+
+func TestGetOpenLots_expired_holds(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	created := test.ParseTime("2020-11-02T14:00:00Z")
+	write := func(records model.Ledger) {
+		assert.NoError(t, database.UpdateLedger(userID, func(model.Ledger) (model.Ledger, error) {
+			return records, nil
+		}))
+	}
+	hold := func(id string, expiresAt time.Time) model.Hold {
+		return model.Hold{ID: id, Points: 10, Status: model.HoldAuthorized, CreatedAt: created, ExpiresAt: expiresAt}
+	}
+
+	write(model.Ledger{Holds: []model.Hold{
+		hold("short", created.Add(time.Hour)),
+		hold("long", created.Add(24*time.Hour)),
+	}})
+	assert.ElementsMatch(t, []model.Hold{hold("short", created.Add(time.Hour)), hold("long", created.Add(24*time.Hour))}, database.GetOpenLots(userID).OpenHolds)
+
+	// A record written after the short hold expired drops it, leaving the long one
+	write(model.Ledger{Transactions: []model.Transaction{
+		{ID: "1", Payer: "DANNON", Points: 100, CreatedAt: created.Add(time.Hour)},
+	}})
+	assert.Equal(t, []model.Hold{hold("long", created.Add(24*time.Hour))}, database.GetOpenLots(userID).OpenHolds)
+	assert.Empty(t, database.CheckProjections())
+
+	// Holds written already expired are never open
+	write(model.Ledger{Holds: []model.Hold{hold("stale", created.Add(time.Minute))}})
+	assert.Len(t, database.GetOpenLots(userID).OpenHolds, 1)
+}
+
+func TestUpdateBudget_payers_do_not_block_each_other(t *testing.T) {
+	database := db.NewInMemoryDB()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+
+	// Hold DANNON's budget, along with user 1's ledger, until released
+	go func() {
+		done <- database.UpdateLedgerAndBudget("1", "DANNON", func(ledger model.Ledger, budget model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+			close(started)
+			<-release
+			budget.Issued = 100
+			return model.Ledger{Transactions: []model.Transaction{{ID: "1", Payer: "DANNON", Points: 100}}}, budget, nil, nil
+		})
+	}()
+	<-started
+
+	// Another payer's budget can be updated meanwhile, on its own or with another user's ledger
+	err := database.UpdateBudget("UNILEVER", func(budget model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+		budget.Funded = 200
+		return budget, &model.BudgetEntry{ID: "1", Type: model.BudgetFunding, PayerID: "UNILEVER", Points: 200}, nil
+	})
+	assert.NoError(t, err)
+	err = database.UpdateLedgerAndBudget("2", "UNILEVER", func(ledger model.Ledger, budget model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+		budget.Issued = 50
+		return model.Ledger{Transactions: []model.Transaction{{ID: "2", Payer: "UNILEVER", Points: 50}}}, budget, nil, nil
+	})
+	assert.NoError(t, err)
+
+	close(release)
+	assert.NoError(t, <-done)
+	dannon, _ := database.GetBudget("DANNON")
+	assert.Equal(t, 100, dannon.Issued)
+	unilever, _ := database.GetBudget("UNILEVER")
+	assert.Equal(t, 200, unilever.Funded)
+	assert.Equal(t, 50, unilever.Issued)
+	assert.Len(t, database.GetBudgetEntries("UNILEVER"), 1)
 }
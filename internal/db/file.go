@@ -0,0 +1,709 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+	// oldWALFileName is the log being compacted, which new records are no longer appended to
+	oldWALFileName = "wal.old.log"
+
+	// DefaultSnapshotThreshold is the number of log records written before the log is
+	// compacted into a new snapshot
+	DefaultSnapshotThreshold = 1000
+	// DefaultBudgetEntryRetention is how long budget entries are kept before compaction drops
+	// them
+	DefaultBudgetEntryRetention = 365 * 24 * time.Hour
+
+	// walHeaderSize is the size of the length and checksum prefix of every log record
+	walHeaderSize = 8
+	// maxWALRecordSize guards replay against allocating huge buffers for a corrupt length
+	maxWALRecordSize = 16 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errClosed = errors.New("database is closed")
+)
+
+// walRecord is a single entry in the write-ahead log. All records committed by one update
+// are written as a single log record, so they are replayed all together or not at all. A log
+// record updates the idempotency records or the payer registry if Idempotency or Payer is set.
+// Otherwise it updates the ledger of UserID, a payer's budget if Budget is set, or both.
+type walRecord struct {
+	Seq          uint64              `json:"seq"`
+	UserID       string              `json:"userId,omitempty"`
+	Transactions []model.Transaction `json:"transactions,omitempty"`
+	Allocations  []model.Allocation  `json:"allocations,omitempty"`
+	Holds        []model.Hold        `json:"holds,omitempty"`
+	Idempotency  *idempotencyChange  `json:"idempotency,omitempty"`
+	Payer        *payerChange        `json:"payer,omitempty"`
+	Budget       *budgetChange       `json:"budget,omitempty"`
+}
+
+// snapshot is the on-disk representation of the full state of the database as of the log
+// record with sequence number Seq. A snapshot is taken while writes go on, so a user's ledger,
+// a payer's budget or a store can also contain later log records. Their sequence number is then
+// recorded in UserSeqs, BudgetSeqs or the store's Seq, so replay skips those records for that
+// part alone.
+type snapshot struct {
+	Seq              uint64                         `json:"seq"`
+	UserTransactions map[string][]model.Transaction `json:"userTransactions"`
+	UserAllocations  map[string][]model.Allocation  `json:"userAllocations,omitempty"`
+	UserHolds        map[string][]model.Hold        `json:"userHolds,omitempty"`
+	UserSeqs         map[string]uint64              `json:"userSeqs,omitempty"`
+	Idempotency      []model.IdempotencyRecord      `json:"idempotency,omitempty"`
+	IdempotencySeq   uint64                         `json:"idempotencySeq,omitempty"`
+	Payers           []model.Payer                  `json:"payers,omitempty"`
+	PayersSeq        uint64                         `json:"payersSeq,omitempty"`
+	Budgets          []model.PayerBudget            `json:"budgets,omitempty"`
+	BudgetEntries    map[string][]model.BudgetEntry `json:"budgetEntries,omitempty"`
+	BudgetSeqs       map[string]uint64              `json:"budgetSeqs,omitempty"`
+}
+
+// FileDB is a durable database that keeps its state on local disk. Every write is appended
+// to a write-ahead log and synced before it is applied to an in-memory copy of the data, which
+// serves all reads. The log is periodically compacted into a snapshot. On startup the latest
+// snapshot is loaded and the log is replayed on top of it.
+//
+// Each log record is prefixed with its length and a CRC-32C checksum so that a record torn by
+// a crash mid-write is detected during replay and discarded.
+//
+// FileDB is safe for concurrent use. Writes are serialized by the log while reads are served
+// by the in-memory copy with its per-user locking. Snapshots are taken in the background from
+// the in-memory copy, so writes carry on while the log is compacted.
+type FileDB struct {
+	// SnapshotThreshold is the number of log records after which a new snapshot is written
+	// and the log is truncated. A value <= 0 disables automatic snapshots.
+	SnapshotThreshold int
+	// BudgetEntryRetention is how long budget entries are kept. Entries created before it are
+	// dropped when the log is compacted, while the budgets themselves keep their totals. A
+	// value <= 0 keeps every entry.
+	BudgetEntryRetention time.Duration
+	// Now returns the current time, against which compaction prunes expired records
+	Now func() time.Time
+
+	mem        *InMemoryDB
+	dir        string
+	mu         sync.Mutex
+	wal        *os.File
+	seq        uint64
+	walRecords int
+	// compacting is set while a snapshot triggered by SnapshotThreshold is being taken and
+	// closing once Close has been called, after which no more are started
+	compacting bool
+	closing    bool
+	// snapshotMu serializes snapshots and compactions counts the ones running in the background
+	snapshotMu  sync.Mutex
+	compactions sync.WaitGroup
+}
+
+// NewFileDB opens, or creates, a FileDB in the given directory and restores its state from
+// the snapshot and write-ahead log found there.
+func NewFileDB(dir string) (*FileDB, error) {
+	log.Printf("Opening file database in %s", dir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	db := &FileDB{
+		SnapshotThreshold:    DefaultSnapshotThreshold,
+		BudgetEntryRetention: DefaultBudgetEntryRetention,
+		Now:                  time.Now,
+		mem:                  newInMemoryDB(),
+		dir:                  dir,
+	}
+	state, err := restore(dir, db.mem)
+	if err != nil {
+		return nil, err
+	}
+	if drift := db.mem.CheckProjections(); len(drift) > 0 {
+		log.Printf("Rebuilding projections that disagree with the restored records: %+v", drift)
+		db.mem.RebuildProjections()
+	}
+
+	wal, err := os.OpenFile(db.path(walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	// Drop anything after the last intact record so new records are appended to a clean log
+	if err := wal.Truncate(state.walOffset); err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("truncating write-ahead log: %w", err)
+	}
+	if _, err := wal.Seek(state.walOffset, io.SeekStart); err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	db.wal = wal
+	db.seq = state.seq
+	db.walRecords = state.walRecords
+	log.Printf("Replayed %d write-ahead log records", state.replayed)
+
+	// A compaction was interrupted before its snapshot was written. Everything in the old log
+	// has been restored, so a snapshot of the restored state replaces it.
+	if state.oldWAL {
+		if err := db.writeSnapshot(state.seq); err != nil {
+			wal.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// GetTransactions returns all the model.Transaction records in time ascending order for the user
+func (db *FileDB) GetTransactions(userID string) []model.Transaction {
+	return db.mem.GetTransactions(userID)
+}
+
+// GetAccounts returns all model.Accounts, or payers, across all transactions for this user
+func (db *FileDB) GetAccounts(userID string) []model.Account {
+	return db.mem.GetAccounts(userID)
+}
+
+// GetTotalPoints returns the sum of every user's balances. See InMemoryDB.GetTotalPoints.
+func (db *FileDB) GetTotalPoints() int {
+	return db.mem.GetTotalPoints()
+}
+
+// GetOpenLots returns the user's lots that have points remaining and the holds that are
+// authorized. See InMemoryDB.GetOpenLots.
+func (db *FileDB) GetOpenLots(userID string) model.Ledger {
+	return db.mem.GetOpenLots(userID)
+}
+
+// GetAccountsAsOf returns all model.Accounts for this user as they stood at the given time
+func (db *FileDB) GetAccountsAsOf(userID string, asOf time.Time) []model.Account {
+	return db.mem.GetAccountsAsOf(userID, asOf)
+}
+
+// GetAccount returns the model.Account associated with the payer for this user
+func (db *FileDB) GetAccount(userID, payer string) (model.Account, bool) {
+	return db.mem.GetAccount(userID, payer)
+}
+
+// GetLedger returns a copy of all the records stored for the user
+func (db *FileDB) GetLedger(userID string) model.Ledger {
+	return db.mem.GetLedger(userID)
+}
+
+// GetUserIDs returns the IDs of every user with stored records, in ascending order
+func (db *FileDB) GetUserIDs() []string {
+	return db.mem.GetUserIDs()
+}
+
+// AddTransaction durably records the given model.Transaction for this user. The transaction
+// is only visible to readers once it has been synced to the write-ahead log.
+func (db *FileDB) AddTransaction(userID string, transaction model.Transaction) error {
+	return db.UpdateLedger(userID, func(model.Ledger) (model.Ledger, error) {
+		return model.Ledger{Transactions: []model.Transaction{transaction}}, nil
+	})
+}
+
+// UpdateLedger runs fn as a unit of work against the user's ledger. See
+// InMemoryDB.UpdateLedger. The records returned by fn are synced to the write-ahead log as a
+// single log record before they become visible, so a crash never leaves part of them behind.
+func (db *FileDB) UpdateLedger(userID string, fn func(model.Ledger) (model.Ledger, error)) error {
+	return db.mem.update(userID, fn, func(records model.Ledger) (uint64, error) {
+		return db.commit(walRecord{
+			UserID:       userID,
+			Transactions: records.Transactions,
+			Allocations:  records.Allocations,
+			Holds:        records.Holds,
+		})
+	})
+}
+
+// Snapshot writes the current state to a new snapshot and truncates the write-ahead log
+func (db *FileDB) Snapshot() error {
+	return db.compact()
+}
+
+// Ready reports whether the FileDB can serve requests. Its state has been restored by the time
+// NewFileDB returns, so it is ready until it is closed.
+func (db *FileDB) Ready() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.wal == nil {
+		return errClosed
+	}
+	return nil
+}
+
+// Close waits for a snapshot being taken in the background to be written and closes the
+// write-ahead log. The FileDB must not be written to after it is closed.
+func (db *FileDB) Close() error {
+	db.mu.Lock()
+	db.closing = true
+	db.mu.Unlock()
+	db.compactions.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.wal == nil {
+		return nil
+	}
+	err := db.wal.Close()
+	db.wal = nil
+	return err
+}
+
+// commit assigns the record the next sequence number, durably appends it to the log and
+// returns the sequence number. Once SnapshotThreshold records have been written it starts a
+// compaction in the background, as the caller holds the lock of the ledger or store it writes.
+func (db *FileDB) commit(record walRecord) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.wal == nil {
+		return 0, errClosed
+	}
+
+	record.Seq = db.seq + 1
+	if err := db.appendRecord(record); err != nil {
+		return 0, err
+	}
+	db.seq = record.Seq
+	db.walRecords++
+
+	if db.SnapshotThreshold > 0 && db.walRecords >= db.SnapshotThreshold && !db.compacting && !db.closing {
+		db.compacting = true
+		db.compactions.Add(1)
+		go func() {
+			defer db.compactions.Done()
+			// The writes themselves are durable in the log, so a failed compaction is not fatal
+			if err := db.compact(); err != nil && err != errClosed {
+				log.Printf("Unable to write snapshot: %v", err)
+			}
+			db.mu.Lock()
+			db.compacting = false
+			db.mu.Unlock()
+		}()
+	}
+	return record.Seq, nil
+}
+
+func (db *FileDB) appendRecord(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[walHeaderSize:], payload)
+
+	offset, err := db.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = db.wal.Write(buf); err != nil {
+		err = fmt.Errorf("writing to write-ahead log: %w", err)
+	} else if err = db.wal.Sync(); err != nil {
+		err = fmt.Errorf("syncing write-ahead log: %w", err)
+	}
+	if err != nil {
+		// Remove any partial record, otherwise replay would stop at it and lose every later one
+		if terr := db.wal.Truncate(offset); terr == nil {
+			_, _ = db.wal.Seek(offset, io.SeekStart)
+		}
+		return err
+	}
+	return nil
+}
+
+// compact starts a new log, writes a snapshot of everything in the old one and removes it.
+// Writers only wait on db.mu for the log to be swapped, not for the snapshot to be written.
+func (db *FileDB) compact() error {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+
+	seq, err := db.rotate()
+	if err != nil {
+		return err
+	}
+	return db.writeSnapshot(seq)
+}
+
+// rotate renames the log to oldWALFileName and opens an empty log in its place. It returns the
+// sequence number of the last record in the old log.
+func (db *FileDB) rotate() (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.wal == nil {
+		return 0, errClosed
+	}
+	if _, err := os.Stat(db.path(oldWALFileName)); err == nil {
+		return 0, fmt.Errorf("%s from an earlier compaction has not been removed", oldWALFileName)
+	}
+
+	if err := os.Rename(db.path(walFileName), db.path(oldWALFileName)); err != nil {
+		return 0, fmt.Errorf("rotating write-ahead log: %w", err)
+	}
+	wal, err := os.OpenFile(db.path(walFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		err = syncDir(db.dir)
+	}
+	if err != nil {
+		// Keep appending to the old log, which is still open
+		if wal != nil {
+			wal.Close()
+		}
+		if rerr := os.Rename(db.path(oldWALFileName), db.path(walFileName)); rerr != nil {
+			log.Printf("Unable to restore write-ahead log after failed rotation: %v", rerr)
+		}
+		return 0, fmt.Errorf("opening write-ahead log: %w", err)
+	}
+
+	db.wal.Close()
+	db.wal = wal
+	db.walRecords = 0
+	return db.seq, nil
+}
+
+// writeSnapshot writes a snapshot of the in-memory state, which contains every log record up
+// to seq, and removes the old log whose records it replaces.
+//
+// The snapshot is written to a temporary file and renamed into place, so a crash leaves either
+// the old or the new snapshot intact. Until then restore replays the old log as well as the
+// current one, skipping the records a snapshot already contains by sequence number.
+func (db *FileDB) writeSnapshot(seq uint64) error {
+	snap := db.takeSnapshot(seq, db.Now())
+	if err := writeFileAtomic(db.path(snapshotFileName), snap); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Remove(db.path(oldWALFileName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing compacted write-ahead log: %w", err)
+	}
+	return syncDir(db.dir)
+}
+
+// takeSnapshot reads the in-memory state one ledger or store at a time, each under its own
+// lock, so writes to the others carry on. Writes committed after the log record with sequence
+// number seq may be included, and each part records the last one it contains. Idempotency
+// records that expired by now and budget entries older than BudgetEntryRetention are pruned
+// from the in-memory state and left out of the snapshot.
+func (db *FileDB) takeSnapshot(seq uint64, now time.Time) snapshot {
+	snap := snapshot{
+		Seq:              seq,
+		UserTransactions: make(map[string][]model.Transaction),
+		UserAllocations:  make(map[string][]model.Allocation),
+		UserHolds:        make(map[string][]model.Hold),
+		UserSeqs:         make(map[string]uint64),
+		BudgetEntries:    make(map[string][]model.BudgetEntry),
+		BudgetSeqs:       make(map[string]uint64),
+	}
+	laterSeq := func(partSeq uint64) uint64 {
+		if partSeq > seq {
+			return partSeq
+		}
+		return 0
+	}
+
+	for _, userID := range db.mem.GetUserIDs() {
+		ledger, _ := db.mem.getLedger(userID)
+		ledger.mu.RLock()
+		records := ledger.copy()
+		ledgerSeq := ledger.seq
+		ledger.mu.RUnlock()
+
+		snap.UserTransactions[userID] = records.Transactions
+		if len(records.Allocations) > 0 {
+			snap.UserAllocations[userID] = records.Allocations
+		}
+		if len(records.Holds) > 0 {
+			snap.UserHolds[userID] = records.Holds
+		}
+		if ledgerSeq > seq {
+			snap.UserSeqs[userID] = ledgerSeq
+		}
+	}
+
+	idempotency := &db.mem.idempotency
+	idempotency.mu.Lock()
+	idempotency.apply(idempotencyChange{PurgeBefore: &now})
+	for _, record := range idempotency.records {
+		snap.Idempotency = append(snap.Idempotency, record)
+	}
+	snap.IdempotencySeq = laterSeq(idempotency.seq)
+	idempotency.mu.Unlock()
+
+	payers := &db.mem.payers
+	payers.mu.RLock()
+	for _, payer := range payers.payers {
+		snap.Payers = append(snap.Payers, payer)
+	}
+	snap.PayersSeq = laterSeq(payers.seq)
+	payers.mu.RUnlock()
+
+	for _, payer := range db.mem.budgets.list() {
+		payer.mu.Lock()
+		if db.BudgetEntryRetention > 0 {
+			payer.prune(now.Add(-db.BudgetEntryRetention))
+		}
+		if payer.exists {
+			payerID := payer.budget.PayerID
+			snap.Budgets = append(snap.Budgets, payer.budget)
+			if len(payer.entries) > 0 {
+				snap.BudgetEntries[payerID] = payer.entries
+			}
+			if payer.seq > seq {
+				snap.BudgetSeqs[payerID] = payer.seq
+			}
+		}
+		payer.mu.Unlock()
+	}
+	return snap
+}
+
+// restoreState describes what restore found on disk
+type restoreState struct {
+	// seq is the sequence number of the last record applied
+	seq uint64
+	// walRecords is the number of intact records in the log
+	walRecords int
+	// walOffset is the offset just past the last intact record in the log
+	walOffset int64
+	// replayed is the number of log records applied on top of the snapshot
+	replayed int
+	// oldWAL reports whether the log of an interrupted compaction was found
+	oldWAL bool
+}
+
+// restore loads the snapshot in dir into target and replays every intact log record newer
+// than the snapshot, first from the log of an interrupted compaction, if any, and then from the
+// current log. Replay of a log stops at the first short or corrupt record, which is what a
+// crash in the middle of a write leaves behind.
+func restore(dir string, target *InMemoryDB) (restoreState, error) {
+	state := restoreState{}
+	// snapSeq is the sequence number every part of the snapshot contains. Records after it are
+	// left to replayRecord, which skips them for the parts that already contain them.
+	var snapSeq uint64
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return state, fmt.Errorf("reading snapshot: %w", err)
+	} else if err == nil {
+		snap := snapshot{}
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return state, fmt.Errorf("decoding snapshot: %w", err)
+		}
+		snapSeq = snap.Seq
+		state.seq = snap.Seq
+		partSeq := func(seq uint64) uint64 {
+			if seq < snap.Seq {
+				seq = snap.Seq
+			}
+			if seq > state.seq {
+				state.seq = seq
+			}
+			return seq
+		}
+
+		// Each user's records are applied together so the projections see the allocations of
+		// every transaction
+		for userID, transactions := range snap.UserTransactions {
+			ledger := target.getOrCreateLedger(userID)
+			ledger.apply(model.Ledger{
+				Transactions: transactions,
+				Allocations:  snap.UserAllocations[userID],
+				Holds:        snap.UserHolds[userID],
+			})
+			ledger.seq = partSeq(snap.UserSeqs[userID])
+		}
+		for i := range snap.Idempotency {
+			target.idempotency.apply(idempotencyChange{Save: &snap.Idempotency[i]})
+		}
+		target.idempotency.seq = partSeq(snap.IdempotencySeq)
+		for i := range snap.Payers {
+			target.payers.apply(payerChange{Save: &snap.Payers[i]})
+		}
+		target.payers.seq = partSeq(snap.PayersSeq)
+		for _, budget := range snap.Budgets {
+			payer := target.budgets.getOrCreatePayer(budget.PayerID)
+			payer.apply(budgetChange{Budget: budget})
+			payer.setEntries(snap.BudgetEntries[budget.PayerID])
+			payer.seq = partSeq(snap.BudgetSeqs[budget.PayerID])
+		}
+	}
+
+	old, err := os.Open(filepath.Join(dir, oldWALFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return state, fmt.Errorf("opening write-ahead log: %w", err)
+	} else if err == nil {
+		defer old.Close()
+		state.oldWAL = true
+		replayLog(old, target, snapSeq, &state)
+	}
+
+	wal, err := os.Open(filepath.Join(dir, walFileName))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	defer wal.Close()
+
+	state.walOffset, state.walRecords = replayLog(wal, target, snapSeq, &state)
+	return state, nil
+}
+
+// replayLog applies the intact records of the log to target, skipping those already contained
+// by the snapshot with sequence number snapSeq or by the part of target they update. It returns
+// the offset just past the last intact record and the number of intact records.
+func replayLog(wal io.Reader, target *InMemoryDB, snapSeq uint64, state *restoreState) (int64, int) {
+	var offset int64
+	records := 0
+	reader := bufio.NewReader(wal)
+	for {
+		record, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Discarding write-ahead log from offset %d: %v", offset, err)
+			break
+		}
+		offset += size
+		records++
+
+		if record.Seq > state.seq {
+			state.seq = record.Seq
+		}
+		if record.Seq > snapSeq && replayRecord(target, record) {
+			state.replayed++
+		}
+	}
+	return offset, records
+}
+
+// replayRecord applies the record to each part of target it updates that has not applied it
+// yet and reports whether any did
+func replayRecord(target *InMemoryDB, record walRecord) bool {
+	applied := false
+	switch {
+	case record.Idempotency != nil:
+		if record.Seq > target.idempotency.seq {
+			target.idempotency.apply(*record.Idempotency)
+			target.idempotency.seq = record.Seq
+			applied = true
+		}
+	case record.Payer != nil:
+		if record.Seq > target.payers.seq {
+			target.payers.apply(*record.Payer)
+			target.payers.seq = record.Seq
+			applied = true
+		}
+	default:
+		if record.Budget != nil {
+			if payer := target.budgets.getOrCreatePayer(record.Budget.Budget.PayerID); record.Seq > payer.seq {
+				payer.apply(*record.Budget)
+				payer.seq = record.Seq
+				applied = true
+			}
+		}
+		if record.UserID != "" {
+			if ledger := target.getOrCreateLedger(record.UserID); record.Seq > ledger.seq {
+				ledger.apply(model.Ledger{
+					Transactions: record.Transactions,
+					Allocations:  record.Allocations,
+					Holds:        record.Holds,
+				})
+				ledger.seq = record.Seq
+				applied = true
+			}
+		}
+	}
+	return applied
+}
+
+// readRecord reads one length and checksum prefixed record. It returns io.EOF only when the
+// reader is exhausted exactly on a record boundary.
+func readRecord(r io.Reader) (walRecord, int64, error) {
+	record := walRecord{}
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return record, 0, io.EOF
+	} else if err != nil {
+		return record, 0, fmt.Errorf("torn record header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxWALRecordSize {
+		return record, 0, fmt.Errorf("record length %d exceeds maximum", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return record, 0, fmt.Errorf("torn record payload: %w", err)
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return record, 0, errors.New("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, fmt.Errorf("decoding record: %w", err)
+	}
+	return record, int64(walHeaderSize + len(payload)), nil
+}
+
+func (db *FileDB) path(name string) string {
+	return filepath.Join(db.dir, name)
+}
+
+// writeFileAtomic encodes v as JSON into a temporary file, syncs it and renames it over path
+func writeFileAtomic(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory so the files created, renamed or removed in it survive a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,423 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDB_persists_between_opens(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	for _, tran := range test.Data {
+		assert.NoError(t, database.AddTransaction(userID, tran))
+	}
+	assert.NoError(t, database.Close())
+
+	assert.Error(t, database.Ready())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+
+	assert.NoError(t, database.Ready())
+	assert.Len(t, database.GetTransactions(userID), len(test.Data))
+	accounts := database.GetAccounts(userID)
+	assert.Len(t, accounts, 3)
+	assert.Equal(t, "DANNON", accounts[0].Payer)
+	assert.Equal(t, 1100, accounts[0].Points)
+}
+
+func TestFileDB_snapshot_and_replay(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 2
+	for _, tran := range test.Data {
+		assert.NoError(t, database.AddTransaction(userID, tran))
+	}
+	err := database.UpdateLedger(userID, func(model.Ledger) (model.Ledger, error) {
+		return model.Ledger{
+			Allocations: []model.Allocation{{TransactionID: "2", LotID: "1", Points: 10}},
+			Holds:       []model.Hold{{ID: "3", Points: 5, Status: model.HoldAuthorized}},
+		}, nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, database.Close())
+
+	// 6 records with a threshold of 2 leaves all of them in the snapshot
+	_, err = os.Stat(filepath.Join(dir, "snapshot.json"))
+	assert.NoError(t, err)
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Len(t, database.GetTransactions(userID), len(test.Data))
+	assert.Len(t, database.GetLedger(userID).Allocations, 1)
+	assert.Len(t, database.GetLedger(userID).Holds, 1)
+
+	// The projections are rebuilt from the snapshot
+	ledger := database.GetOpenLots(userID)
+	assert.Len(t, ledger.Lots, 4)
+	assert.Equal(t, 100, ledger.Lots[0].Remaining)
+	assert.Len(t, ledger.OpenHolds, 1)
+}
+
+func TestFileDB_snapshot_does_not_duplicate_log_records(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 0
+	assert.NoError(t, database.AddTransaction(userID, test.Data[0]))
+	assert.NoError(t, database.AddTransaction(userID, test.Data[1]))
+
+	// Simulate a crash after the snapshot was renamed into place but before the log was
+	// truncated by restoring the old log contents
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := ioutil.ReadFile(walPath)
+	assert.NoError(t, err)
+	assert.NoError(t, database.Snapshot())
+	assert.NoError(t, database.Close())
+	assert.NoError(t, ioutil.WriteFile(walPath, wal, 0644))
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Len(t, database.GetTransactions(userID), 2)
+}
+
+func TestFileDB_restores_writes_made_during_compaction(t *testing.T) {
+	dir := t.TempDir()
+	users := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+	start := test.ParseTime("2020-11-01T00:00:00Z")
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 5
+	database.Now = func() time.Time { return start }
+
+	var wg sync.WaitGroup
+	for w, userID := range users {
+		wg.Add(1)
+		go func(w int, userID string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				payerID := fmt.Sprintf("PAYER %d", w%2)
+				err := database.UpdateLedgerAndBudget(userID, payerID, func(_ model.Ledger, budget model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+					tran := model.Transaction{ID: fmt.Sprintf("%s-%d", userID, i), Payer: payerID, Points: 1, Timestamp: start}
+					budget.Issued++
+					entry := &model.BudgetEntry{ID: tran.ID, Type: model.BudgetIssuance, PayerID: payerID, TransactionID: tran.ID, Points: -1, CreatedAt: start}
+					return model.Ledger{Transactions: []model.Transaction{tran}}, budget, entry, nil
+				})
+				assert.NoError(t, err)
+			}
+		}(w, userID)
+	}
+	// Snapshots are also forced while the writers run, on top of the ones the threshold starts
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, database.Snapshot())
+		}
+	}()
+	wg.Wait()
+
+	expected := make(map[string]model.Ledger)
+	for _, userID := range users {
+		expected[userID] = database.GetLedger(userID)
+	}
+	expectedEntries := [][]model.BudgetEntry{database.GetBudgetEntries("PAYER 0"), database.GetBudgetEntries("PAYER 1")}
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	for _, userID := range users {
+		assert.Len(t, expected[userID].Transactions, 50)
+		assert.ElementsMatch(t, expected[userID].Transactions, database.GetLedger(userID).Transactions, "user %s", userID)
+	}
+	for i, entries := range expectedEntries {
+		payerID := fmt.Sprintf("PAYER %d", i)
+		assert.ElementsMatch(t, entries, database.GetBudgetEntries(payerID), payerID)
+		budget, _ := database.GetBudget(payerID)
+		assert.Equal(t, len(users)/2*50, budget.Issued)
+	}
+	assert.Equal(t, len(users)*50, database.GetTotalPoints())
+}
+
+func TestFileDB_recovers_interrupted_compaction(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 0
+	assert.NoError(t, database.AddTransaction(userID, test.Data[0]))
+	assert.NoError(t, database.AddTransaction(userID, test.Data[1]))
+	assert.NoError(t, database.Close())
+
+	// Simulate a crash after the log was rotated but before the snapshot was written
+	assert.NoError(t, os.Rename(filepath.Join(dir, "wal.log"), filepath.Join(dir, "wal.old.log")))
+
+	database = openFileDB(t, dir)
+	assert.Len(t, database.GetTransactions(userID), 2)
+	_, err := os.Stat(filepath.Join(dir, "wal.old.log"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, database.AddTransaction(userID, test.Data[2]))
+	assert.NoError(t, database.Snapshot())
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Len(t, database.GetTransactions(userID), 3)
+}
+
+func TestFileDB_snapshot_prunes_expired_records(t *testing.T) {
+	dir := t.TempDir()
+	now := test.ParseTime("2020-11-02T14:00:00Z")
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 0
+	database.BudgetEntryRetention = 24 * time.Hour
+	database.Now = func() time.Time { return now }
+	for _, record := range []model.IdempotencyRecord{
+		{Key: "expired", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		{Key: "live", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+	} {
+		assert.NoError(t, database.SaveIdempotencyRecord(record))
+	}
+	for i, createdAt := range []time.Time{now.Add(-48 * time.Hour), now.Add(-time.Hour)} {
+		err := database.UpdateBudget("DANNON", func(budget model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+			budget.Funded += 100
+			budget.Remaining = budget.Funded
+			return budget, &model.BudgetEntry{ID: strconv.Itoa(i), Type: model.BudgetFunding, PayerID: "DANNON", Points: 100, CreatedAt: createdAt}, nil
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, database.Snapshot())
+
+	// The records are pruned from memory as well as from the snapshot
+	assert.Len(t, database.GetBudgetEntries("DANNON"), 1)
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+
+	_, reserved, err := database.ReserveIdempotencyKey(model.IdempotencyRecord{Key: "expired", CreatedAt: now.Add(-2 * time.Hour)})
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	_, reserved, err = database.ReserveIdempotencyKey(model.IdempotencyRecord{Key: "live", CreatedAt: now})
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+
+	// The budget keeps the points of the entries dropped
+	entries := database.GetBudgetEntries("DANNON")
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "1", entries[0].ID)
+	}
+	budget, _ := database.GetBudget("DANNON")
+	assert.Equal(t, 200, budget.Funded)
+}
+
+func TestFileDB_discards_torn_record(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	assert.NoError(t, database.AddTransaction(userID, test.Data[0]))
+	assert.NoError(t, database.AddTransaction(userID, test.Data[1]))
+	assert.NoError(t, database.Close())
+
+	// Chop the last record in half as if the process died mid-write
+	walPath := filepath.Join(dir, "wal.log")
+	info, err := os.Stat(walPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(walPath, info.Size()-10))
+
+	database = openFileDB(t, dir)
+	transactions := database.GetTransactions(userID)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, "DANNON", transactions[0].Payer)
+
+	// New writes go after the last intact record
+	assert.NoError(t, database.AddTransaction(userID, test.Data[2]))
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Len(t, database.GetTransactions(userID), 2)
+}
+
+func TestFileDB_discards_corrupt_record(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	assert.NoError(t, database.AddTransaction(userID, test.Data[0]))
+	assert.NoError(t, database.AddTransaction(userID, test.Data[1]))
+	assert.NoError(t, database.Close())
+
+	// Flip a byte in the payload of the last record so its checksum no longer matches
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := ioutil.ReadFile(walPath)
+	assert.NoError(t, err)
+	wal[len(wal)-2] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(walPath, wal, 0644))
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Len(t, database.GetTransactions(userID), 1)
+}
+
+func openFileDB(t *testing.T, dir string) *db.FileDB {
+	database, err := db.NewFileDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func TestFileDB_failed_commit_writes_nothing(t *testing.T) {
+	dir := t.TempDir()
+	userID := "1"
+
+	database := openFileDB(t, dir)
+	assert.NoError(t, database.AddTransaction(userID, test.Data[0]))
+	assert.NoError(t, database.Close())
+
+	err := database.UpdateLedger(userID, func(model.Ledger) (model.Ledger, error) {
+		return model.Ledger{Transactions: []model.Transaction{test.Data[1], test.Data[2]}}, nil
+	})
+	assert.Error(t, err)
+	assert.Len(t, database.GetTransactions(userID), 1)
+}
+
+func TestFileDB_persists_idempotency_records(t *testing.T) {
+	dir := t.TempDir()
+	now := test.ParseTime("2020-11-02T14:00:00Z")
+	record := func(key string, createdAt time.Time) model.IdempotencyRecord {
+		return model.IdempotencyRecord{Key: key, Fingerprint: "f", CreatedAt: createdAt, ExpiresAt: createdAt.Add(time.Hour)}
+	}
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 3
+	database.Now = func() time.Time { return now }
+	_, reserved, err := database.ReserveIdempotencyKey(record("old", now))
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	_, reserved, err = database.ReserveIdempotencyKey(record("new", now.Add(30*time.Minute)))
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	completed := record("new", now.Add(30*time.Minute))
+	completed.Completed = true
+	completed.StatusCode = 200
+	completed.Body = []byte("[]")
+	assert.NoError(t, database.SaveIdempotencyRecord(completed))
+	assert.NoError(t, database.PurgeIdempotencyRecords(now.Add(time.Hour)))
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+
+	existing, reserved, err := database.ReserveIdempotencyKey(record("new", now.Add(time.Hour)))
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, completed.Body, existing.Body)
+	assert.True(t, existing.Completed)
+
+	// The purged record can be reserved again
+	_, reserved, err = database.ReserveIdempotencyKey(record("old", now.Add(time.Hour)))
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func TestFileDB_persists_payers(t *testing.T) {
+	dir := t.TempDir()
+	save := func(payer model.Payer) func(model.Payer, bool) (model.Payer, error) {
+		return func(model.Payer, bool) (model.Payer, error) {
+			return payer, nil
+		}
+	}
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 2
+	assert.NoError(t, database.UpdatePayer("DANNON", save(model.Payer{DisplayName: "Dannon", Status: model.PayerActive})))
+	assert.NoError(t, database.UpdatePayer("UNILEVER", save(model.Payer{DisplayName: "Unilever", Status: model.PayerActive})))
+	assert.NoError(t, database.UpdatePayer("DANNON", save(model.Payer{DisplayName: "Dannon", Status: model.PayerSuspended})))
+	deleted, err := database.DeletePayer("UNILEVER")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Equal(t, []model.Payer{{ID: "DANNON", DisplayName: "Dannon", Status: model.PayerSuspended}}, database.GetPayers())
+}
+
+func TestFileDB_persists_budgets(t *testing.T) {
+	dir := t.TempDir()
+	now := test.ParseTime("2020-11-02T14:00:00Z")
+	fund := func(points int) func(model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+		return func(budget model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+			budget.Funded += points
+			budget.Remaining = budget.Funded - budget.Issued
+			return budget, &model.BudgetEntry{ID: strconv.Itoa(points), Type: model.BudgetFunding, PayerID: "DANNON", Points: points, CreatedAt: now}, nil
+		}
+	}
+
+	database := openFileDB(t, dir)
+	database.SnapshotThreshold = 2
+	database.Now = func() time.Time { return now }
+	assert.NoError(t, database.UpdateBudget("DANNON", fund(100)))
+	assert.NoError(t, database.UpdateBudget("DANNON", fund(200)))
+	assert.NoError(t, database.UpdateBudget("DANNON", func(budget model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+		budget.DailyCap = 50
+		return budget, nil, nil
+	}))
+	assert.NoError(t, database.Close())
+
+	database = openFileDB(t, dir)
+	defer database.Close()
+	budget, found := database.GetBudget("DANNON")
+	assert.True(t, found)
+	assert.Equal(t, model.PayerBudget{PayerID: "DANNON", Funded: 300, Remaining: 300, DailyCap: 50}, budget)
+	assert.Len(t, database.GetBudgetEntries("DANNON"), 2)
+}
+
+func TestFileDB_persists_ledger_and_budget_together(t *testing.T) {
+	dir := t.TempDir()
+	issue := func(points int, fail error) func(model.Ledger, model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+		return func(_ model.Ledger, budget model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+			budget.Issued += points
+			transaction := model.Transaction{ID: strconv.Itoa(points), Payer: "DANNON", Points: points}
+			entry := &model.BudgetEntry{ID: strconv.Itoa(points), Type: model.BudgetIssuance, PayerID: "DANNON", TransactionID: transaction.ID, Points: -points}
+			return model.Ledger{Transactions: []model.Transaction{transaction}}, budget, entry, fail
+		}
+	}
+
+	database := openFileDB(t, dir)
+	assert.NoError(t, database.UpdateLedgerAndBudget("1", "DANNON", issue(100, nil)))
+	assert.Error(t, database.UpdateLedgerAndBudget("1", "DANNON", issue(200, errors.New("rejected"))))
+	assert.NoError(t, database.Close())
+
+	// Only the update that succeeded was stored, both its transaction and its issuance
+	database = openFileDB(t, dir)
+	defer database.Close()
+	assert.Len(t, database.GetTransactions("1"), 1)
+	budget, found := database.GetBudget("DANNON")
+	assert.True(t, found)
+	assert.Equal(t, 100, budget.Issued)
+	assert.Len(t, database.GetBudgetEntries("DANNON"), 1)
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// idempotencyChange is a single change to the stored idempotency records. Exactly one of its
+// fields is set.
+type idempotencyChange struct {
+	Save        *model.IdempotencyRecord `json:"save,omitempty"`
+	Delete      string                   `json:"delete,omitempty"`
+	PurgeBefore *time.Time               `json:"purgeBefore,omitempty"`
+}
+
+// idempotencyRecords holds the idempotency records of all users, keyed by idempotency key
+type idempotencyRecords struct {
+	mu      sync.Mutex
+	records map[string]model.IdempotencyRecord
+	// seq is the sequence number of the last log record applied, when kept by a FileDB
+	seq uint64
+}
+
+// apply makes the change. Must be called while holding r.mu.
+func (r *idempotencyRecords) apply(change idempotencyChange) {
+	switch {
+	case change.Save != nil:
+		r.records[change.Save.Key] = *change.Save
+	case change.Delete != "":
+		delete(r.records, change.Delete)
+	case change.PurgeBefore != nil:
+		for key, record := range r.records {
+			if !record.ExpiresAt.After(*change.PurgeBefore) {
+				delete(r.records, key)
+			}
+		}
+	}
+}
+
+// update runs fn while holding r.mu and applies the change it returns, if any. If commit is
+// not nil it is called with the change first and returns the sequence number it was logged
+// with, or an error to veto it.
+func (r *idempotencyRecords) update(fn func() *idempotencyChange, commit func(idempotencyChange) (uint64, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	change := fn()
+	if change == nil {
+		return nil
+	}
+	if commit != nil {
+		seq, err := commit(*change)
+		if err != nil {
+			return err
+		}
+		r.seq = seq
+	}
+	r.apply(*change)
+	return nil
+}
+
+// reserve stores record unless an unexpired record with the same key exists, or takes over the
+// existing record if its lease has lapsed. It returns the record stored under the key and
+// whether it was reserved.
+func (r *idempotencyRecords) reserve(record model.IdempotencyRecord, commit func(idempotencyChange) (uint64, error)) (model.IdempotencyRecord, bool, error) {
+	result := record
+	reserved := false
+	err := r.update(func() *idempotencyChange {
+		existing, ok := r.records[record.Key]
+		if !ok || !existing.ExpiresAt.After(record.CreatedAt) {
+			reserved = true
+			return &idempotencyChange{Save: &record}
+		}
+		result = existing
+		if existing.Completed || existing.Fingerprint != record.Fingerprint || existing.LeaseExpiresAt.IsZero() || existing.LeaseExpiresAt.After(record.CreatedAt) {
+			return nil
+		}
+		// Take over the request, keeping its RequestID so what it already wrote is found
+		result.LeaseExpiresAt = record.LeaseExpiresAt
+		reserved = true
+		return &idempotencyChange{Save: &result}
+	}, commit)
+	if err != nil {
+		return model.IdempotencyRecord{}, false, err
+	}
+	return result, reserved, nil
+}
+
+// ReserveIdempotencyKey stores the given record unless an unexpired record with the same key
+// exists, in which case that record is returned instead. The bool reports whether the key was
+// reserved. A record has expired once its ExpiresAt is not after the new record's CreatedAt.
+// An uncompleted record with the same Fingerprint whose lease has lapsed by then is taken over
+// instead: it is returned with the new record's LeaseExpiresAt and the key is reserved.
+func (db *InMemoryDB) ReserveIdempotencyKey(record model.IdempotencyRecord) (model.IdempotencyRecord, bool, error) {
+	return db.idempotency.reserve(record, nil)
+}
+
+// SaveIdempotencyRecord stores the record, replacing any record with the same key
+func (db *InMemoryDB) SaveIdempotencyRecord(record model.IdempotencyRecord) error {
+	return db.idempotency.update(func() *idempotencyChange {
+		return &idempotencyChange{Save: &record}
+	}, nil)
+}
+
+// DeleteIdempotencyKey removes the record stored under the key, if any
+func (db *InMemoryDB) DeleteIdempotencyKey(key string) error {
+	return db.idempotency.update(func() *idempotencyChange {
+		return &idempotencyChange{Delete: key}
+	}, nil)
+}
+
+// PurgeIdempotencyRecords removes every record that has expired at the given time
+func (db *InMemoryDB) PurgeIdempotencyRecords(now time.Time) error {
+	return db.idempotency.update(func() *idempotencyChange {
+		return &idempotencyChange{PurgeBefore: &now}
+	}, nil)
+}
+
+// ReserveIdempotencyKey durably stores the record. See InMemoryDB.ReserveIdempotencyKey.
+func (db *FileDB) ReserveIdempotencyKey(record model.IdempotencyRecord) (model.IdempotencyRecord, bool, error) {
+	return db.mem.idempotency.reserve(record, db.commitIdempotency)
+}
+
+// SaveIdempotencyRecord durably stores the record, replacing any record with the same key
+func (db *FileDB) SaveIdempotencyRecord(record model.IdempotencyRecord) error {
+	return db.mem.idempotency.update(func() *idempotencyChange {
+		return &idempotencyChange{Save: &record}
+	}, db.commitIdempotency)
+}
+
+// DeleteIdempotencyKey durably removes the record stored under the key, if any
+func (db *FileDB) DeleteIdempotencyKey(key string) error {
+	return db.mem.idempotency.update(func() *idempotencyChange {
+		return &idempotencyChange{Delete: key}
+	}, db.commitIdempotency)
+}
+
+// PurgeIdempotencyRecords durably removes every record that has expired at the given time
+func (db *FileDB) PurgeIdempotencyRecords(now time.Time) error {
+	return db.mem.idempotency.update(func() *idempotencyChange {
+		return &idempotencyChange{PurgeBefore: &now}
+	}, db.commitIdempotency)
+}
+
+func (db *FileDB) commitIdempotency(change idempotencyChange) (uint64, error) {
+	return db.commit(walRecord{Idempotency: &change})
+}
@@ -0,0 +1,339 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// lotProjection keeps a user's lots and authorized holds up to date as records are written, so
+// spends and holds do not replay the ledger to find the points they can draw from.
+//
+// Every positive transaction that is not a reversal is a lot. Allocations take points from
+// exactly the lots they name, and negative allocations give them back. Negative transactions
+// written without allocations, such as payer adjustments, are debits against the payer as a
+// whole: together they drain the payer's oldest lots first. Because they are not tied to any
+// lot, a lot written later with an earlier timestamp takes over the debits that had drained
+// newer lots, exactly as if it had been written first.
+type lotProjection struct {
+	lots   map[string]*lotState
+	payers map[string]*payerLots
+	// open holds the lots with points remaining, oldest first, and openStates their state
+	open       []model.Lot
+	openStates []*lotState
+	// changed holds the lots whose remaining balance changed since open was last updated
+	changed []*lotState
+	// holds holds the latest record of each hold whose status is authorized and that has not
+	// expired by latest, in no particular order, and holdIndex the position of each in holds
+	holds     []model.Hold
+	holdIndex map[string]int
+	// latest is the latest CreatedAt of the records applied. Holds that expired by then are
+	// dropped, so holds neither captured nor voided do not pile up.
+	latest time.Time
+	// nextExpiry is the earliest ExpiresAt among holds
+	nextExpiry time.Time
+	// written counts the lots written, to order lots with the same timestamp
+	written int
+}
+
+// lotState is a lot along with what has been taken from it
+type lotState struct {
+	lot model.Lot
+	// order breaks ties between lots with the same timestamp, in the order they were written
+	order int
+	// allocated is the sum of the allocations against the lot
+	allocated int
+	// drained is the part of the payer's debits taken from the lot
+	drained int
+	// isOpen and isChanged report whether the lot is in open and in changed
+	isOpen    bool
+	isChanged bool
+}
+
+// payerLots holds the lots of one payer, oldest first, and the payer's debits
+type payerLots struct {
+	lots []*lotState
+	// drainedTo is the index of the first lot from which every later lot has nothing drained
+	drainedTo int
+	// shortfall is the part of the payer's debits that no lot had points left to cover. It is
+	// drained from the payer's next lots.
+	shortfall int
+}
+
+func newLotProjection() lotProjection {
+	return lotProjection{
+		lots:      make(map[string]*lotState),
+		payers:    make(map[string]*payerLots),
+		holdIndex: make(map[string]int),
+	}
+}
+
+// apply updates the projection with records that have just been appended to the ledger
+func (p *lotProjection) apply(records model.Ledger) {
+	allocated := make(map[string]bool, len(records.Allocations))
+	for _, allocation := range records.Allocations {
+		allocated[allocation.TransactionID] = true
+	}
+
+	for _, tran := range records.Transactions {
+		if tran.Points > 0 && tran.ReversalOf == "" {
+			p.addLot(tran)
+		}
+	}
+	for _, allocation := range records.Allocations {
+		p.allocate(allocation)
+	}
+	for _, tran := range records.Transactions {
+		if tran.Points < 0 && !allocated[tran.ID] {
+			p.debit(tran.Payer, -tran.Points)
+		}
+	}
+	for _, tran := range records.Transactions {
+		if tran.CreatedAt.After(p.latest) {
+			p.latest = tran.CreatedAt
+		}
+	}
+	for _, hold := range records.Holds {
+		if hold.CreatedAt.After(p.latest) {
+			p.latest = hold.CreatedAt
+		}
+	}
+	for _, hold := range records.Holds {
+		p.applyHold(hold)
+	}
+	p.expireHolds()
+	p.updateOpen()
+}
+
+func (p *lotProjection) addLot(tran model.Transaction) {
+	lot := &lotState{
+		lot: model.Lot{
+			ID:        tran.ID,
+			Payer:     tran.Payer,
+			Points:    tran.Points,
+			Remaining: tran.Points,
+			Timestamp: tran.Timestamp,
+		},
+		order: p.written,
+	}
+	p.written++
+	p.lots[lot.lot.ID] = lot
+
+	payer := p.payer(tran.Payer)
+	i := sort.Search(len(payer.lots), func(i int) bool {
+		return lot.before(payer.lots[i])
+	})
+	payer.lots = append(payer.lots, nil)
+	copy(payer.lots[i+1:], payer.lots[i:])
+	payer.lots[i] = lot
+
+	p.change(lot)
+	if i < payer.drainedTo || payer.shortfall > 0 {
+		if i < payer.drainedTo {
+			payer.drainedTo++
+		}
+		p.settle(payer, i)
+	}
+}
+
+func (p *lotProjection) allocate(allocation model.Allocation) {
+	lot, ok := p.lots[allocation.LotID]
+	if !ok {
+		return
+	}
+	lot.allocated += allocation.Points
+
+	payer := p.payer(lot.lot.Payer)
+	if i := payer.index(lot); i < payer.drainedTo || payer.shortfall > 0 {
+		p.settle(payer, i)
+		return
+	}
+	p.change(lot)
+}
+
+func (p *lotProjection) debit(payerID string, points int) {
+	payer := p.payer(payerID)
+	payer.shortfall += points
+	from := payer.drainedTo - 1
+	if from < 0 {
+		from = 0
+	}
+	p.settle(payer, from)
+}
+
+// applyHold keeps the latest record of each authorized hold, dropping holds once they are
+// captured or voided
+func (p *lotProjection) applyHold(hold model.Hold) {
+	if i, ok := p.holdIndex[hold.ID]; ok {
+		p.removeHold(i)
+	}
+	if hold.Status != model.HoldAuthorized || p.expired(hold) {
+		return
+	}
+	p.holdIndex[hold.ID] = len(p.holds)
+	p.holds = append(p.holds, hold)
+	if p.nextExpiry.IsZero() || hold.ExpiresAt.Before(p.nextExpiry) {
+		p.nextExpiry = hold.ExpiresAt
+	}
+}
+
+// expireHolds drops the holds that expired by p.latest
+func (p *lotProjection) expireHolds() {
+	if len(p.holds) == 0 || p.latest.Before(p.nextExpiry) {
+		return
+	}
+	p.nextExpiry = time.Time{}
+	for i := 0; i < len(p.holds); {
+		hold := p.holds[i]
+		if p.expired(hold) {
+			p.removeHold(i)
+			continue
+		}
+		if p.nextExpiry.IsZero() || hold.ExpiresAt.Before(p.nextExpiry) {
+			p.nextExpiry = hold.ExpiresAt
+		}
+		i++
+	}
+}
+
+// expired reports whether the hold expired by p.latest. Nothing expires before a record with a
+// CreatedAt has been applied.
+func (p *lotProjection) expired(hold model.Hold) bool {
+	return !p.latest.IsZero() && !p.latest.Before(hold.ExpiresAt)
+}
+
+// removeHold removes the hold at index i from holds by moving the last hold in its place
+func (p *lotProjection) removeHold(i int) {
+	delete(p.holdIndex, p.holds[i].ID)
+	last := len(p.holds) - 1
+	if i != last {
+		p.holds[i] = p.holds[last]
+		p.holdIndex[p.holds[i].ID] = i
+	}
+	p.holds = p.holds[:last]
+}
+
+// settle drains the payer's debits again from the lot at index from onwards. The lots before
+// it are left as they are, as nothing that changed affects them.
+func (p *lotProjection) settle(payer *payerLots, from int) {
+	pool := payer.shortfall
+	for i := from; i < payer.drainedTo && i < len(payer.lots); i++ {
+		pool += payer.lots[i].drained
+	}
+
+	drainedTo := from
+	for i := from; i < len(payer.lots) && (pool > 0 || i < payer.drainedTo); i++ {
+		lot := payer.lots[i]
+		drained := lot.lot.Points - lot.allocated
+		if drained > pool {
+			drained = pool
+		}
+		if drained < 0 {
+			drained = 0
+		}
+		pool -= drained
+		lot.drained = drained
+		p.change(lot)
+		if drained > 0 {
+			drainedTo = i + 1
+		}
+	}
+	payer.drainedTo = drainedTo
+	payer.shortfall = pool
+}
+
+// change recomputes the lot's remaining balance, leaving open to be updated by updateOpen
+func (p *lotProjection) change(lot *lotState) {
+	lot.lot.Remaining = lot.lot.Points - lot.allocated - lot.drained
+	if !lot.isChanged {
+		lot.isChanged = true
+		p.changed = append(p.changed, lot)
+	}
+}
+
+// maxPlacedLots is the most changed lots updateOpen places in open one by one. Beyond it, as
+// when a large spend drains many lots, open is rebuilt in one pass instead.
+const maxPlacedLots = 16
+
+// updateOpen brings open in line with the lots that changed
+func (p *lotProjection) updateOpen() {
+	if len(p.changed) > maxPlacedLots {
+		states := p.openStates[:0:0]
+		for _, lot := range p.openStates {
+			if lot.lot.Remaining > 0 {
+				states = append(states, lot)
+			}
+		}
+		for _, lot := range p.changed {
+			if !lot.isOpen && lot.lot.Remaining > 0 {
+				states = append(states, lot)
+			}
+		}
+		sort.Slice(states, func(i, j int) bool {
+			return states[i].before(states[j])
+		})
+		p.openStates = states
+		p.open = make([]model.Lot, len(states))
+		for i, lot := range states {
+			p.open[i] = lot.lot
+		}
+		for _, lot := range p.changed {
+			lot.isOpen = lot.lot.Remaining > 0
+		}
+	} else {
+		for _, lot := range p.changed {
+			p.place(lot)
+		}
+	}
+	for _, lot := range p.changed {
+		lot.isChanged = false
+	}
+	p.changed = p.changed[:0]
+}
+
+// place adds, updates or removes the lot in open depending on its remaining balance
+func (p *lotProjection) place(lot *lotState) {
+	i := sort.Search(len(p.openStates), func(i int) bool {
+		return !p.openStates[i].before(lot)
+	})
+	switch {
+	case lot.isOpen && lot.lot.Remaining > 0:
+		p.open[i] = lot.lot
+	case lot.isOpen:
+		p.open = append(p.open[:i], p.open[i+1:]...)
+		p.openStates = append(p.openStates[:i], p.openStates[i+1:]...)
+	case lot.lot.Remaining > 0:
+		p.open = append(p.open, model.Lot{})
+		copy(p.open[i+1:], p.open[i:])
+		p.open[i] = lot.lot
+		p.openStates = append(p.openStates, nil)
+		copy(p.openStates[i+1:], p.openStates[i:])
+		p.openStates[i] = lot
+	}
+	lot.isOpen = lot.lot.Remaining > 0
+}
+
+func (p *lotProjection) payer(payerID string) *payerLots {
+	payer, ok := p.payers[payerID]
+	if !ok {
+		payer = &payerLots{}
+		p.payers[payerID] = payer
+	}
+	return payer
+}
+
+// index returns the position of the lot among the payer's lots
+func (p *payerLots) index(lot *lotState) int {
+	return sort.Search(len(p.lots), func(i int) bool {
+		return !p.lots[i].before(lot)
+	})
+}
+
+// before reports whether l is older than other
+func (l *lotState) before(other *lotState) bool {
+	if l.lot.Timestamp.Equal(other.lot.Timestamp) {
+		return l.order < other.order
+	}
+	return l.lot.Timestamp.Before(other.lot.Timestamp)
+}
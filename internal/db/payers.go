@@ -0,0 +1,149 @@
+package db
+
+import (
+	"sort"
+	"sync"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// payerChange is a single change to the payer registry. Exactly one of its fields is set.
+type payerChange struct {
+	Save   *model.Payer `json:"save,omitempty"`
+	Delete string       `json:"delete,omitempty"`
+}
+
+// payerRecords holds the registered payers, keyed by payer ID
+type payerRecords struct {
+	mu     sync.RWMutex
+	payers map[string]model.Payer
+	// seq is the sequence number of the last log record applied, when kept by a FileDB
+	seq uint64
+}
+
+// apply makes the change. Must be called while holding r.mu.
+func (r *payerRecords) apply(change payerChange) {
+	switch {
+	case change.Save != nil:
+		r.payers[change.Save.ID] = *change.Save
+	case change.Delete != "":
+		delete(r.payers, change.Delete)
+	}
+}
+
+// update runs fn while holding r.mu and applies the change it returns, if any. If commit is
+// not nil it is called with the change first and returns the sequence number it was logged
+// with, or an error to veto it.
+func (r *payerRecords) update(fn func() (*payerChange, error), commit func(payerChange) (uint64, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	change, err := fn()
+	if err != nil || change == nil {
+		return err
+	}
+	if commit != nil {
+		seq, err := commit(*change)
+		if err != nil {
+			return err
+		}
+		r.seq = seq
+	}
+	r.apply(*change)
+	return nil
+}
+
+func (r *payerRecords) get(payerID string) (model.Payer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payer, ok := r.payers[payerID]
+	return payer, ok
+}
+
+// all returns every payer ordered by ID
+func (r *payerRecords) all() []model.Payer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payers := make([]model.Payer, 0, len(r.payers))
+	for _, payer := range r.payers {
+		payers = append(payers, payer)
+	}
+	sort.Slice(payers, func(i, j int) bool {
+		return payers[i].ID < payers[j].ID
+	})
+	return payers
+}
+
+// save runs fn against the payer stored under payerID, if any, and stores the payer it returns
+func (r *payerRecords) save(payerID string, fn func(existing model.Payer, found bool) (model.Payer, error), commit func(payerChange) (uint64, error)) error {
+	return r.update(func() (*payerChange, error) {
+		existing, found := r.payers[payerID]
+		payer, err := fn(existing, found)
+		if err != nil {
+			return nil, err
+		}
+		payer.ID = payerID
+		return &payerChange{Save: &payer}, nil
+	}, commit)
+}
+
+// remove deletes the payer stored under payerID and reports whether there was one
+func (r *payerRecords) remove(payerID string, commit func(payerChange) (uint64, error)) (bool, error) {
+	found := false
+	err := r.update(func() (*payerChange, error) {
+		if _, found = r.payers[payerID]; !found {
+			return nil, nil
+		}
+		return &payerChange{Delete: payerID}, nil
+	}, commit)
+	return found, err
+}
+
+// GetPayer returns the registered payer with the given ID
+func (db *InMemoryDB) GetPayer(payerID string) (model.Payer, bool) {
+	return db.payers.get(payerID)
+}
+
+// GetPayers returns every registered payer ordered by ID
+func (db *InMemoryDB) GetPayers() []model.Payer {
+	return db.payers.all()
+}
+
+// UpdatePayer runs fn as a unit of work against the payer with the given ID. fn receives the
+// payer currently registered under the ID, if found, and returns the payer to store in its
+// place. Nothing is stored if fn returns an error.
+func (db *InMemoryDB) UpdatePayer(payerID string, fn func(existing model.Payer, found bool) (model.Payer, error)) error {
+	return db.payers.save(payerID, fn, nil)
+}
+
+// DeletePayer removes the payer with the given ID from the registry and reports whether it
+// was registered
+func (db *InMemoryDB) DeletePayer(payerID string) (bool, error) {
+	return db.payers.remove(payerID, nil)
+}
+
+// GetPayer returns the registered payer with the given ID
+func (db *FileDB) GetPayer(payerID string) (model.Payer, bool) {
+	return db.mem.GetPayer(payerID)
+}
+
+// GetPayers returns every registered payer ordered by ID
+func (db *FileDB) GetPayers() []model.Payer {
+	return db.mem.GetPayers()
+}
+
+// UpdatePayer durably stores the payer returned by fn. See InMemoryDB.UpdatePayer.
+func (db *FileDB) UpdatePayer(payerID string, fn func(existing model.Payer, found bool) (model.Payer, error)) error {
+	return db.mem.payers.save(payerID, fn, db.commitPayer)
+}
+
+// DeletePayer durably removes the payer with the given ID from the registry
+func (db *FileDB) DeletePayer(payerID string) (bool, error) {
+	return db.mem.payers.remove(payerID, db.commitPayer)
+}
+
+func (db *FileDB) commitPayer(change payerChange) (uint64, error) {
+	return db.commit(walRecord{Payer: &change})
+}
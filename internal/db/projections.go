@@ -0,0 +1,178 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// ProjectionDrift reports a projection that disagrees with the user's records. For a payer
+// balance LotID and HoldID are empty and Projected and Actual are the projected balance and the
+// sum of the payer's transactions. For a lot they are its projected remaining points and those
+// left after replaying the records, and for an authorized hold its points, 0 when the lot or
+// hold is missing on that side. A hold whose record differs in any other way is reported too.
+type ProjectionDrift struct {
+	UserID    string `json:"userId"`
+	Payer     string `json:"payer"`
+	LotID     string `json:"lotId,omitempty"`
+	HoldID    string `json:"holdId,omitempty"`
+	Projected int    `json:"projected"`
+	Actual    int    `json:"actual"`
+}
+
+// CheckProjections recomputes every user's payer balances, open lots and authorized holds from
+// their raw records and reports each whose projection has drifted, ordered by user and payer
+func (db *InMemoryDB) CheckProjections() []ProjectionDrift {
+	return db.checkProjections(false)
+}
+
+// RebuildProjections recomputes every user's payer balances, lots and holds, and the total of
+// the balances, from their raw records, replaces the projections with them and reports the
+// drift that was corrected. Writes made while it runs may be missed by the total, so it
+// is meant to be run before the database is in use.
+func (db *InMemoryDB) RebuildProjections() []ProjectionDrift {
+	return db.checkProjections(true)
+}
+
+func (db *InMemoryDB) checkProjections(rebuild bool) []ProjectionDrift {
+	drift := make([]ProjectionDrift, 0)
+	for _, userID := range db.GetUserIDs() {
+		ledger, ok := db.getLedger(userID)
+		if !ok {
+			continue
+		}
+		drift = append(drift, ledger.check(userID, rebuild)...)
+	}
+
+	if rebuild {
+		total := 0
+		for _, userID := range db.GetUserIDs() {
+			ledger, ok := db.getLedger(userID)
+			if !ok {
+				continue
+			}
+			ledger.mu.RLock()
+			for _, points := range ledger.balances {
+				total += points
+			}
+			ledger.mu.RUnlock()
+		}
+		atomic.StoreInt64(db.totalPoints, int64(total))
+	}
+	return drift
+}
+
+// check compares the balances and lots projections with projections rebuilt from the records,
+// replacing them and the requests projection if rebuild is true
+func (l *userLedger) check(userID string, rebuild bool) []ProjectionDrift {
+	if rebuild {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+	} else {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+	}
+
+	actual := make(map[string]int)
+	for _, tran := range l.transactions {
+		actual[tran.Payer] += tran.Points
+	}
+	lots := newLotProjection()
+	lots.apply(l.view())
+
+	drift := make([]ProjectionDrift, 0)
+	payers := make(map[string]bool)
+	for payer := range actual {
+		payers[payer] = true
+	}
+	for payer := range l.balances {
+		payers[payer] = true
+	}
+	for payer := range payers {
+		projected, ok := l.balances[payer]
+		if projected != actual[payer] || !ok {
+			drift = append(drift, ProjectionDrift{
+				UserID:    userID,
+				Payer:     payer,
+				Projected: projected,
+				Actual:    actual[payer],
+			})
+		}
+	}
+	drift = append(drift, lotDrift(userID, l.lots.open, lots.open)...)
+	drift = append(drift, holdDrift(userID, l.lots.holds, lots.holds)...)
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Payer != drift[j].Payer {
+			return drift[i].Payer < drift[j].Payer
+		}
+		if drift[i].HoldID != drift[j].HoldID {
+			return drift[i].HoldID < drift[j].HoldID
+		}
+		return drift[i].LotID < drift[j].LotID
+	})
+
+	if rebuild {
+		l.balances = actual
+		l.lots = lots
+		l.requests = make(map[string]model.Ledger)
+		l.indexRequests(l.view())
+	}
+	return drift
+}
+
+// lotDrift reports the lots that are open in only one of projected and actual, or differ. Lots
+// are matched by ID, in order among lots with the same ID.
+func lotDrift(userID string, projected, actual []model.Lot) []ProjectionDrift {
+	byID := make(map[string][]model.Lot, len(actual))
+	for _, lot := range actual {
+		byID[lot.ID] = append(byID[lot.ID], lot)
+	}
+	drift := make([]ProjectionDrift, 0)
+	for _, lot := range projected {
+		var want model.Lot
+		matches := byID[lot.ID]
+		if len(matches) > 0 {
+			want, byID[lot.ID] = matches[0], matches[1:]
+		}
+		if len(matches) == 0 || !reflect.DeepEqual(lot, want) {
+			drift = append(drift, ProjectionDrift{UserID: userID, Payer: lot.Payer, LotID: lot.ID, Projected: lot.Remaining, Actual: want.Remaining})
+		}
+	}
+	for _, lots := range byID {
+		for _, lot := range lots {
+			drift = append(drift, ProjectionDrift{UserID: userID, Payer: lot.Payer, LotID: lot.ID, Actual: lot.Remaining})
+		}
+	}
+	return drift
+}
+
+// holdDrift reports the holds that are authorized in only one of projected and actual, or
+// differ
+func holdDrift(userID string, projected, actual []model.Hold) []ProjectionDrift {
+	byID := make(map[string]model.Hold, len(actual))
+	for _, hold := range actual {
+		byID[hold.ID] = hold
+	}
+	drift := make([]ProjectionDrift, 0)
+	for _, hold := range projected {
+		want, ok := byID[hold.ID]
+		delete(byID, hold.ID)
+		if !ok || !reflect.DeepEqual(hold, want) {
+			drift = append(drift, ProjectionDrift{UserID: userID, Payer: holdPayer(hold), HoldID: hold.ID, Projected: hold.Points, Actual: want.Points})
+		}
+	}
+	for _, hold := range byID {
+		drift = append(drift, ProjectionDrift{UserID: userID, Payer: holdPayer(hold), HoldID: hold.ID, Actual: hold.Points})
+	}
+	return drift
+}
+
+// holdPayer returns the payer of the hold's first allocation, as holds are not tied to a payer
+func holdPayer(hold model.Hold) string {
+	if len(hold.Allocations) == 0 {
+		return ""
+	}
+	return hold.Allocations[0].Payer
+}
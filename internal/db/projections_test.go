@@ -0,0 +1,130 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestProjections(t *testing.T) {
+	database := newInMemoryDB()
+	for _, tran := range test.Data {
+		assert.NoError(t, database.AddTransaction("1", tran))
+	}
+	assert.NoError(t, database.AddTransaction("2", test.Data[0]))
+	assert.Empty(t, database.CheckProjections())
+	assert.Equal(t, 12300, database.GetTotalPoints())
+
+	// Corrupt the projections behind the ledger's back
+	ledger, _ := database.getLedger("1")
+	ledger.balances["DANNON"] = 5
+	delete(ledger.balances, "UNILEVER")
+
+	expected := []ProjectionDrift{
+		{UserID: "1", Payer: "DANNON", Projected: 5, Actual: 1100},
+		{UserID: "1", Payer: "UNILEVER", Projected: 0, Actual: 200},
+	}
+	assert.Equal(t, expected, database.CheckProjections())
+	assert.Equal(t, 5, database.GetAccounts("1")[0].Points)
+
+	assert.Equal(t, expected, database.RebuildProjections())
+	assert.Empty(t, database.CheckProjections())
+	assert.Equal(t, 12300, database.GetTotalPoints())
+	assert.Equal(t, []model.Account{
+		{Payer: "DANNON", Points: 1100},
+		{Payer: "MILLER COORS", Points: 10000},
+		{Payer: "UNILEVER", Points: 200},
+	}, database.GetAccounts("1"))
+}
+
+func TestProjections_lots_and_holds(t *testing.T) {
+	database := newInMemoryDB()
+	hold := model.Hold{
+		ID:          "hold",
+		Points:      100,
+		Status:      model.HoldAuthorized,
+		Allocations: []model.Allocation{{LotID: "1", Payer: "DANNON", Points: 100}},
+	}
+	err := database.UpdateLedger("1", func(model.Ledger) (model.Ledger, error) {
+		return model.Ledger{
+			Transactions: []model.Transaction{
+				{ID: "1", Payer: "DANNON", Points: 300, Timestamp: test.ParseTime("2020-10-31T10:00:00Z")},
+				{ID: "2", Payer: "UNILEVER", Points: 200, Timestamp: test.ParseTime("2020-10-31T11:00:00Z")},
+			},
+			Holds: []model.Hold{hold},
+		}, nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, database.CheckProjections())
+
+	// Corrupt the projections behind the ledger's back, leaving the balances alone
+	ledger, _ := database.getLedger("1")
+	ledger.lots.open[0].Remaining = 5
+	ledger.lots.open = ledger.lots.open[:1]
+	ledger.lots.holds = nil
+
+	expected := []ProjectionDrift{
+		{UserID: "1", Payer: "DANNON", LotID: "1", Projected: 5, Actual: 300},
+		{UserID: "1", Payer: "DANNON", HoldID: "hold", Actual: 100},
+		{UserID: "1", Payer: "UNILEVER", LotID: "2", Actual: 200},
+	}
+	assert.Equal(t, expected, database.CheckProjections())
+
+	assert.Equal(t, expected, database.RebuildProjections())
+	assert.Empty(t, database.CheckProjections())
+	open := database.GetOpenLots("1")
+	assert.Len(t, open.Lots, 2)
+	assert.Equal(t, []model.Hold{hold}, open.OpenHolds)
+}
+
+// The benchmarks below read and write a user with a growing history. Their time per
+// operation should stay flat as the history grows.
+
+func BenchmarkGetAccounts(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			database := databaseWithHistory(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				database.GetAccounts("1")
+			}
+		})
+	}
+}
+
+func BenchmarkAddTransaction(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			database := databaseWithHistory(size)
+			start := test.ParseTime("2021-01-01T00:00:00Z")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tran := model.Transaction{Payer: "DANNON", Points: 1, Timestamp: start.Add(time.Duration(i) * time.Second)}
+				_ = database.UpdateLedger("1", func(model.Ledger) (model.Ledger, error) {
+					return model.Ledger{Transactions: []model.Transaction{tran}}, nil
+				})
+			}
+		})
+	}
+}
+
+// databaseWithHistory returns a database where user 1 has the given number of transactions
+// spread across a handful of payers
+func databaseWithHistory(size int) *InMemoryDB {
+	database := newInMemoryDB()
+	start := test.ParseTime("2020-01-01T00:00:00Z")
+	for i := 0; i < size; i++ {
+		_ = database.AddTransaction("1", model.Transaction{
+			ID:        fmt.Sprintf("%d", i),
+			Payer:     fmt.Sprintf("PAYER %d", i%5),
+			Points:    100,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	return database
+}
@@ -0,0 +1,312 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds, in seconds, of the histogram buckets used for request
+// latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// StorageBuckets are the upper bounds, in seconds, of the histogram buckets used for storage
+// operations, which are mostly much faster than a request
+var StorageBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// Default is the Registry the API's metrics are registered with and served from
+var Default = NewRegistry()
+
+// Registry holds metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// metric is a named metric with all of its series
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// NewCounter registers a counter partitioned by the given labels. It panics if the name is
+// already registered.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, kind: "counter", labels: labels}, series: make(map[string]*counterSeries)}
+	r.register(name, c)
+	return c
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, partitioned by the
+// given labels. It panics if the name is already registered.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name: name, help: help, kind: "histogram", labels: labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.register(name, h)
+	return h
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn every time the metrics are
+// written. It panics if the name is already registered.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &gaugeFunc{desc: desc{name: name, help: help, kind: "gauge"}, fn: fn})
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	r.metrics[name] = m
+}
+
+// Write writes every metric, sorted by name, in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Handler serves the metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.Write(w)
+	})
+}
+
+// desc describes a metric and the names of the labels its series are partitioned by
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+}
+
+// key identifies the series with the given label values
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelPairs formats the labels with the given values, and an optional extra label, as
+// {name="value",...}
+func (d desc) labelPairs(labelValues []string, extraName, extraValue string) string {
+	if len(d.labels) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(d.labels)+1)
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a metric that only goes up, such as the number of requests served
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Inc adds 1 to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.name))
+	}
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: append([]string(nil), labelValues...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// Value returns the value of the series with the given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.series[key]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(s.labelValues, "", ""), formatFloat(s.value))
+	}
+}
+
+// Histogram is a metric that counts observations, such as request latencies, in buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts holds the number of observations in each bucket, and not in the buckets before it
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince records the seconds elapsed since start in the series with the given label
+// values
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns the number of observations in the series with the given label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(s.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(s.labelValues, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(s.labelValues, "", ""), s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is computed when it is written
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
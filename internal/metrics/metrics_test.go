@@ -0,0 +1,67 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.NewCounter("requests_total", "Requests served", "route", "status")
+	latency := registry.NewHistogram("latency_seconds", "Request latency", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("outstanding", "Points owed\nto users", func() float64 { return 42 })
+
+	requests.Inc("/balance", "200")
+	requests.Add(2, "/balance", "200")
+	requests.Inc(`/say "hi"`, "404")
+	latency.Observe(0.05, "/balance")
+	latency.Observe(0.1, "/balance")
+	latency.Observe(3, "/balance")
+
+	var out bytes.Buffer
+	assert.NoError(t, registry.Write(&out))
+	assert.Equal(t, `# HELP latency_seconds Request latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/balance",le="0.1"} 2
+latency_seconds_bucket{route="/balance",le="1"} 2
+latency_seconds_bucket{route="/balance",le="+Inf"} 3
+latency_seconds_sum{route="/balance"} 3.15
+latency_seconds_count{route="/balance"} 3
+# HELP outstanding Points owed\nto users
+# TYPE outstanding gauge
+outstanding 42
+# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{route="/balance",status="200"} 3
+requests_total{route="/say \"hi\"",status="404"} 1
+`, out.String())
+
+	assert.Equal(t, float64(3), requests.Value("/balance", "200"))
+	assert.Equal(t, float64(0), requests.Value("/balance", "500"))
+	assert.Equal(t, uint64(3), latency.Count("/balance"))
+}
+
+func TestRegistry_misuse(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.NewCounter("requests_total", "Requests served", "route")
+
+	assert.Panics(t, func() { registry.NewCounter("requests_total", "Requests served") })
+	assert.Panics(t, func() { requests.Inc() })
+	assert.Panics(t, func() { requests.Add(-1, "/balance") })
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounter("requests_total", "Requests served").Inc()
+
+	w := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "requests_total 1\n")
+}
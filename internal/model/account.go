@@ -1,7 +1,16 @@
 package model
 
+import "time"
+
 // Account represents a payer and holds the payer's name and balance
 type Account struct {
 	Payer  string `json:"payer"`
 	Points int    `json:"points"`
 }
+
+// Balance is a user's total balance across all payers. AsOf is set when the balance is as it
+// stood at an earlier time.
+type Balance struct {
+	Points int        `json:"points"`
+	AsOf   *time.Time `json:"asOf,omitempty"`
+}
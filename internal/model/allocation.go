@@ -0,0 +1,11 @@
+package model
+
+// Allocation records that a negative Transaction, such as one written by a spend, drew Points
+// from a Lot. The reversal of a spend records allocations with negative Points, giving the
+// points back to the Lot they were drawn from.
+type Allocation struct {
+	TransactionID string `json:"transactionId"`
+	LotID         string `json:"lotId"`
+	Payer         string `json:"payer"`
+	Points        int    `json:"points"`
+}
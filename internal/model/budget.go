@@ -0,0 +1,51 @@
+package model
+
+import "time"
+
+// PayerBudget is the prepaid balance a payer issues points from. Remaining is what is left of
+// the Funded points once the Issued points are taken off. The caps, when not 0, limit the
+// points the payer can issue per UTC day in total and to any one user. The Day counters track
+// the points issued on Day so far.
+type PayerBudget struct {
+	PayerID      string `json:"payerId"`
+	Funded       int    `json:"funded"`
+	Issued       int    `json:"issued"`
+	Remaining    int    `json:"remaining"`
+	DailyCap     int    `json:"dailyCap,omitempty"`
+	UserDailyCap int    `json:"userDailyCap,omitempty"`
+
+	Day               string         `json:"day,omitempty"`
+	IssuedOnDay       int            `json:"issuedOnDay"`
+	IssuedOnDayByUser map[string]int `json:"issuedOnDayByUser,omitempty"`
+
+	// Requests is a projection of the entries written by requests with a RequestID, keyed by
+	// RequestID. It is only set on the budget a unit of work receives and is never stored.
+	Requests map[string]BudgetEntry `json:"-"`
+}
+
+// BudgetEntryType says what a BudgetEntry records
+type BudgetEntryType string
+
+// The types of BudgetEntry
+const (
+	// BudgetFunding adds prepaid points to the budget
+	BudgetFunding BudgetEntryType = "funding"
+	// BudgetIssuance takes away the points issued to a user
+	BudgetIssuance BudgetEntryType = "issuance"
+)
+
+// BudgetEntry is a single change to a PayerBudget's balance. Funding has positive Points while
+// issuances have negative Points. Issuances name the user and the transaction the points were
+// issued for.
+type BudgetEntry struct {
+	ID            string          `json:"id"`
+	Type          BudgetEntryType `json:"type"`
+	PayerID       string          `json:"payerId"`
+	UserID        string          `json:"userId,omitempty"`
+	TransactionID string          `json:"transactionId,omitempty"`
+	Points        int             `json:"points"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	// RequestID identifies the request made with an Idempotency-Key that wrote the entry. See
+	// Transaction.RequestID.
+	RequestID string `json:"requestId,omitempty"`
+}
@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// HoldStatus is the state a Hold is in
+type HoldStatus string
+
+// The states of a Hold. A hold starts out authorized and ends up captured, voided or expired.
+const (
+	HoldAuthorized HoldStatus = "authorized"
+	HoldCaptured   HoldStatus = "captured"
+	HoldVoided     HoldStatus = "voided"
+	HoldExpired    HoldStatus = "expired"
+)
+
+// Hold earmarks Points from a user's lots so they can be spent later. While the hold is
+// authorized its Allocations, which have no TransactionID, keep the points from being spent
+// by anything else. Capturing the hold spends them and records the SpendID. A hold that is
+// neither captured nor voided by ExpiresAt expires and its points become available again.
+type Hold struct {
+	ID          string       `json:"id"`
+	Points      int          `json:"points"`
+	Status      HoldStatus   `json:"status"`
+	Allocations []Allocation `json:"allocations"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	ExpiresAt   time.Time    `json:"expiresAt"`
+	SpendID     string       `json:"spendId,omitempty"`
+	// RequestID identifies the request made with an Idempotency-Key that wrote this record of
+	// the hold. See Transaction.RequestID.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// StatusAt returns the status of the hold at the given time, which is HoldExpired for an
+// authorized hold once ExpiresAt has passed
+func (h Hold) StatusAt(t time.Time) HoldStatus {
+	if h.Status == HoldAuthorized && !t.Before(h.ExpiresAt) {
+		return HoldExpired
+	}
+	return h.Status
+}
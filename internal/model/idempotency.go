@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// IdempotencyRecord remembers a request made with an Idempotency-Key and, once the request has
+// completed, the response that was sent, so retries of the request get the same response.
+// Fingerprint identifies the request the key was first used with, and RequestID tags the
+// records written while handling it. Until the request completes it is only held by whoever is
+// handling it until LeaseExpiresAt, after which a retry of the same request can take it over.
+// Without a LeaseExpiresAt it is held until it expires.
+type IdempotencyRecord struct {
+	Key            string    `json:"key"`
+	Fingerprint    string    `json:"fingerprint"`
+	RequestID      string    `json:"requestId,omitempty"`
+	Completed      bool      `json:"completed"`
+	StatusCode     int       `json:"statusCode,omitempty"`
+	ContentType    string    `json:"contentType,omitempty"`
+	Body           []byte    `json:"body,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LeaseExpiresAt time.Time `json:"leaseExpiresAt,omitempty"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+}
@@ -0,0 +1,23 @@
+package model
+
+// Ledger holds a user's stored records: the Transactions that changed their balance, the
+// Allocations recording which lots each negative Transaction drew from and the Holds placed on
+// their points. Holds are stored once per change of status, so the last record with a given
+// hold ID is its current state.
+//
+// Lots and OpenHolds are projections the database keeps up to date as records are written, so
+// they can be read without replaying the records. Lots holds the lots with points remaining,
+// oldest first. Their remaining balances do not take holds into account and their ExpiresAt is
+// not set, as both depend on when they are read. OpenHolds holds the latest record of each hold
+// whose status is authorized, in no particular order. A hold is dropped once a record created
+// at or after its ExpiresAt is written, so it may include holds that have since expired. Requests holds the
+// transactions and hold records written by each request with a RequestID, keyed by RequestID.
+// None of them is stored, nor appended when returned from a unit of work.
+type Ledger struct {
+	Transactions []Transaction     `json:"transactions"`
+	Allocations  []Allocation      `json:"allocations"`
+	Holds        []Hold            `json:"holds"`
+	Lots         []Lot             `json:"-"`
+	OpenHolds    []Hold            `json:"-"`
+	Requests     map[string]Ledger `json:"-"`
+}
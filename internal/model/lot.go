@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// Lot is a positive Transaction viewed as a pool of points that debits draw from. A lot's ID
+// is the ID of the Transaction that earned it. ExpiresAt is nil when the lot never expires.
+type Lot struct {
+	ID        string     `json:"id"`
+	Payer     string     `json:"payer"`
+	Points    int        `json:"points"`
+	Remaining int        `json:"remaining"`
+	Timestamp time.Time  `json:"timestamp"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ExpiredAt reports whether the lot's points have expired at the given time
+func (l Lot) ExpiredAt(t time.Time) bool {
+	return l.ExpiresAt != nil && !t.Before(*l.ExpiresAt)
+}
@@ -0,0 +1,8 @@
+package model
+
+// TransactionPage is one page of a user's transaction history. NextCursor fetches the next
+// page and is empty on the last page.
+type TransactionPage struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"nextCursor,omitempty"`
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// PayerStatus says whether a Payer may issue points
+type PayerStatus string
+
+// The states of a Payer
+const (
+	PayerActive    PayerStatus = "active"
+	PayerSuspended PayerStatus = "suspended"
+)
+
+// Payer is a partner registered to issue points. ID is the canonical name used in
+// transactions and accounts, while DisplayName is how the payer prefers to be shown.
+type Payer struct {
+	ID          string      `json:"id"`
+	DisplayName string      `json:"displayName"`
+	Status      PayerStatus `json:"status"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	UpdatedAt   time.Time   `json:"updatedAt"`
+}
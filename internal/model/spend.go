@@ -0,0 +1,27 @@
+package model
+
+// Spend describes the outcome of spending points: the negative Transactions written per payer
+// and the Lots that funded them. Reversed is the number of points given back by the
+// Reversals of the spend so far.
+type Spend struct {
+	ID           string        `json:"id"`
+	Points       int           `json:"points"`
+	Transactions []Transaction `json:"transactions"`
+	Funding      []Funding     `json:"funding"`
+	Reversed     int           `json:"reversed"`
+	Reversals    []Transaction `json:"reversals"`
+}
+
+// Funding is the part of a Spend that was drawn from a single Lot
+type Funding struct {
+	Lot    Lot `json:"lot"`
+	Points int `json:"points"`
+}
+
+// SpendPreview describes what spending Points would do without spending them: the
+// Transactions that would be written, one per payer, and the resulting account Balances
+type SpendPreview struct {
+	Points       int           `json:"points"`
+	Transactions []Transaction `json:"transactions"`
+	Balances     []Account     `json:"balances"`
+}
@@ -2,10 +2,46 @@ package model
 
 import "time"
 
+// TransactionType says what kind of event a Transaction records
+type TransactionType string
+
+// The types of Transaction
+const (
+	// TransactionEarn adds points earned from a payer
+	TransactionEarn TransactionType = "earn"
+	// TransactionSpend takes points away when the user spends them
+	TransactionSpend TransactionType = "spend"
+	// TransactionAdjustment takes points away at a payer's request
+	TransactionAdjustment TransactionType = "adjustment"
+	// TransactionExpiration takes away points that have expired
+	TransactionExpiration TransactionType = "expiration"
+	// TransactionReversal gives back points taken by a spend
+	TransactionReversal TransactionType = "reversal"
+	// TransactionTransfer moves points into or out of the user's account from elsewhere
+	TransactionTransfer TransactionType = "transfer"
+)
+
 // Transaction represents an event that changes the state of the overall point balance for
-// specific payers
+// specific payers. Timestamp is when the event happened for the business, while CreatedAt is
+// when the server recorded it.
 type Transaction struct {
-	Payer     string    `json:"payer"`
-	Points    int       `json:"points"`
-	Timestamp time.Time `json:"timestamp"`
+	ID        string          `json:"id,omitempty"`
+	Type      TransactionType `json:"type,omitempty"`
+	Payer     string          `json:"payer"`
+	Points    int             `json:"points"`
+	Timestamp time.Time       `json:"timestamp"`
+	CreatedAt time.Time       `json:"createdAt"`
+	// Reference optionally identifies the transaction outside this service, for example a
+	// receipt or order ID
+	Reference string `json:"reference,omitempty"`
+	// Metadata holds free-form annotations
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// SpendID is set on the negative transactions written by a spend and identifies the spend
+	SpendID string `json:"spendId,omitempty"`
+	// ReversalOf is set on the positive transactions written when a spend is reversed and
+	// holds the ID of the reversed spend
+	ReversalOf string `json:"reversalOf,omitempty"`
+	// RequestID identifies the request made with an Idempotency-Key that wrote the transaction,
+	// so a retry of the request finds it instead of writing it again
+	RequestID string `json:"requestId,omitempty"`
 }
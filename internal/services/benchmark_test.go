@@ -0,0 +1,127 @@
+package services_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+// The benchmarks below read and write a user with a growing history. Their time per
+// operation should stay flat as the history grows.
+
+func BenchmarkGetAccounts(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			service := serviceWithHistory(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				service.GetAccounts("1")
+			}
+		})
+	}
+}
+
+func BenchmarkAddPoints(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			service := serviceWithHistory(b, size)
+			start := test.ParseTime("2021-01-01T00:00:00Z")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tran := model.Transaction{Payer: "DANNON", Points: 1, Timestamp: start.Add(time.Duration(i) * time.Second)}
+				if err := service.AddPoints("1", tran); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSpendPoints(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			service := serviceWithHistory(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := service.SpendPoints("1", 1, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAuthorizeHold(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			service := serviceWithHistory(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hold, err := service.AuthorizeHold("1", 1, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Voiding keeps the number of open holds from growing with b.N
+				if _, err := service.VoidHold("1", hold.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddPoints_adjustment(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("history=%d", size), func(b *testing.B) {
+			service := serviceWithHistory(b, size)
+			start := test.ParseTime("2021-01-01T00:00:00Z")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tran := model.Transaction{Payer: "PAYER 0", Points: -1, Timestamp: start.Add(time.Duration(i) * time.Second)}
+				if err := service.AddPoints("1", tran); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// serviceWithHistory returns a service where user 1 has earned and spent points the given
+// number of times from a handful of payers, whose points expire. Only the last lot of each payer
+// has points remaining, as is usual for a user with a long history.
+func serviceWithHistory(b *testing.B, size int) *services.PointService {
+	service := services.NewPointService(db.NewInMemoryDB())
+	start := test.ParseTime("2020-01-01T00:00:00Z")
+	for i := 0; i < 5; i++ {
+		service.ExpirationPolicies[fmt.Sprintf("PAYER %d", i)] = services.ExpireAfterMonths{Months: 1200}
+	}
+	for i := 0; i < size; i++ {
+		tran := model.Transaction{
+			Payer:     fmt.Sprintf("PAYER %d", i%5),
+			Points:    100,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		}
+		if err := service.AddPoints("1", tran); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := service.SpendPoints("1", size*100, nil); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		tran := model.Transaction{
+			Payer:     fmt.Sprintf("PAYER %d", i),
+			Points:    1000000000,
+			Timestamp: test.ParseTime("2020-12-31T00:00:00Z"),
+		}
+		if err := service.AddPoints("1", tran); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return service
+}
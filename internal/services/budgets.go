@@ -0,0 +1,191 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// Errors returned when a payer cannot issue the points added for it
+var (
+	ErrBudgetExceeded       = newError(ErrLimitExceeded, "budget_exhausted", "payer budget exhausted")
+	ErrDailyCapExceeded     = newError(ErrLimitExceeded, "daily_cap_exceeded", "payer daily issuance cap exceeded")
+	ErrUserDailyCapExceeded = newError(ErrLimitExceeded, "user_daily_cap_exceeded", "payer daily issuance cap per user exceeded")
+)
+
+// budgetDay is the layout of model.PayerBudget.Day
+const budgetDay = "2006-01-02"
+
+// budgetsDB is an abstraction for the database layer dependencies used by the BudgetLedger
+type budgetsDB interface {
+	GetBudget(payerID string) (model.PayerBudget, bool)
+	GetBudgetEntries(payerID string) []model.BudgetEntry
+	UpdateBudget(payerID string, fn func(model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error)) error
+}
+
+// BudgetCaps holds the issuance caps to set on a payer's budget. Fields left nil are not
+// changed and a cap of 0 removes it.
+type BudgetCaps struct {
+	DailyCap     *int `json:"dailyCap,omitempty"`
+	UserDailyCap *int `json:"userDailyCap,omitempty"`
+}
+
+// BudgetLedger keeps track of the points payers have prepaid for. Points added for a payer
+// are drawn from its budget, and are rejected once the budget or one of its daily caps would
+// be exceeded. Payers are identified by their canonical ID.
+type BudgetLedger struct {
+	DB    budgetsDB
+	Clock Clock
+
+	// requestID is set by WithRequestID
+	requestID string
+}
+
+// NewBudgetLedger creates a new BudgetLedger with the given budgetsDB using the system clock
+func NewBudgetLedger(db budgetsDB) *BudgetLedger {
+	return &BudgetLedger{
+		DB:    db,
+		Clock: systemClock{},
+	}
+}
+
+// WithRequestID returns a copy of the ledger that handles a single request identified by
+// requestID. See PointService.WithRequestID.
+func (b *BudgetLedger) WithRequestID(requestID string) *BudgetLedger {
+	ledger := *b
+	ledger.requestID = requestID
+	return &ledger
+}
+
+// GetBudget returns the budget of the payer. A payer that was never funded has an empty
+// budget. The daily counters are those of the current UTC day.
+func (b *BudgetLedger) GetBudget(payerID string) model.PayerBudget {
+	payerID = CanonicalPayerID(payerID)
+	budget, found := b.DB.GetBudget(payerID)
+	if !found {
+		budget.PayerID = payerID
+	}
+	return startDay(budget, b.Clock.Now())
+}
+
+// GetEntries returns the fundings, issuances and refunds of the payer's budget, oldest first
+func (b *BudgetLedger) GetEntries(payerID string) []model.BudgetEntry {
+	return b.DB.GetBudgetEntries(CanonicalPayerID(payerID))
+}
+
+// Fund adds prepaid points to the payer's budget and returns the updated budget
+func (b *BudgetLedger) Fund(payerID string, points int) (model.PayerBudget, error) {
+	if points <= 0 {
+		return model.PayerBudget{}, errPointsNotPositive
+	}
+	payerID = CanonicalPayerID(payerID)
+	if payerID == "" {
+		return model.PayerBudget{}, errPayerRequired
+	}
+
+	var updated model.PayerBudget
+	err := b.DB.UpdateBudget(payerID, func(budget model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+		now := b.Clock.Now()
+		budget = startDay(budget, now)
+		if _, ok := budget.Requests[b.requestID]; ok && b.requestID != "" {
+			// The request was already applied, so return the budget as it now stands
+			updated = budget
+			return budget, nil, nil
+		}
+		budget.Funded += points
+		budget.Remaining = budget.Funded - budget.Issued
+		updated = budget
+		return budget, &model.BudgetEntry{
+			ID:        newID(),
+			Type:      model.BudgetFunding,
+			PayerID:   payerID,
+			Points:    points,
+			CreatedAt: now,
+			RequestID: b.requestID,
+		}, nil
+	})
+	if err != nil {
+		return model.PayerBudget{}, err
+	}
+	// Requests is only there for the unit of work
+	updated.Requests = nil
+	return updated, nil
+}
+
+// SetCaps changes the issuance caps of the payer's budget and returns the updated budget
+func (b *BudgetLedger) SetCaps(payerID string, caps BudgetCaps) (model.PayerBudget, error) {
+	if (caps.DailyCap != nil && *caps.DailyCap < 0) || (caps.UserDailyCap != nil && *caps.UserDailyCap < 0) {
+		return model.PayerBudget{}, newError(ErrInvalidAmount, "invalid_amount", "caps must not be negative")
+	}
+	payerID = CanonicalPayerID(payerID)
+	if payerID == "" {
+		return model.PayerBudget{}, errPayerRequired
+	}
+
+	var updated model.PayerBudget
+	err := b.DB.UpdateBudget(payerID, func(budget model.PayerBudget) (model.PayerBudget, *model.BudgetEntry, error) {
+		budget = startDay(budget, b.Clock.Now())
+		if caps.DailyCap != nil {
+			budget.DailyCap = *caps.DailyCap
+		}
+		if caps.UserDailyCap != nil {
+			budget.UserDailyCap = *caps.UserDailyCap
+		}
+		budget.Remaining = budget.Funded - budget.Issued
+		updated = budget
+		return budget, nil, nil
+	})
+	if err != nil {
+		return model.PayerBudget{}, err
+	}
+	// Requests is only there for the unit of work
+	updated.Requests = nil
+	return updated, nil
+}
+
+// issue draws the points of the transaction being added for the user from budget, the budget
+// of its payer, and returns the budget to store along with the entry recording the issuance.
+// Returns ErrBudgetExceeded, ErrDailyCapExceeded or ErrUserDailyCapExceeded, wrapped with the
+// points still available, if the payer cannot issue them.
+func (b *BudgetLedger) issue(budget model.PayerBudget, userID string, transaction model.Transaction) (model.PayerBudget, *model.BudgetEntry, error) {
+	points := transaction.Points
+	now := b.Clock.Now()
+	budget = startDay(budget, now)
+	switch {
+	case budget.Funded-budget.Issued < points:
+		return budget, nil, fmt.Errorf("%w: %s has %d points left", ErrBudgetExceeded, budget.PayerID, budget.Funded-budget.Issued)
+	case budget.DailyCap > 0 && budget.IssuedOnDay+points > budget.DailyCap:
+		return budget, nil, fmt.Errorf("%w: %s can issue %d more points today", ErrDailyCapExceeded, budget.PayerID, budget.DailyCap-budget.IssuedOnDay)
+	case budget.UserDailyCap > 0 && budget.IssuedOnDayByUser[userID]+points > budget.UserDailyCap:
+		return budget, nil, fmt.Errorf("%w: %s can issue %d more points to this user today", ErrUserDailyCapExceeded, budget.PayerID, budget.UserDailyCap-budget.IssuedOnDayByUser[userID])
+	}
+
+	budget.Issued += points
+	budget.Remaining = budget.Funded - budget.Issued
+	budget.IssuedOnDay += points
+	if budget.IssuedOnDayByUser == nil {
+		budget.IssuedOnDayByUser = make(map[string]int)
+	}
+	budget.IssuedOnDayByUser[userID] += points
+	return budget, &model.BudgetEntry{
+		ID:            newID(),
+		Type:          model.BudgetIssuance,
+		PayerID:       budget.PayerID,
+		UserID:        userID,
+		TransactionID: transaction.ID,
+		Points:        -points,
+		CreatedAt:     now,
+	}, nil
+}
+
+// startDay resets the daily counters of the budget if they belong to a day before now's
+func startDay(budget model.PayerBudget, now time.Time) model.PayerBudget {
+	day := now.UTC().Format(budgetDay)
+	if budget.Day != day {
+		budget.Day = day
+		budget.IssuedOnDay = 0
+		budget.IssuedOnDayByUser = nil
+	}
+	return budget
+}
@@ -0,0 +1,112 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestBudgetLedger(t *testing.T) {
+	clock := test.NewClock(test.ParseTime("2020-11-02T14:00:00Z"))
+	budgets := services.NewBudgetLedger(db.NewInMemoryDB())
+	budgets.Clock = clock
+
+	assert.Equal(t, model.PayerBudget{PayerID: "DANNON", Day: "2020-11-02"}, budgets.GetBudget("Dannon"))
+
+	_, err := budgets.Fund("DANNON", 0)
+	assert.Error(t, err)
+	budget, err := budgets.Fund("Dannon", 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, budget.Funded)
+	assert.Equal(t, 1000, budget.Remaining)
+
+	negative := -1
+	_, err = budgets.SetCaps("DANNON", services.BudgetCaps{DailyCap: &negative})
+	assert.Error(t, err)
+	dailyCap := 500
+	budget, err = budgets.SetCaps("DANNON", services.BudgetCaps{DailyCap: &dailyCap})
+	assert.NoError(t, err)
+	assert.Equal(t, 500, budget.DailyCap)
+	assert.Equal(t, 0, budget.UserDailyCap)
+
+	entries := budgets.GetEntries("DANNON")
+	assert.Len(t, entries, 1)
+	assert.Equal(t, model.BudgetFunding, entries[0].Type)
+	assert.Equal(t, 1000, entries[0].Points)
+}
+
+func TestAddPoints_budgets(t *testing.T) {
+	clock := test.NewClock(test.ParseTime("2020-11-02T14:00:00Z"))
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Clock = clock
+	service.Budgets = services.NewBudgetLedger(database)
+	service.Budgets.Clock = clock
+
+	earn := func(userID string, points int) error {
+		return service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: points, Timestamp: clock.Now()})
+	}
+
+	err := earn("1", 100)
+	assert.True(t, errors.Is(err, services.ErrBudgetExceeded))
+	assert.Empty(t, database.GetTransactions("1"))
+
+	_, err = service.Budgets.Fund("DANNON", 1000)
+	assert.NoError(t, err)
+	dailyCap, userDailyCap := 600, 400
+	_, err = service.Budgets.SetCaps("DANNON", services.BudgetCaps{DailyCap: &dailyCap, UserDailyCap: &userDailyCap})
+	assert.NoError(t, err)
+
+	assert.NoError(t, earn("1", 300))
+	err = earn("1", 200)
+	assert.True(t, errors.Is(err, services.ErrUserDailyCapExceeded))
+	assert.NoError(t, earn("2", 300))
+	err = earn("3", 1)
+	assert.True(t, errors.Is(err, services.ErrDailyCapExceeded))
+
+	// Adjustments do not touch the budget
+	assert.NoError(t, earn("1", -100))
+
+	budget := service.Budgets.GetBudget("DANNON")
+	assert.Equal(t, 600, budget.Issued)
+	assert.Equal(t, 400, budget.Remaining)
+	assert.Equal(t, map[string]int{"1": 300, "2": 300}, budget.IssuedOnDayByUser)
+
+	// The caps reset the next day, but the budget does not
+	clock.Set(test.ParseTime("2020-11-03T00:00:00Z"))
+	assert.Equal(t, 0, service.Budgets.GetBudget("DANNON").IssuedOnDay)
+	assert.NoError(t, earn("1", 400))
+	err = earn("2", 1)
+	assert.True(t, errors.Is(err, services.ErrBudgetExceeded))
+
+	entries := service.Budgets.GetEntries("DANNON")
+	assert.Len(t, entries, 4)
+	transactions := database.GetTransactions("1")
+	assert.Equal(t, model.BudgetIssuance, entries[1].Type)
+	assert.Equal(t, "1", entries[1].UserID)
+	assert.Equal(t, transactions[0].ID, entries[1].TransactionID)
+	assert.Equal(t, -300, entries[1].Points)
+}
+
+func TestAddPoints_budgets_canonical_payer(t *testing.T) {
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Budgets = services.NewBudgetLedger(database)
+
+	_, err := service.Budgets.Fund("DANNON", 100)
+	assert.NoError(t, err)
+
+	// Without a payer registry the transaction keeps its payer name, but draws from the budget
+	// of the canonical payer
+	assert.NoError(t, service.AddPoints("1", model.Transaction{Payer: "Dannon", Points: 60, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}))
+	assert.Equal(t, 40, service.Budgets.GetBudget("DANNON").Remaining)
+	err = service.AddPoints("1", model.Transaction{Payer: "dannon ", Points: 50, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+	assert.True(t, errors.Is(err, services.ErrBudgetExceeded))
+	assert.Len(t, database.GetTransactions("1"), 1)
+}
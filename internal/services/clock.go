@@ -0,0 +1,16 @@
+package services
+
+import "time"
+
+// Clock tells the PointService what time it is. Tests substitute their own implementation to
+// move time forward.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock backed by the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of error returned by the services. Every *Error wraps one of them, so callers can
+// check the kind with errors.Is without knowing every specific error.
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInvalidAmount     = errors.New("invalid amount")
+	ErrInvalidRequest    = errors.New("invalid request")
+	ErrUnknownPayer      = errors.New("unknown payer")
+	ErrConflict          = errors.New("conflict")
+	ErrNotFound          = errors.New("not found")
+	ErrLimitExceeded     = errors.New("limit exceeded")
+)
+
+// Error is an error with a stable, machine-readable Code, such as "insufficient_points", that
+// clients can branch on instead of matching the Message. Kind is one of the ErrXxx kinds above.
+type Error struct {
+	Kind    error
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the Kind of the error
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// newError returns a new *Error of the given kind
+func newError(kind error, code, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errPointsNotPositive is returned when an amount of points that must be positive is not
+var errPointsNotPositive = newError(ErrInvalidAmount, "invalid_amount", "points must be a positive integer")
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// ExpirationPolicy decides when the points a payer issues expire
+type ExpirationPolicy interface {
+	// ExpiresAt returns the first instant at which points earned at the given time are expired
+	ExpiresAt(earned time.Time) time.Time
+}
+
+// ExpireAfterMonths expires points the given number of calendar months after they were earned
+type ExpireAfterMonths struct {
+	Months int
+}
+
+// ExpiresAt implements ExpirationPolicy
+func (p ExpireAfterMonths) ExpiresAt(earned time.Time) time.Time {
+	return earned.AddDate(0, p.Months, 0)
+}
+
+// ExpireEndOfQuarter expires points at the end of a calendar quarter, in UTC. QuartersAfter is
+// the number of quarters after the one the points were earned in, so 0 expires them at the end
+// of the same quarter and 1 at the end of the following quarter.
+type ExpireEndOfQuarter struct {
+	QuartersAfter int
+}
+
+// ExpiresAt implements ExpirationPolicy
+func (p ExpireEndOfQuarter) ExpiresAt(earned time.Time) time.Time {
+	earned = earned.UTC()
+	quarterStart := time.Month((int(earned.Month())-1)/3*3 + 1)
+	start := time.Date(earned.Year(), quarterStart, 1, 0, 0, 0, 0, time.UTC)
+	return start.AddDate(0, 3*(p.QuartersAfter+1), 0)
+}
+
+// ExpirePoints writes an expiration transaction for every lot of the user whose points have
+// expired with some remaining, and returns the new transactions. Each expiration transaction
+// is dated when its lot expired and is allocated against that lot.
+func (s *PointService) ExpirePoints(userID string) ([]model.Transaction, error) {
+	now := s.Clock.Now()
+
+	var newTransactions []model.Transaction
+	err := s.DB.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		records := model.Ledger{}
+		for _, lot := range s.openLots(ledger, now) {
+			if lot.Remaining <= 0 || !lot.ExpiredAt(now) {
+				continue
+			}
+
+			tran := model.Transaction{
+				ID:        newID(),
+				Type:      model.TransactionExpiration,
+				Payer:     lot.Payer,
+				Points:    -lot.Remaining,
+				Timestamp: *lot.ExpiresAt,
+				CreatedAt: now,
+			}
+			records.Transactions = append(records.Transactions, tran)
+			records.Allocations = append(records.Allocations, model.Allocation{
+				TransactionID: tran.ID,
+				LotID:         lot.ID,
+				Payer:         lot.Payer,
+				Points:        lot.Remaining,
+			})
+		}
+		newTransactions = records.Transactions
+		return records, nil
+	})
+	if err != nil {
+		return []model.Transaction{}, err
+	}
+	return newTransactions, nil
+}
+
+// ExpireAllPoints runs ExpirePoints for every user and returns the number of expiration
+// transactions written. It keeps going when a user fails and returns the last error.
+func (s *PointService) ExpireAllPoints() (int, error) {
+	if len(s.ExpirationPolicies) == 0 {
+		return 0, nil
+	}
+
+	var lastErr error
+	expired := 0
+	for _, userID := range s.DB.GetUserIDs() {
+		transactions, err := s.ExpirePoints(userID)
+		if err != nil {
+			log.Printf("Unable to expire points for user %s: %v", userID, err)
+			lastErr = err
+			continue
+		}
+		expired += len(transactions)
+	}
+	return expired, lastErr
+}
+
+// StartExpirationSweeper calls ExpireAllPoints every interval in the background until the
+// returned function is called. Stopping waits for a sweep in progress to finish.
+func (s *PointService) StartExpirationSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				if expired, _ := s.ExpireAllPoints(); expired > 0 {
+					log.Printf("Expired %d lots", expired)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// expiresAt returns when points earned from the payer at the given time expire, or nil if the
+// payer has no expiration policy
+func (s *PointService) expiresAt(payer string, earned time.Time) *time.Time {
+	policy, ok := s.ExpirationPolicies[payer]
+	if !ok {
+		return nil
+	}
+	expiresAt := policy.ExpiresAt(earned)
+	return &expiresAt
+}
+
+// expiredPoints returns, per payer, the points remaining in lots that have expired at the
+// given time but have not been swept yet
+func expiredPoints(lots []model.Lot, now time.Time) map[string]int {
+	result := make(map[string]int)
+	for _, lot := range lots {
+		if lot.Remaining > 0 && lot.ExpiredAt(now) {
+			result[lot.Payer] += lot.Remaining
+		}
+	}
+	return result
+}
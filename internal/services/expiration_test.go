@@ -0,0 +1,170 @@
+package services_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestExpirationPolicies(t *testing.T) {
+	tests := map[string]struct {
+		policy   services.ExpirationPolicy
+		earned   string
+		expected string
+	}{
+		"12 months after earning": {
+			policy:   services.ExpireAfterMonths{Months: 12},
+			earned:   "2020-11-02T14:00:00Z",
+			expected: "2021-11-02T14:00:00Z",
+		},
+		"End of the same quarter": {
+			policy:   services.ExpireEndOfQuarter{},
+			earned:   "2020-11-02T14:00:00Z",
+			expected: "2021-01-01T00:00:00Z",
+		},
+		"End of the following quarter": {
+			policy:   services.ExpireEndOfQuarter{QuartersAfter: 1},
+			earned:   "2020-02-29T23:59:59Z",
+			expected: "2020-07-01T00:00:00Z",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual := tc.policy.ExpiresAt(test.ParseTime(tc.earned))
+			assert.Equal(t, test.ParseTime(tc.expected), actual)
+		})
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	userID := "1"
+	clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Clock = clock
+	service.ExpirationPolicies["DANNON"] = services.ExpireEndOfQuarter{}
+
+	// DANNON lots: 300 from 2020-10-31 drained to 100 by the adjustment, and 1000 from
+	// 2020-11-02. Both expire on 2021-01-01.
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+	assert.Equal(t, 1100, pointsFor(service.GetAccounts(userID), "DANNON"))
+
+	clock.Set(test.ParseTime("2021-01-01T00:00:00Z"))
+
+	t.Run("balances exclude expired points before they are swept", func(t *testing.T) {
+		accounts := service.GetAccounts(userID)
+		assert.Equal(t, 0, pointsFor(accounts, "DANNON"))
+		assert.Equal(t, 10000, pointsFor(accounts, "MILLER COORS"))
+		assert.Equal(t, 200, pointsFor(accounts, "UNILEVER"))
+	})
+
+	t.Run("spends never draw from expired lots", func(t *testing.T) {
+		_, err := service.SpendPoints(userID, 10201, nil)
+		assert.Error(t, err)
+
+		transactions, err := service.SpendPoints(userID, 300, nil)
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 2)
+		assert.Equal(t, "UNILEVER", transactions[0].Payer)
+		assert.Equal(t, -200, transactions[0].Points)
+		assert.Equal(t, "MILLER COORS", transactions[1].Payer)
+		assert.Equal(t, -100, transactions[1].Points)
+	})
+
+	t.Run("adjustments cannot remove expired points", func(t *testing.T) {
+		err := service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: -1, Timestamp: clock.Now()})
+		assert.Error(t, err)
+	})
+
+	t.Run("sweeper writes expiration transactions", func(t *testing.T) {
+		expired, err := service.ExpireAllPoints()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, expired)
+
+		// The ledger now agrees with the balances and sweeping again is a no-op
+		for _, account := range database.GetAccounts(userID) {
+			assert.Equal(t, pointsFor(service.GetAccounts(userID), account.Payer), account.Points)
+		}
+		transactions, err := service.ExpirePoints(userID)
+		assert.NoError(t, err)
+		assert.Empty(t, transactions)
+
+		expirations := database.GetTransactions(userID)
+		assert.Equal(t, test.ParseTime("2021-01-01T00:00:00Z"), expirations[len(expirations)-1].Timestamp)
+	})
+}
+
+func pointsFor(accounts []model.Account, payer string) int {
+	for _, account := range accounts {
+		if account.Payer == payer {
+			return account.Points
+		}
+	}
+	return 0
+}
+
+func TestGetAccountsAsOf(t *testing.T) {
+	userID := "1"
+	clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+	service := services.NewPointService(db.NewInMemoryDB())
+	service.Clock = clock
+	service.ExpirationPolicies["DANNON"] = services.ExpireEndOfQuarter{}
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+	_, err := service.SpendPoints(userID, 5000, nil)
+	assert.NoError(t, err)
+	clock.Set(test.ParseTime("2021-02-01T00:00:00Z"))
+
+	tests := map[string]struct {
+		asOf     string
+		expected []model.Account
+	}{
+		"before any transaction": {
+			asOf:     "2020-10-01T00:00:00Z",
+			expected: []model.Account{},
+		},
+		"after the adjustment": {
+			asOf:     "2020-11-01T00:00:00Z",
+			expected: []model.Account{{Payer: "DANNON", Points: 100}, {Payer: "UNILEVER", Points: 200}},
+		},
+		"before the spend": {
+			asOf: "2020-11-02T14:00:00Z",
+			expected: []model.Account{
+				{Payer: "DANNON", Points: 1100},
+				{Payer: "MILLER COORS", Points: 10000},
+				{Payer: "UNILEVER", Points: 200},
+			},
+		},
+		"after the DANNON points expired": {
+			asOf: "2021-01-15T00:00:00Z",
+			expected: []model.Account{
+				{Payer: "DANNON", Points: 0},
+				{Payer: "MILLER COORS", Points: 5300},
+				{Payer: "UNILEVER", Points: 0},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			asOf := test.ParseTime(tc.asOf)
+			assert.Equal(t, tc.expected, service.GetAccountsAsOf(userID, asOf))
+
+			balance := service.GetBalanceAsOf(userID, asOf)
+			assert.Equal(t, totalPoints(tc.expected), balance.Points)
+			assert.Equal(t, asOf, *balance.AsOf)
+		})
+	}
+
+	assert.Equal(t, 5300, service.GetBalance(userID).Points)
+	assert.Nil(t, service.GetBalance(userID).AsOf)
+}
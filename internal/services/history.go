@@ -0,0 +1,163 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// Kinds of transaction a TransactionQuery can filter on
+const (
+	// TransactionsEarned are the transactions that add points
+	TransactionsEarned = "earn"
+	// TransactionsSpent are the transactions that take points away
+	TransactionsSpent = "spend"
+)
+
+// Page sizes used by ListTransactions
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// TransactionQuery selects a page of a user's transaction history. Every filter left at its
+// zero value matches all transactions.
+type TransactionQuery struct {
+	// Payer only matches the transactions of this payer, compared by canonical ID
+	Payer string
+	// Kind only matches TransactionsEarned or TransactionsSpent
+	Kind string
+	// Type only matches transactions of this type
+	Type model.TransactionType
+	// Reference only matches transactions with this external reference
+	Reference string
+	// From only matches transactions at or after this time
+	From time.Time
+	// To only matches transactions before this time
+	To time.Time
+	// Descending lists the newest transactions first instead of the oldest
+	Descending bool
+	// Limit is the maximum number of transactions on the page, DefaultPageSize if 0
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// historyCursor is the position after which the next page starts, encoded in
+// model.TransactionPage.NextCursor
+type historyCursor struct {
+	Timestamp  time.Time `json:"t"`
+	ID         string    `json:"id"`
+	Descending bool      `json:"desc,omitempty"`
+}
+
+// ListTransactions returns a page of the user's transactions matching the query, ordered by
+// timestamp. Transactions with the same timestamp are ordered by ID. IDs are assigned while the
+// user's ledger is locked for the write and increase monotonically, so that is the order they
+// were written in. Pages are keyed on the last transaction returned rather than an offset, so
+// transactions written between requests do not shift later pages.
+func (s *PointService) ListTransactions(userID string, query TransactionQuery) (model.TransactionPage, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return model.TransactionPage{}, newError(ErrInvalidRequest, "invalid_limit", "limit must be between 1 and %d", MaxPageSize)
+	}
+	if query.Kind != "" && query.Kind != TransactionsEarned && query.Kind != TransactionsSpent {
+		return model.TransactionPage{}, newError(ErrInvalidRequest, "invalid_kind", "unknown transaction kind %q", query.Kind)
+	}
+
+	query.Payer = CanonicalPayerID(query.Payer)
+
+	var after *historyCursor
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return model.TransactionPage{}, err
+		}
+		if cursor.Descending != query.Descending {
+			return model.TransactionPage{}, newError(ErrInvalidRequest, "invalid_cursor", "cursor was issued for the opposite order")
+		}
+		after = &cursor
+	}
+
+	matches := make([]model.Transaction, 0)
+	for _, tran := range s.DB.GetTransactions(userID) {
+		if query.matches(tran) {
+			matches = append(matches, tran)
+		}
+	}
+	before := func(a, b model.Transaction) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp) != query.Descending
+		}
+		if a.ID == b.ID {
+			return false
+		}
+		return (a.ID < b.ID) != query.Descending
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return before(matches[i], matches[j])
+	})
+
+	start := 0
+	if after != nil {
+		last := model.Transaction{Timestamp: after.Timestamp, ID: after.ID}
+		start = sort.Search(len(matches), func(i int) bool {
+			return before(last, matches[i])
+		})
+	}
+	end := start + limit
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	page := model.TransactionPage{Transactions: matches[start:end]}
+	if end < len(matches) {
+		last := matches[end-1]
+		page.NextCursor = encodeCursor(historyCursor{Timestamp: last.Timestamp, ID: last.ID, Descending: query.Descending})
+	}
+	return page, nil
+}
+
+// matches reports whether the transaction passes the query's filters
+func (q TransactionQuery) matches(tran model.Transaction) bool {
+	switch {
+	case q.Payer != "" && tran.Payer != q.Payer:
+		return false
+	case q.Type != "" && tran.Type != q.Type:
+		return false
+	case q.Reference != "" && tran.Reference != q.Reference:
+		return false
+	case q.Kind == TransactionsEarned && tran.Points <= 0:
+		return false
+	case q.Kind == TransactionsSpent && tran.Points >= 0:
+		return false
+	case !q.From.IsZero() && tran.Timestamp.Before(q.From):
+		return false
+	case !q.To.IsZero() && !tran.Timestamp.Before(q.To):
+		return false
+	}
+	return true
+}
+
+func encodeCursor(cursor historyCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (historyCursor, error) {
+	cursor := historyCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return historyCursor{}, newError(ErrInvalidRequest, "invalid_cursor", "invalid cursor")
+	}
+	return cursor, nil
+}
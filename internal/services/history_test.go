@@ -0,0 +1,187 @@
+package services_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestListTransactions(t *testing.T) {
+	userID := "1"
+	service := services.NewPointService(db.NewInMemoryDB())
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+
+	tests := map[string]struct {
+		query    services.TransactionQuery
+		expected []int
+	}{
+		"all, oldest first": {
+			query:    services.TransactionQuery{},
+			expected: []int{300, 200, -200, 10000, 1000},
+		},
+		"newest first": {
+			query:    services.TransactionQuery{Descending: true},
+			expected: []int{1000, 10000, -200, 200, 300},
+		},
+		"by payer": {
+			query:    services.TransactionQuery{Payer: "DANNON"},
+			expected: []int{300, -200, 1000},
+		},
+		"by payer name": {
+			query:    services.TransactionQuery{Payer: " Dannon"},
+			expected: []int{300, -200, 1000},
+		},
+		"earned": {
+			query:    services.TransactionQuery{Kind: services.TransactionsEarned},
+			expected: []int{300, 200, 10000, 1000},
+		},
+		"spent": {
+			query:    services.TransactionQuery{Kind: services.TransactionsSpent},
+			expected: []int{-200},
+		},
+		"time range": {
+			query: services.TransactionQuery{
+				From: test.ParseTime("2020-10-31T11:00:00Z"),
+				To:   test.ParseTime("2020-11-02T14:00:00Z"),
+			},
+			expected: []int{200, -200, 10000},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			page, err := service.ListTransactions(userID, tc.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, pointsOf(page.Transactions))
+			assert.Empty(t, page.NextCursor)
+		})
+	}
+}
+
+func TestListTransactions_pagination(t *testing.T) {
+	userID := "1"
+	start := test.ParseTime("2020-11-02T14:00:00Z")
+
+	for _, descending := range []bool{false, true} {
+		t.Run(fmt.Sprintf("descending %v", descending), func(t *testing.T) {
+			service := services.NewPointService(db.NewInMemoryDB())
+			for i := 0; i < 25; i++ {
+				// Pairs of transactions share a timestamp so ties have to be broken by ID
+				tran := model.Transaction{Payer: "DANNON", Points: i + 1, Timestamp: start.Add(time.Duration(i/2) * time.Hour)}
+				assert.NoError(t, service.AddPoints(userID, tran))
+			}
+
+			query := services.TransactionQuery{Descending: descending, Limit: 10}
+			seen := make([]int, 0)
+			pages := 0
+			for {
+				page, err := service.ListTransactions(userID, query)
+				assert.NoError(t, err)
+				seen = append(seen, pointsOf(page.Transactions)...)
+				pages++
+				if page.NextCursor == "" {
+					break
+				}
+				query.Cursor = page.NextCursor
+
+				// A backdated transaction written between pages does not shift later pages
+				if pages == 1 {
+					tran := model.Transaction{Payer: "DANNON", Points: 1000, Timestamp: start.Add(-time.Hour)}
+					if descending {
+						tran.Timestamp = start.Add(100 * time.Hour)
+					}
+					assert.NoError(t, service.AddPoints(userID, tran))
+				}
+			}
+			assert.Equal(t, 3, pages)
+			assert.Len(t, seen, 25)
+			for i, points := range seen {
+				if descending {
+					assert.Equal(t, 25-i, points)
+				} else {
+					assert.Equal(t, i+1, points)
+				}
+			}
+		})
+	}
+}
+
+func TestListTransactions_pages_in_write_order(t *testing.T) {
+	userID := "1"
+	database := &delayedDB{InMemoryDB: db.NewInMemoryDB(), delayed: make(chan struct{}), release: make(chan struct{})}
+	service := services.NewPointService(database)
+	timestamp := test.ParseTime("2020-11-02T14:00:00Z")
+
+	// The first add is held back until the second has been written
+	done := make(chan error)
+	go func() {
+		done <- service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: 10, Timestamp: timestamp})
+	}()
+	<-database.delayed
+	assert.NoError(t, service.AddPoints(userID, model.Transaction{Payer: "UNILEVER", Points: 20, Timestamp: timestamp}))
+	close(database.release)
+	assert.NoError(t, <-done)
+
+	// Transactions with the same timestamp are stored in the order they were written
+	written := database.GetTransactions(userID)
+	assert.Equal(t, "UNILEVER", written[0].Payer)
+	listed := make([]model.Transaction, 0, len(written))
+	query := services.TransactionQuery{Limit: 1}
+	for {
+		page, err := service.ListTransactions(userID, query)
+		assert.NoError(t, err)
+		listed = append(listed, page.Transactions...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	assert.Equal(t, written, listed)
+}
+
+// delayedDB holds the first ledger update back until release is closed
+type delayedDB struct {
+	*db.InMemoryDB
+	once    sync.Once
+	delayed chan struct{}
+	release chan struct{}
+}
+
+func (d *delayedDB) UpdateLedger(userID string, fn func(model.Ledger) (model.Ledger, error)) error {
+	first := false
+	d.once.Do(func() { first = true })
+	if first {
+		close(d.delayed)
+		<-d.release
+	}
+	return d.InMemoryDB.UpdateLedger(userID, fn)
+}
+
+func TestListTransactions_errors(t *testing.T) {
+	service := services.NewPointService(db.NewInMemoryDB())
+
+	_, err := service.ListTransactions("1", services.TransactionQuery{Limit: services.MaxPageSize + 1})
+	assert.Error(t, err)
+	_, err = service.ListTransactions("1", services.TransactionQuery{Kind: "refund"})
+	assert.Error(t, err)
+	_, err = service.ListTransactions("1", services.TransactionQuery{Cursor: "not a cursor"})
+	assert.Error(t, err)
+}
+
+func pointsOf(transactions []model.Transaction) []int {
+	points := make([]int, 0, len(transactions))
+	for _, tran := range transactions {
+		points = append(points, tran.Points)
+	}
+	return points
+}
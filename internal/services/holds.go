@@ -0,0 +1,207 @@
+package services
+
+import (
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// DefaultHoldDuration is how long holds last before they expire unless PointService.HoldDuration
+// says otherwise
+const DefaultHoldDuration = 7 * 24 * time.Hour
+
+// ErrHoldNotFound is returned when capturing or voiding a hold the user does not have
+var ErrHoldNotFound = newError(ErrNotFound, "hold_not_found", "hold not found")
+
+// AuthorizeHold earmarks points from the user's unexpired lots, chosen by the given
+// SpendStrategy or the DefaultStrategy if it is nil, so they can be spent later by CaptureHold.
+// Held points are left out of the balances returned by GetAccounts and cannot be spent or
+// held by anything else. The hold expires after HoldDuration unless it is captured or voided
+// first, or sooner if one of the lots it earmarks expires sooner, so expired points are never
+// captured. Returns an error if there are not enough points.
+func (s *PointService) AuthorizeHold(userID string, points int, strategy SpendStrategy) (model.Hold, error) {
+	if points <= 0 {
+		return model.Hold{}, errPointsNotPositive
+	}
+	if strategy == nil {
+		strategy = s.DefaultStrategy
+	}
+
+	var hold model.Hold
+	err := s.DB.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		if written, ok := s.written(ledger); ok {
+			hold = written.Holds[len(written.Holds)-1]
+			return model.Ledger{}, nil
+		}
+		now := s.Clock.Now()
+		allocations, lots, err := s.allocate(ledger, points, strategy, now)
+		if err != nil {
+			return model.Ledger{}, err
+		}
+
+		hold = model.Hold{
+			ID:          newID(),
+			Points:      points,
+			Status:      model.HoldAuthorized,
+			Allocations: allocations,
+			CreatedAt:   now,
+			ExpiresAt:   holdExpiry(lots, allocations, now.Add(s.HoldDuration)),
+			RequestID:   s.requestID,
+		}
+		return model.Ledger{Holds: []model.Hold{hold}}, nil
+	})
+	if err != nil {
+		return model.Hold{}, err
+	}
+	return hold, nil
+}
+
+// CaptureHold spends the points earmarked by an authorized hold. It writes the same per-payer
+// transactions SpendPoints does, drawing from exactly the lots the hold earmarked, and returns
+// them. Returns an error if the hold has been captured, voided or has expired.
+func (s *PointService) CaptureHold(userID, holdID string) ([]model.Transaction, error) {
+	var newTransactions []model.Transaction
+	captured := true
+	err := s.DB.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		if written, ok := s.written(ledger); ok {
+			newTransactions, captured = written.Transactions, false
+			return model.Ledger{}, nil
+		}
+		now := s.Clock.Now()
+		hold, err := authorizedHold(ledger, holdID, now)
+		if err != nil {
+			return model.Ledger{}, err
+		}
+
+		allocations := make([]model.Allocation, len(hold.Allocations))
+		copy(allocations, hold.Allocations)
+		hold.Status = model.HoldCaptured
+		hold.SpendID = newID()
+		hold.RequestID = s.requestID
+		newTransactions = transactionsForAllocations(allocations, model.Transaction{
+			Type:      model.TransactionSpend,
+			Timestamp: now,
+			CreatedAt: now,
+			SpendID:   hold.SpendID,
+			RequestID: s.requestID,
+		})
+		return model.Ledger{
+			Transactions: newTransactions,
+			Allocations:  allocations,
+			Holds:        []model.Hold{hold},
+		}, nil
+	})
+	if err != nil {
+		return []model.Transaction{}, err
+	}
+	if captured {
+		s.recordSpent(newTransactions)
+	}
+	return newTransactions, nil
+}
+
+// VoidHold releases the points earmarked by an authorized hold without spending them and
+// returns the voided hold. Returns an error if the hold has been captured, voided or has
+// expired.
+func (s *PointService) VoidHold(userID, holdID string) (model.Hold, error) {
+	var hold model.Hold
+	err := s.DB.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		if written, ok := s.written(ledger); ok {
+			hold = written.Holds[len(written.Holds)-1]
+			return model.Ledger{}, nil
+		}
+		var err error
+		hold, err = authorizedHold(ledger, holdID, s.Clock.Now())
+		if err != nil {
+			return model.Ledger{}, err
+		}
+		hold.Status = model.HoldVoided
+		hold.RequestID = s.requestID
+		return model.Ledger{Holds: []model.Hold{hold}}, nil
+	})
+	if err != nil {
+		return model.Hold{}, err
+	}
+	return hold, nil
+}
+
+// GetHold returns the current state of the hold with the given ID. The bool is false if the
+// user has no such hold.
+func (s *PointService) GetHold(userID, holdID string) (model.Hold, bool) {
+	hold, ok := currentHolds(s.DB.GetLedger(userID))[holdID]
+	if !ok {
+		return model.Hold{}, false
+	}
+	hold.Status = hold.StatusAt(s.Clock.Now())
+	return hold, true
+}
+
+// holdExpiry returns when a hold on the given allocations expires: at expiresAt, or when the
+// first of the lots it earmarks expires if that is sooner
+func holdExpiry(lots []model.Lot, allocations []model.Allocation, expiresAt time.Time) time.Time {
+	held := make(map[string]bool, len(allocations))
+	for _, allocation := range allocations {
+		held[allocation.LotID] = true
+	}
+	for _, lot := range lots {
+		if held[lot.ID] && lot.ExpiresAt != nil && lot.ExpiresAt.Before(expiresAt) {
+			expiresAt = *lot.ExpiresAt
+		}
+	}
+	return expiresAt
+}
+
+// authorizedHold returns the current state of the hold with the given ID, or an error if
+// there is no such hold or it is not authorized at the given time. Only the open holds are
+// searched unless the hold is not among them.
+func authorizedHold(ledger model.Ledger, holdID string, now time.Time) (model.Hold, error) {
+	hold, ok := model.Hold{}, false
+	for _, open := range ledger.OpenHolds {
+		if open.ID == holdID {
+			hold, ok = open, true
+		}
+	}
+	if !ok {
+		hold, ok = currentHolds(ledger)[holdID]
+	}
+	if !ok {
+		return model.Hold{}, ErrHoldNotFound
+	}
+	if status := hold.StatusAt(now); status != model.HoldAuthorized {
+		return model.Hold{}, newError(ErrConflict, "hold_not_authorized", "the hold is %s", status)
+	}
+	return hold, nil
+}
+
+// currentHolds returns the latest record of each hold in the ledger, keyed by hold ID
+func currentHolds(ledger model.Ledger) map[string]model.Hold {
+	holds := make(map[string]model.Hold)
+	for _, hold := range ledger.Holds {
+		holds[hold.ID] = hold
+	}
+	return holds
+}
+
+// authorizedHolds returns the holds in the ledger's projection that are authorized at the
+// given time
+func authorizedHolds(ledger model.Ledger, now time.Time) []model.Hold {
+	result := make([]model.Hold, 0)
+	for _, hold := range ledger.OpenHolds {
+		if hold.StatusAt(now) == model.HoldAuthorized {
+			result = append(result, hold)
+		}
+	}
+	return result
+}
+
+// heldPoints returns, per payer, the points earmarked by holds that are authorized at the
+// given time
+func heldPoints(ledger model.Ledger, now time.Time) map[string]int {
+	result := make(map[string]int)
+	for _, hold := range authorizedHolds(ledger, now) {
+		for _, allocation := range hold.Allocations {
+			result[allocation.Payer] += allocation.Points
+		}
+	}
+	return result
+}
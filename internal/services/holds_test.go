@@ -0,0 +1,153 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestHolds(t *testing.T) {
+	userID := "1"
+	setup := func(t *testing.T) (*services.PointService, *test.Clock) {
+		clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+		service := services.NewPointService(db.NewInMemoryDB())
+		service.Clock = clock
+		for _, tran := range test.Data {
+			assert.NoError(t, service.AddPoints(userID, tran))
+		}
+		return service, clock
+	}
+
+	t.Run("held points are not available", func(t *testing.T) {
+		service, _ := setup(t)
+
+		hold, err := service.AuthorizeHold(userID, 5000, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, model.HoldAuthorized, hold.Status)
+		assert.Equal(t, 6300, totalPoints(service.GetAccounts(userID)))
+		assert.Equal(t, 5300, pointsFor(service.GetAccounts(userID), "MILLER COORS"))
+
+		_, err = service.SpendPoints(userID, 6301, nil)
+		assert.Error(t, err)
+		_, err = service.AuthorizeHold(userID, 6301, nil)
+		assert.Error(t, err)
+		err = service.AddPoints(userID, model.Transaction{Payer: "UNILEVER", Points: -1, Timestamp: test.ParseTime("2020-11-02T00:00:00Z")})
+		assert.Error(t, err)
+
+		// Other spends skip the held lots
+		transactions, err := service.SpendPoints(userID, 1000, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []model.Account{{Payer: "MILLER COORS", Points: -1000}}, transactionAccounts(transactions))
+	})
+
+	t.Run("capture spends the held points", func(t *testing.T) {
+		service, _ := setup(t)
+		expected, err := service.PreviewSpend(userID, 5000, nil)
+		assert.NoError(t, err)
+
+		hold, err := service.AuthorizeHold(userID, 5000, nil)
+		assert.NoError(t, err)
+		transactions, err := service.CaptureHold(userID, hold.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, transactionAccounts(expected.Transactions), transactionAccounts(transactions))
+		assert.Equal(t, expected.Balances, service.GetAccounts(userID))
+
+		captured, found := service.GetHold(userID, hold.ID)
+		assert.True(t, found)
+		assert.Equal(t, model.HoldCaptured, captured.Status)
+		assert.Equal(t, transactions[0].SpendID, captured.SpendID)
+		spend, found := service.GetSpend(userID, captured.SpendID)
+		assert.True(t, found)
+		assert.Equal(t, 5000, spend.Points)
+
+		_, err = service.CaptureHold(userID, hold.ID)
+		assert.Error(t, err)
+		_, err = service.VoidHold(userID, hold.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("void releases the held points", func(t *testing.T) {
+		service, _ := setup(t)
+
+		hold, err := service.AuthorizeHold(userID, 5000, nil)
+		assert.NoError(t, err)
+		voided, err := service.VoidHold(userID, hold.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, model.HoldVoided, voided.Status)
+		assert.Equal(t, 11300, totalPoints(service.GetAccounts(userID)))
+
+		_, err = service.CaptureHold(userID, hold.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("adjustments leave held points alone", func(t *testing.T) {
+		service, _ := setup(t)
+
+		// The hold earmarks the 100 points left in the oldest DANNON lot, so the adjustment has
+		// to come out of the newer one
+		hold, err := service.AuthorizeHold(userID, 100, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: -1000, Timestamp: test.ParseTime("2020-11-03T00:00:00Z")}))
+		assert.Equal(t, 0, pointsFor(service.GetAccounts(userID), "DANNON"))
+
+		_, err = service.SpendPoints(userID, 10201, nil)
+		assert.Error(t, err)
+		_, err = service.SpendPoints(userID, 10200, nil)
+		assert.NoError(t, err)
+		_, err = service.CaptureHold(userID, hold.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, totalPoints(service.GetAccounts(userID)))
+	})
+
+	t.Run("stale holds expire", func(t *testing.T) {
+		service, clock := setup(t)
+		service.HoldDuration = time.Hour
+
+		hold, err := service.AuthorizeHold(userID, 5000, nil)
+		assert.NoError(t, err)
+		clock.Advance(time.Hour)
+
+		expired, found := service.GetHold(userID, hold.ID)
+		assert.True(t, found)
+		assert.Equal(t, model.HoldExpired, expired.Status)
+		assert.Equal(t, 11300, totalPoints(service.GetAccounts(userID)))
+		_, err = service.CaptureHold(userID, hold.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("holds expire with the first lot they earmark", func(t *testing.T) {
+		service, clock := setup(t)
+		service.HoldDuration = 60 * 24 * time.Hour
+		service.ExpirationPolicies["DANNON"] = services.ExpireAfterMonths{Months: 1}
+
+		// The hold draws 100 points from the DANNON lot earned on 2020-10-31
+		hold, err := service.AuthorizeHold(userID, 5000, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.ParseTime("2020-12-01T10:00:00Z"), hold.ExpiresAt)
+
+		clock.Set(hold.ExpiresAt)
+		_, err = service.CaptureHold(userID, hold.ID)
+		assert.Error(t, err)
+		expired, found := service.GetHold(userID, hold.ID)
+		assert.True(t, found)
+		assert.Equal(t, model.HoldExpired, expired.Status)
+		assert.Equal(t, 11200, totalPoints(service.GetAccounts(userID)))
+	})
+
+	t.Run("unknown holds are not found", func(t *testing.T) {
+		service, _ := setup(t)
+
+		_, err := service.CaptureHold(userID, "unknown")
+		assert.Equal(t, services.ErrHoldNotFound, err)
+		_, err = service.VoidHold(userID, "unknown")
+		assert.Equal(t, services.ErrHoldNotFound, err)
+		_, found := service.GetHold(userID, "unknown")
+		assert.False(t, found)
+	})
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet, which sorts in the same order as the values it
+// encodes
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idGenerator creates identifiers laid out like a ULID: a 48 bit millisecond timestamp
+// followed by 80 random bits, encoded as 26 characters of Crockford base32. IDs therefore sort
+// by creation time, and IDs created within the same millisecond increment the random part so
+// they still sort in creation order.
+type idGenerator struct {
+	mu       sync.Mutex
+	lastMs   uint64
+	lastRand [10]byte
+}
+
+var ids = &idGenerator{}
+
+// newID returns a new unique, time sortable identifier
+func newID() string {
+	return ids.next(time.Now())
+}
+
+func (g *idGenerator) next(now time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	if ms <= g.lastMs {
+		// Same (or an earlier) millisecond: keep the previous timestamp and increment
+		ms = g.lastMs
+		for i := len(g.lastRand) - 1; i >= 0; i-- {
+			g.lastRand[i]++
+			if g.lastRand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		if _, err := rand.Read(g.lastRand[:]); err != nil {
+			panic(err)
+		}
+		g.lastMs = ms
+	}
+
+	var raw [16]byte
+	binary.BigEndian.PutUint16(raw[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(raw[2:6], uint32(ms))
+	copy(raw[6:], g.lastRand[:])
+	return encodeCrockford(raw)
+}
+
+// encodeCrockford encodes 128 bits as 26 base32 characters, most significant bits first. The
+// first character only carries 3 bits.
+func encodeCrockford(raw [16]byte) string {
+	hi := binary.BigEndian.Uint64(raw[0:8])
+	lo := binary.BigEndian.Uint64(raw[8:16])
+
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
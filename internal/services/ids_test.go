@@ -0,0 +1,25 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDGenerator_ids_sort_in_creation_order(t *testing.T) {
+	generator := &idGenerator{}
+	now := time.Date(2020, 11, 2, 14, 0, 0, 0, time.UTC)
+
+	previous := generator.next(now)
+	assert.Len(t, previous, 26)
+	for i := 0; i < 1000; i++ {
+		// Mix IDs from the same millisecond with IDs from later ones
+		id := generator.next(now.Add(time.Duration(i/10) * time.Millisecond))
+		assert.Greater(t, id, previous)
+		previous = id
+	}
+
+	// A clock that goes backwards still produces increasing IDs
+	assert.Greater(t, generator.next(now), previous)
+}
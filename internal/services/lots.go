@@ -0,0 +1,142 @@
+package services
+
+import (
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// openLots returns the lots in the ledger's projection that have points remaining, oldest
+// first, with their expiry. Points earmarked by holds that are authorized at the given time
+// are not remaining.
+func (s *PointService) openLots(ledger model.Ledger, now time.Time) []model.Lot {
+	held := make(map[string]int)
+	for _, hold := range authorizedHolds(ledger, now) {
+		for _, allocation := range hold.Allocations {
+			held[allocation.LotID] += allocation.Points
+		}
+	}
+
+	lots := make([]model.Lot, len(ledger.Lots))
+	for i, lot := range ledger.Lots {
+		lot.Remaining -= held[lot.ID]
+		lot.ExpiresAt = s.expiresAt(lot.Payer, lot.Timestamp)
+		lots[i] = lot
+	}
+	return lots
+}
+
+// buildLots replays the ledger's records to return every lot in it, oldest first, with its
+// remaining balance and expiry. It is only needed for balances in the past; the current lots
+// are projected by the database, see openLots. Negative transactions that recorded allocations,
+// such as spends, reduce exactly the lots they were allocated. The others, such as payer
+// adjustments, drain the payer's oldest lots, the same way the database's projection does.
+// Reversals of spends are not lots of their own; their negative allocations return the points
+// to the lots the spend drew from. Holds are not taken into account.
+func (s *PointService) buildLots(ledger model.Ledger) []model.Lot {
+	drawn := make(map[string]int)
+	allocated := make(map[string]bool)
+	for _, allocation := range ledger.Allocations {
+		drawn[allocation.LotID] += allocation.Points
+		allocated[allocation.TransactionID] = true
+	}
+
+	lots := make([]model.Lot, 0)
+	for _, tran := range ledger.Transactions {
+		if tran.Points <= 0 || tran.ReversalOf != "" {
+			continue
+		}
+		lots = append(lots, model.Lot{
+			ID:        tran.ID,
+			Payer:     tran.Payer,
+			Points:    tran.Points,
+			Remaining: tran.Points - drawn[tran.ID],
+			Timestamp: tran.Timestamp,
+			ExpiresAt: s.expiresAt(tran.Payer, tran.Timestamp),
+		})
+	}
+
+	for _, tran := range ledger.Transactions {
+		if tran.Points < 0 && !allocated[tran.ID] {
+			drawLots(lots, -tran.Points, payerLots(tran.Payer))
+		}
+	}
+	return lots
+}
+
+// spendableLots returns the lots that have points remaining and have not expired at the
+// given time, oldest first
+func spendableLots(lots []model.Lot, now time.Time) []model.Lot {
+	result := make([]model.Lot, 0, len(lots))
+	for _, lot := range lots {
+		if lot.Remaining > 0 && !lot.ExpiredAt(now) {
+			result = append(result, lot)
+		}
+	}
+	return result
+}
+
+// availablePoints sums the remaining balance of the lots accepted by include
+func availablePoints(lots []model.Lot, include func(model.Lot) bool) int {
+	pointSum := 0
+	for _, lot := range lots {
+		if include(lot) {
+			pointSum += lot.Remaining
+		}
+	}
+	return pointSum
+}
+
+// drawLots takes points from the lots accepted by include in the order given, reducing their
+// remaining balances, and returns one allocation per lot drawn from. The caller must check
+// there are enough points available first. The returned allocations have no TransactionID.
+func drawLots(lots []model.Lot, points int, include func(model.Lot) bool) []model.Allocation {
+	allocations := make([]model.Allocation, 0)
+	pointsRemaining := points
+	for i := 0; i < len(lots) && pointsRemaining > 0; i++ {
+		lot := &lots[i]
+		if lot.Remaining <= 0 || !include(*lot) {
+			continue
+		}
+
+		drawn := lot.Remaining
+		if drawn > pointsRemaining {
+			drawn = pointsRemaining
+		}
+		lot.Remaining -= drawn
+		pointsRemaining -= drawn
+
+		allocations = append(allocations, model.Allocation{
+			LotID:  lot.ID,
+			Payer:  lot.Payer,
+			Points: drawn,
+		})
+	}
+	return allocations
+}
+
+// unexpiredLots returns a filter accepting only the lots that have not expired at the given time
+func unexpiredLots(at time.Time) func(model.Lot) bool {
+	return func(lot model.Lot) bool {
+		return !lot.ExpiredAt(at)
+	}
+}
+
+// payerLots returns a filter accepting only the lots of the given payer
+func payerLots(payer string) func(model.Lot) bool {
+	return func(lot model.Lot) bool {
+		return lot.Payer == payer
+	}
+}
+
+// allOf returns a filter accepting only the lots accepted by every one of the given filters
+func allOf(filters ...func(model.Lot) bool) func(model.Lot) bool {
+	return func(lot model.Lot) bool {
+		for _, include := range filters {
+			if !include(lot) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"fetchrewards.com/points-api/internal/metrics"
+	"fetchrewards.com/points-api/internal/model"
+)
+
+var (
+	pointsEarned = metrics.Default.NewCounter("points_api_points_earned_total",
+		"Points added to users' balances, by registered payer", "payer")
+	pointsSpent = metrics.Default.NewCounter("points_api_points_spent_total",
+		"Points spent by users, including captured holds, by registered payer", "payer")
+	spendFailures = metrics.Default.NewCounter("points_api_spend_failures_total",
+		"Spends that were rejected, by the code of the error", "reason")
+	storageDuration = metrics.Default.NewHistogram("points_api_storage_operation_duration_seconds",
+		"How long operations on the points database took, by operation", metrics.StorageBuckets, "operation")
+)
+
+// OutstandingPoints returns the points owed to all users: every point that has not been spent
+// or expired, including points earmarked by holds. It reads the total the database keeps up to
+// date rather than visiting every user, so points that have expired count until the sweeper
+// writes their expiration transactions.
+func (s *PointService) OutstandingPoints() int {
+	return s.DB.GetTotalPoints()
+}
+
+// otherPayers is the payer label of points from payers that are not labelled on their own
+const otherPayers = "other"
+
+// payerLabel returns the payer label of points from the payer. Payers are only labelled on
+// their own when a strict registry is set, as only then do operators decide which payers exist.
+// Otherwise any payer named in a request would become a label of its own, so they are all
+// counted as otherPayers.
+func (s *PointService) payerLabel(payer string) string {
+	if s.Payers == nil || s.Payers.Permissive {
+		return otherPayers
+	}
+	return payer
+}
+
+// recordSpent counts the points drawn by the transactions of a spend
+func (s *PointService) recordSpent(transactions []model.Transaction) {
+	for _, transaction := range transactions {
+		pointsSpent.Add(float64(-transaction.Points), s.payerLabel(transaction.Payer))
+	}
+}
+
+// recordSpendFailure counts a rejected spend by the Code of its error
+func recordSpendFailure(err error) {
+	reason := "internal_error"
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		reason = serviceErr.Code
+	}
+	spendFailures.Inc(reason)
+}
+
+// instrumentedDB times every operation on the pointsDB it wraps
+type instrumentedDB struct {
+	db pointsDB
+}
+
+// UpdateLedger is timed from when fn returns, so only writing the records is measured, not
+// waiting for the user's lock or the unit of work itself
+func (i instrumentedDB) UpdateLedger(userID string, fn func(model.Ledger) (model.Ledger, error)) error {
+	var written time.Time
+	err := i.db.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		defer func() { written = time.Now() }()
+		return fn(ledger)
+	})
+	if !written.IsZero() {
+		storageDuration.ObserveSince(written, "update_ledger")
+	}
+	return err
+}
+
+// UpdateLedgerAndBudget is timed from when fn returns, like UpdateLedger
+func (i instrumentedDB) UpdateLedgerAndBudget(userID, payerID string, fn func(model.Ledger, model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error)) error {
+	var written time.Time
+	err := i.db.UpdateLedgerAndBudget(userID, payerID, func(ledger model.Ledger, budget model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+		defer func() { written = time.Now() }()
+		return fn(ledger, budget)
+	})
+	if !written.IsZero() {
+		storageDuration.ObserveSince(written, "update_ledger_and_budget")
+	}
+	return err
+}
+
+func (i instrumentedDB) GetLedger(userID string) model.Ledger {
+	defer storageDuration.ObserveSince(time.Now(), "get_ledger")
+	return i.db.GetLedger(userID)
+}
+
+func (i instrumentedDB) GetAccounts(userID string) []model.Account {
+	defer storageDuration.ObserveSince(time.Now(), "get_accounts")
+	return i.db.GetAccounts(userID)
+}
+
+func (i instrumentedDB) GetAccountsAsOf(userID string, asOf time.Time) []model.Account {
+	defer storageDuration.ObserveSince(time.Now(), "get_accounts_as_of")
+	return i.db.GetAccountsAsOf(userID, asOf)
+}
+
+func (i instrumentedDB) GetAccount(userID string, payer string) (model.Account, bool) {
+	defer storageDuration.ObserveSince(time.Now(), "get_account")
+	return i.db.GetAccount(userID, payer)
+}
+
+func (i instrumentedDB) GetTransactions(userID string) []model.Transaction {
+	defer storageDuration.ObserveSince(time.Now(), "get_transactions")
+	return i.db.GetTransactions(userID)
+}
+
+func (i instrumentedDB) GetOpenLots(userID string) model.Ledger {
+	defer storageDuration.ObserveSince(time.Now(), "get_open_lots")
+	return i.db.GetOpenLots(userID)
+}
+
+func (i instrumentedDB) GetTotalPoints() int {
+	defer storageDuration.ObserveSince(time.Now(), "get_total_points")
+	return i.db.GetTotalPoints()
+}
+
+func (i instrumentedDB) GetUserIDs() []string {
+	defer storageDuration.ObserveSince(time.Now(), "get_user_ids")
+	return i.db.GetUserIDs()
+}
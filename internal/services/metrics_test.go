@@ -0,0 +1,89 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestMetrics(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := NewPointService(database)
+	service.Clock = test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+	service.Payers = NewPayerRegistry(database)
+	for _, payer := range []string{"DANNON", "UNILEVER", "MILLER COORS"} {
+		_, err := service.Payers.Register(model.Payer{DisplayName: payer})
+		assert.NoError(t, err)
+	}
+
+	// The metrics are shared by every service, so only how much they change is checked
+	earned := pointsEarned.Value("MILLER COORS")
+	spentDannon := pointsSpent.Value("DANNON")
+	spentMiller := pointsSpent.Value("MILLER COORS")
+	insufficient := spendFailures.Value("insufficient_points")
+	invalid := spendFailures.Value("invalid_amount")
+	updates := storageDuration.Count("update_ledger")
+
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+	assert.Equal(t, float64(10000), pointsEarned.Value("MILLER COORS")-earned)
+	assert.Equal(t, 11300, service.OutstandingPoints())
+
+	_, err := service.SpendPoints(userID, 300, nil)
+	assert.NoError(t, err)
+	hold, err := service.AuthorizeHold(userID, 1000, nil)
+	assert.NoError(t, err)
+	// Held points are still owed to the user
+	assert.Equal(t, 11000, service.OutstandingPoints())
+	_, err = service.CaptureHold(userID, hold.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 10000, service.OutstandingPoints())
+
+	_, err = service.SpendPoints(userID, 20000, nil)
+	assert.Error(t, err)
+	_, err = service.SpendPoints(userID, 0, nil)
+	assert.Error(t, err)
+
+	// The spend drew 100 DANNON and 200 UNILEVER points and the hold 1000 MILLER COORS points
+	assert.Equal(t, float64(100), pointsSpent.Value("DANNON")-spentDannon)
+	assert.Equal(t, float64(1000), pointsSpent.Value("MILLER COORS")-spentMiller)
+	assert.Equal(t, float64(1), spendFailures.Value("insufficient_points")-insufficient)
+	assert.Equal(t, float64(1), spendFailures.Value("invalid_amount")-invalid)
+	assert.Equal(t, uint64(len(test.Data)+4), storageDuration.Count("update_ledger")-updates)
+}
+
+func TestMetrics_unregistered_payers(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	permissive := NewPayerRegistry(database)
+	permissive.Permissive = true
+	tran := model.Transaction{Payer: "UNKNOWN", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}
+
+	tests := map[string]*PayerRegistry{
+		"without a registry":    nil,
+		"with a permissive one": permissive,
+	}
+	for name, payers := range tests {
+		t.Run(name, func(t *testing.T) {
+			service := NewPointService(database)
+			service.Payers = payers
+			earned := pointsEarned.Value(otherPayers)
+			spent := pointsSpent.Value(otherPayers)
+
+			assert.NoError(t, service.AddPoints(userID, tran))
+			_, err := service.SpendPoints(userID, 40, nil)
+			assert.NoError(t, err)
+
+			// Payers anyone can name are counted together so they cannot add labels at will
+			assert.Equal(t, float64(100), pointsEarned.Value(otherPayers)-earned)
+			assert.Equal(t, float64(40), pointsSpent.Value(otherPayers)-spent)
+			assert.Zero(t, pointsEarned.Value("UNKNOWN"))
+		})
+	}
+}
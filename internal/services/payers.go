@@ -0,0 +1,187 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// Errors returned by the PayerRegistry. ErrPayerNotFound is returned when looking up a payer
+// and ErrPayerNotRegistered when points are added for one.
+var (
+	ErrPayerNotFound      = newError(ErrNotFound, "payer_not_found", "payer not found")
+	ErrPayerNotRegistered = newError(ErrUnknownPayer, "unknown_payer", "payer is not registered")
+	ErrPayerExists        = newError(ErrConflict, "payer_exists", "payer already registered")
+	ErrPayerSuspended     = newError(ErrConflict, "payer_suspended", "payer is suspended")
+)
+
+// errPayerRequired is returned when a payer is not named
+var errPayerRequired = newError(ErrInvalidRequest, "payer_required", "payer is required")
+
+// payersDB is an abstraction for the database layer dependencies used by the PayerRegistry
+type payersDB interface {
+	GetPayer(payerID string) (model.Payer, bool)
+	GetPayers() []model.Payer
+	UpdatePayer(payerID string, fn func(existing model.Payer, found bool) (model.Payer, error)) error
+	DeletePayer(payerID string) (bool, error)
+}
+
+// PayerUpdate holds the changes to make to a registered payer. Fields left nil are not changed.
+type PayerUpdate struct {
+	DisplayName *string            `json:"displayName,omitempty"`
+	Status      *model.PayerStatus `json:"status,omitempty"`
+}
+
+// PayerRegistry keeps track of the payers allowed to issue points. Payers are identified by
+// their canonical ID, so differently written names of the same payer resolve to one account.
+type PayerRegistry struct {
+	DB    payersDB
+	Clock Clock
+
+	// Permissive registers unknown payers the first time points are added for them instead of
+	// rejecting the points. It is meant for backfilling historical transactions.
+	Permissive bool
+}
+
+// NewPayerRegistry creates a new, strict PayerRegistry with the given payersDB using the
+// system clock
+func NewPayerRegistry(db payersDB) *PayerRegistry {
+	return &PayerRegistry{
+		DB:    db,
+		Clock: systemClock{},
+	}
+}
+
+// CanonicalPayerID returns the canonical ID of the payer with the given name: upper case with
+// surrounding space removed and inner runs of space collapsed, so "Dannon", "DANNON " and
+// "DANNON" all name the same payer
+func CanonicalPayerID(name string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(name), " "))
+}
+
+// Register adds a new active payer. The ID is canonicalized and defaults to the canonical form
+// of the display name, which in turn defaults to the ID. Returns ErrPayerExists if a payer
+// with the same canonical ID is registered already.
+func (r *PayerRegistry) Register(payer model.Payer) (model.Payer, error) {
+	if payer.ID == "" {
+		payer.ID = payer.DisplayName
+	}
+	payer.ID = CanonicalPayerID(payer.ID)
+	if payer.ID == "" {
+		return model.Payer{}, newError(ErrInvalidRequest, "payer_required", "payer id or displayName is required")
+	}
+	if payer.DisplayName == "" {
+		payer.DisplayName = payer.ID
+	}
+	if payer.Status == "" {
+		payer.Status = model.PayerActive
+	}
+	if err := validatePayerStatus(payer.Status); err != nil {
+		return model.Payer{}, err
+	}
+
+	err := r.DB.UpdatePayer(payer.ID, func(_ model.Payer, found bool) (model.Payer, error) {
+		if found {
+			return model.Payer{}, ErrPayerExists
+		}
+		now := r.Clock.Now()
+		payer.CreatedAt = now
+		payer.UpdatedAt = now
+		return payer, nil
+	})
+	if err != nil {
+		return model.Payer{}, err
+	}
+	return payer, nil
+}
+
+// GetPayer returns the payer registered under the canonical form of the given ID
+func (r *PayerRegistry) GetPayer(payerID string) (model.Payer, bool) {
+	return r.DB.GetPayer(CanonicalPayerID(payerID))
+}
+
+// ListPayers returns every registered payer ordered by ID
+func (r *PayerRegistry) ListPayers() []model.Payer {
+	return r.DB.GetPayers()
+}
+
+// UpdatePayer changes the display name or status of a registered payer and returns the
+// updated payer
+func (r *PayerRegistry) UpdatePayer(payerID string, update PayerUpdate) (model.Payer, error) {
+	if update.DisplayName != nil && strings.TrimSpace(*update.DisplayName) == "" {
+		return model.Payer{}, newError(ErrInvalidRequest, "invalid_display_name", "displayName must not be empty")
+	}
+	if update.Status != nil {
+		if err := validatePayerStatus(*update.Status); err != nil {
+			return model.Payer{}, err
+		}
+	}
+
+	var updated model.Payer
+	err := r.DB.UpdatePayer(CanonicalPayerID(payerID), func(payer model.Payer, found bool) (model.Payer, error) {
+		if !found {
+			return model.Payer{}, ErrPayerNotFound
+		}
+		if update.DisplayName != nil {
+			payer.DisplayName = *update.DisplayName
+		}
+		if update.Status != nil {
+			payer.Status = *update.Status
+		}
+		payer.UpdatedAt = r.Clock.Now()
+		updated = payer
+		return payer, nil
+	})
+	if err != nil {
+		return model.Payer{}, err
+	}
+	return updated, nil
+}
+
+// DeletePayer removes a payer from the registry. Points already issued by the payer are kept,
+// but no more can be added until it is registered again.
+func (r *PayerRegistry) DeletePayer(payerID string) error {
+	deleted, err := r.DB.DeletePayer(CanonicalPayerID(payerID))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrPayerNotFound
+	}
+	return nil
+}
+
+// Resolve returns the canonical ID of the named payer if it may issue points. Unknown payers
+// are rejected with ErrPayerNotRegistered, or registered in Permissive mode, and suspended payers
+// are rejected with ErrPayerSuspended.
+func (r *PayerRegistry) Resolve(name string) (string, error) {
+	payerID := CanonicalPayerID(name)
+	if payerID == "" {
+		return "", errPayerRequired
+	}
+
+	payer, found := r.DB.GetPayer(payerID)
+	if !found {
+		if !r.Permissive {
+			return "", fmt.Errorf("%w: %s", ErrPayerNotRegistered, payerID)
+		}
+		payer, err := r.Register(model.Payer{ID: payerID, DisplayName: strings.TrimSpace(name)})
+		if err == ErrPayerExists {
+			// Registered concurrently, check it again
+			return r.Resolve(name)
+		}
+		return payer.ID, err
+	}
+	if payer.Status != model.PayerActive {
+		return "", fmt.Errorf("%w: %s", ErrPayerSuspended, payerID)
+	}
+	return payerID, nil
+}
+
+func validatePayerStatus(status model.PayerStatus) error {
+	if status != model.PayerActive && status != model.PayerSuspended {
+		return newError(ErrInvalidRequest, "invalid_payer_status", "payer status must be %s or %s", model.PayerActive, model.PayerSuspended)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestCanonicalPayerID(t *testing.T) {
+	for _, name := range []string{"DANNON", "Dannon", "DANNON ", "  dannon"} {
+		assert.Equal(t, "DANNON", services.CanonicalPayerID(name))
+	}
+	assert.Equal(t, "MILLER COORS", services.CanonicalPayerID("Miller   Coors"))
+}
+
+func TestPayerRegistry(t *testing.T) {
+	registry := services.NewPayerRegistry(db.NewInMemoryDB())
+
+	payer, err := registry.Register(model.Payer{DisplayName: "Miller Coors"})
+	assert.NoError(t, err)
+	assert.Equal(t, "MILLER COORS", payer.ID)
+	assert.Equal(t, "Miller Coors", payer.DisplayName)
+	assert.Equal(t, model.PayerActive, payer.Status)
+
+	_, err = registry.Register(model.Payer{ID: "miller coors "})
+	assert.Equal(t, services.ErrPayerExists, err)
+	_, err = registry.Register(model.Payer{})
+	assert.Error(t, err)
+
+	suspended := model.PayerSuspended
+	payer, err = registry.UpdatePayer("Miller Coors", services.PayerUpdate{Status: &suspended})
+	assert.NoError(t, err)
+	assert.Equal(t, model.PayerSuspended, payer.Status)
+	found, ok := registry.GetPayer("MILLER COORS")
+	assert.True(t, ok)
+	assert.Equal(t, payer, found)
+
+	unknown := model.PayerStatus("retired")
+	_, err = registry.UpdatePayer("MILLER COORS", services.PayerUpdate{Status: &unknown})
+	assert.Error(t, err)
+	_, err = registry.UpdatePayer("UNILEVER", services.PayerUpdate{Status: &suspended})
+	assert.Equal(t, services.ErrPayerNotFound, err)
+
+	assert.NoError(t, registry.DeletePayer("MILLER COORS"))
+	assert.Equal(t, services.ErrPayerNotFound, registry.DeletePayer("MILLER COORS"))
+	assert.Empty(t, registry.ListPayers())
+}
+
+func TestAddPoints_payer_registry(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Payers = services.NewPayerRegistry(database)
+
+	_, err := service.Payers.Register(model.Payer{DisplayName: "Dannon"})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"DANNON", "Dannon", "DANNON "} {
+		err := service.AddPoints(userID, model.Transaction{Payer: name, Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []model.Account{{Payer: "DANNON", Points: 300}}, service.GetAccounts(userID))
+
+	err = service.AddPoints(userID, model.Transaction{Payer: "UNILEVER", Points: 100})
+	assert.True(t, errors.Is(err, services.ErrPayerNotRegistered))
+
+	suspended := model.PayerSuspended
+	_, err = service.Payers.UpdatePayer("DANNON", services.PayerUpdate{Status: &suspended})
+	assert.NoError(t, err)
+	err = service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: 100})
+	assert.True(t, errors.Is(err, services.ErrPayerSuspended))
+
+	t.Run("permissive mode registers unknown payers", func(t *testing.T) {
+		service.Payers.Permissive = true
+		err := service.AddPoints(userID, model.Transaction{Payer: "Unilever ", Points: 100})
+		assert.NoError(t, err)
+		payer, found := service.Payers.GetPayer("UNILEVER")
+		assert.True(t, found)
+		assert.Equal(t, "Unilever", payer.DisplayName)
+
+		// Suspended payers are still rejected
+		err = service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: 100})
+		assert.True(t, errors.Is(err, services.ErrPayerSuspended))
+	})
+}
+
+func TestErrors(t *testing.T) {
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Payers = services.NewPayerRegistry(database)
+
+	err := service.AddPoints("1", model.Transaction{Payer: "UNILEVER", Points: 100})
+	assert.True(t, errors.Is(err, services.ErrUnknownPayer))
+	var serviceErr *services.Error
+	assert.True(t, errors.As(err, &serviceErr))
+	assert.Equal(t, "unknown_payer", serviceErr.Code)
+	assert.Equal(t, "payer is not registered: UNILEVER", err.Error())
+
+	_, err = service.SpendPoints("1", 100, nil)
+	assert.True(t, errors.Is(err, services.ErrInsufficientFunds))
+	assert.True(t, errors.Is(err, services.ErrNotEnoughPoints))
+}
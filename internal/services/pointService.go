@@ -1,7 +1,6 @@
 package services
 
 import (
-	"errors"
 	"sort"
 	"time"
 
@@ -10,117 +9,508 @@ import (
 
 // pointsDB is an abstraction for the database layer dependencies used by this package
 type pointsDB interface {
-	AddTransaction(userID string, transaction model.Transaction)
+	UpdateLedger(userID string, fn func(model.Ledger) (model.Ledger, error)) error
+	UpdateLedgerAndBudget(userID, payerID string, fn func(model.Ledger, model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error)) error
+	GetLedger(userID string) model.Ledger
 	GetAccounts(userID string) []model.Account
+	GetAccountsAsOf(userID string, asOf time.Time) []model.Account
 	GetAccount(userID string, payer string) (model.Account, bool)
 	GetTransactions(userID string) []model.Transaction
+	GetOpenLots(userID string) model.Ledger
+	GetTotalPoints() int
+	GetUserIDs() []string
 }
 
-var notEnoughPointsErr = errors.New("not enough points")
+// ErrNotEnoughPoints is returned when a user does not have the points to spend, hold or adjust
+var ErrNotEnoughPoints = newError(ErrInsufficientFunds, "insufficient_points", "not enough points")
 
 // PointService houses the business logic of the api. It delegates data manipulation tasks
 // to a pointsDB interface.
+//
+// Every positive transaction is a lot that later debits draw from, oldest first. Each spend
+// is stored together with allocations recording exactly which lots it consumed. Holds
+// earmark points from lots in the same way until they are captured, voided or expire.
 type PointService struct {
-	DB pointsDB
+	DB    pointsDB
+	Clock Clock
+
+	// DefaultStrategy is the SpendStrategy used by spends that do not choose their own
+	DefaultStrategy SpendStrategy
+
+	// ExpirationPolicies holds the ExpirationPolicy of each payer that has one, keyed by payer.
+	// Points from other payers never expire. Expired points are excluded from balances and
+	// are never spent, even before ExpirePoints writes their expiration transactions. The map
+	// must not be modified while the service is in use.
+	ExpirationPolicies map[string]ExpirationPolicy
+
+	// HoldDuration is how long an authorized hold lasts before it expires
+	HoldDuration time.Duration
+
+	// Payers, when set, is the registry AddPoints checks payers against. Payer names are then
+	// stored in their canonical form. When nil any payer name is accepted as is.
+	Payers *PayerRegistry
+
+	// Budgets, when set, is the BudgetLedger positive transactions added by AddPoints are
+	// drawn from. It must keep its budgets in the service's database, which draws from them in
+	// the same unit of work that adds the points. When nil payers can issue any number of
+	// points.
+	Budgets *BudgetLedger
+
+	// requestID is set by WithRequestID
+	requestID string
 }
 
-// NewPointService creates a new PointService with the given pointsDB
+// NewPointService creates a new PointService with the given pointsDB, using the system clock,
+// spending oldest points first, with no expiration policies and holds lasting
+// DefaultHoldDuration
 func NewPointService(db pointsDB) *PointService {
 	return &PointService{
-		DB: db,
+		DB:                 instrumentedDB{db: db},
+		Clock:              systemClock{},
+		DefaultStrategy:    FIFOStrategy{},
+		ExpirationPolicies: make(map[string]ExpirationPolicy),
+		HoldDuration:       DefaultHoldDuration,
 	}
 }
 
-// AddPoints adds the given model.Transaction to the db. If the point value is negative
-// then it must not take the payer's account balance lower than 0. If it results in a
-// negative account balance, an error will be returned.
+// WithRequestID returns a copy of the service that handles a single request identified by
+// requestID, such as one made with an Idempotency-Key. Everything the copy writes is tagged with
+// the ID, and a write that finds records tagged with it in the ledger writes nothing and returns
+// what those records hold instead. So a request that is retried, even while the first attempt is
+// still running, is only ever applied once.
+func (s *PointService) WithRequestID(requestID string) *PointService {
+	service := *s
+	service.requestID = requestID
+	return &service
+}
+
+// written returns the records already written by the service's request, if it has a request ID
+func (s *PointService) written(ledger model.Ledger) (model.Ledger, bool) {
+	if s.requestID == "" {
+		return model.Ledger{}, false
+	}
+	records, ok := ledger.Requests[s.requestID]
+	return records, ok
+}
+
+// AddPoints adds the given model.Transaction to the db and assigns it a new ID and CreatedAt.
+// If the point value is negative then it must not take the payer's account balance lower than
+// 0. If it results in a negative account balance, an error will be returned. A negative
+// transaction drains the payer's oldest lots first, see debitAllocations. The balance check
+// and the write happen in a single unit of work, so concurrent calls cannot overdraw the payer.
+//
+// If the service has a PayerRegistry the payer must be registered and active, see
+// PayerRegistry.Resolve.
+//
+// If the service has a BudgetLedger positive points are drawn from the payer's budget, see
+// BudgetLedger, in the same unit of work that adds them, so either both are stored or neither
+// is. Negative points are not returned to the budget.
+//
+// The transaction's type is earn for positive points and adjustment for negative points,
+// unless it is given as transfer. Other types are written by the service itself and are
+// rejected.
 func (s *PointService) AddPoints(userID string, transaction model.Transaction) error {
-	if transaction.Points > 0 {
-		s.DB.AddTransaction(userID, transaction)
-		return nil
+	switch {
+	case transaction.Type == "" && transaction.Points >= 0:
+		transaction.Type = model.TransactionEarn
+	case transaction.Type == "":
+		transaction.Type = model.TransactionAdjustment
+	case transaction.Type == model.TransactionEarn && transaction.Points < 0:
+		return newError(ErrInvalidAmount, "invalid_amount", "earn transactions must have positive points")
+	case transaction.Type == model.TransactionAdjustment && transaction.Points >= 0:
+		return newError(ErrInvalidAmount, "invalid_amount", "adjustment transactions must have negative points")
+	case transaction.Type != model.TransactionEarn && transaction.Type != model.TransactionAdjustment && transaction.Type != model.TransactionTransfer:
+		return newError(ErrInvalidRequest, "invalid_transaction_type", "transactions of type %q cannot be added", transaction.Type)
+	}
+	if s.Payers != nil {
+		payerID, err := s.Payers.Resolve(transaction.Payer)
+		if err != nil {
+			return err
+		}
+		transaction.Payer = payerID
+	}
+	transaction.ID = ""
+	transaction.SpendID = ""
+	transaction.ReversalOf = ""
+	transaction.RequestID = s.requestID
+	if transaction.Metadata != nil {
+		// The caller keeps its map, so store a copy it cannot change afterwards
+		metadata := make(map[string]string, len(transaction.Metadata))
+		for key, value := range transaction.Metadata {
+			metadata[key] = value
+		}
+		transaction.Metadata = metadata
+	}
+
+	// The ID is assigned under the ledger's lock, so the user's IDs sort in the order the
+	// transactions were written
+	added := true
+	add := func(ledger model.Ledger) (model.Ledger, error) {
+		if _, ok := s.written(ledger); ok {
+			added = false
+			return model.Ledger{}, nil
+		}
+		if transaction.ID == "" {
+			transaction.ID = newID()
+		}
+		now := s.Clock.Now()
+		transaction.CreatedAt = now
+		if transaction.Points >= 0 {
+			return model.Ledger{Transactions: []model.Transaction{transaction}}, nil
+		}
+		allocations, err := s.debitAllocations(ledger, transaction, now)
+		if err != nil {
+			return model.Ledger{}, err
+		}
+		return model.Ledger{Transactions: []model.Transaction{transaction}, Allocations: allocations}, nil
+	}
+
+	var err error
+	if s.Budgets != nil && transaction.Points > 0 {
+		err = s.DB.UpdateLedgerAndBudget(userID, CanonicalPayerID(transaction.Payer), func(ledger model.Ledger, budget model.PayerBudget) (model.Ledger, model.PayerBudget, *model.BudgetEntry, error) {
+			if _, ok := s.written(ledger); ok {
+				added = false
+				return model.Ledger{}, budget, nil, nil
+			}
+			transaction.ID = newID()
+			budget, entry, err := s.Budgets.issue(budget, userID, transaction)
+			if err != nil {
+				return model.Ledger{}, budget, nil, err
+			}
+			records, err := add(ledger)
+			return records, budget, entry, err
+		})
 	} else {
-		totalPoints := s.getTotalPointsForPayer(userID, transaction.Payer)
+		err = s.DB.UpdateLedger(userID, add)
+	}
+	if err == nil && added && transaction.Points > 0 {
+		pointsEarned.Add(float64(transaction.Points), s.payerLabel(transaction.Payer))
+	}
+	return err
+}
+
+// debitAllocations works out which lots the negative transaction takes its points from. It
+// can only take points of its payer that have neither expired nor are held at the given time.
+// Usually those are the payer's oldest points, and the transaction is written without
+// allocations for the database to drain from the payer's oldest lots. That keeps it first in,
+// first out even if lots with earlier timestamps are added afterwards. Should the oldest points
+// be expired or held, the transaction is instead allocated against the oldest points it can
+// take.
+func (s *PointService) debitAllocations(ledger model.Ledger, transaction model.Transaction, now time.Time) ([]model.Allocation, error) {
+	lots := s.openLots(ledger, now)
+	include := allOf(payerLots(transaction.Payer), unexpiredLots(now))
+	points := -transaction.Points
+	if availablePoints(lots, include) < points {
+		return nil, ErrNotEnoughPoints
+	}
 
-		if totalPoints >= -transaction.Points {
-			s.DB.AddTransaction(userID, transaction)
-			return nil
-		} else {
-			return notEnoughPointsErr
+	// Follow the database's drain through the payer's lots, which ignores holds and expiry
+	drained := points
+	for i, lot := range ledger.Lots {
+		if drained == 0 {
+			return nil, nil
 		}
+		if lot.Payer != transaction.Payer {
+			continue
+		}
+		taken := lot.Remaining
+		if taken > drained {
+			taken = drained
+		}
+		if taken > lots[i].Remaining || lots[i].ExpiredAt(now) {
+			break
+		}
+		drained -= taken
+	}
+	if drained == 0 {
+		return nil, nil
+	}
+
+	allocations := drawLots(lots, points, include)
+	for i := range allocations {
+		allocations[i].TransactionID = transaction.ID
+	}
+	return allocations, nil
+}
+
+// SpendPoints consumes points from the user's unexpired lots in the order chosen by the given
+// SpendStrategy, or the DefaultStrategy if it is nil, and returns new transactions, one per
+// payer drawn from, as a result of the operation. All the returned transactions share the same
+// SpendID. Returns an error if there are not enough points. The spend is all-or-nothing and is
+// serialized with every other write for the same user, so concurrent spends cannot drive the
+// balance negative.
+func (s *PointService) SpendPoints(userID string, points int, strategy SpendStrategy) ([]model.Transaction, error) {
+	if points <= 0 {
+		recordSpendFailure(errPointsNotPositive)
+		return []model.Transaction{}, errPointsNotPositive
+	}
+	if strategy == nil {
+		strategy = s.DefaultStrategy
+	}
+
+	var newTransactions []model.Transaction
+	spent := true
+	err := s.DB.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		if written, ok := s.written(ledger); ok {
+			newTransactions, spent = written.Transactions, false
+			return model.Ledger{}, nil
+		}
+		records, err := s.planSpend(ledger, points, strategy, newID())
+		newTransactions = records.Transactions
+		return records, err
+	})
+	if err != nil {
+		recordSpendFailure(err)
+		return []model.Transaction{}, err
+	}
+	if spent {
+		s.recordSpent(newTransactions)
 	}
+	return newTransactions, nil
 }
 
-// SpendPoints consumes points from transactions starting with the oldest transaction going
-// forward and returns new transactions as a result of the operation. Returns an error if
-// there are not enough points.
-func (s *PointService) SpendPoints(userID string, points int) ([]model.Transaction, error) {
+// PreviewSpend works out what SpendPoints would do with the same arguments without writing
+// anything. It returns the transactions the spend would write, one per payer, and the account
+// balances the user would be left with.
+func (s *PointService) PreviewSpend(userID string, points int, strategy SpendStrategy) (model.SpendPreview, error) {
 	if points <= 0 {
-		return []model.Transaction{}, errors.New("points must be a positive integer")
+		return model.SpendPreview{}, errPointsNotPositive
+	}
+	if strategy == nil {
+		strategy = s.DefaultStrategy
+	}
+
+	ledger := s.DB.GetOpenLots(userID)
+	records, err := s.planSpend(ledger, points, strategy, "")
+	if err != nil {
+		return model.SpendPreview{}, err
+	}
+
+	spent := make(map[string]int)
+	for _, tran := range records.Transactions {
+		spent[tran.Payer] += tran.Points
+	}
+	balances := s.availableAccounts(s.DB.GetAccounts(userID), ledger, s.Clock.Now())
+	for i := range balances {
+		balances[i].Points += spent[balances[i].Payer]
+	}
+
+	// Nothing is written, so the planned transactions get no identity
+	for i := range records.Transactions {
+		records.Transactions[i].ID = ""
+	}
+	return model.SpendPreview{
+		Points:       points,
+		Transactions: records.Transactions,
+		Balances:     balances,
+	}, nil
+}
+
+// planSpend works out the records a spend of the given points writes to the ledger
+func (s *PointService) planSpend(ledger model.Ledger, points int, strategy SpendStrategy, spendID string) (model.Ledger, error) {
+	now := s.Clock.Now()
+	allocations, _, err := s.allocate(ledger, points, strategy, now)
+	if err != nil {
+		return model.Ledger{}, err
 	}
-	totalPoints := s.getTotalPointsForUser(userID)
-	if points > totalPoints {
-		return []model.Transaction{}, notEnoughPointsErr
+	return model.Ledger{
+		Transactions: transactionsForAllocations(allocations, model.Transaction{
+			Type:      model.TransactionSpend,
+			Timestamp: now,
+			CreatedAt: now,
+			SpendID:   spendID,
+			RequestID: s.requestID,
+		}),
+		Allocations: allocations,
+	}, nil
+}
+
+// allocate draws the given points from the lots that can be spent at the given time using
+// the strategy. It also returns the lots that could be spent. Returns an error if there are
+// not enough points.
+func (s *PointService) allocate(ledger model.Ledger, points int, strategy SpendStrategy, now time.Time) ([]model.Allocation, []model.Lot, error) {
+	lots := spendableLots(s.openLots(ledger, now), now)
+	if availablePoints(lots, anyLot) < points {
+		return nil, nil, ErrNotEnoughPoints
 	}
+	return strategy.Allocate(lots, points), lots, nil
+}
 
-	transactions := s.DB.GetTransactions(userID)
+// GetSpend returns the transactions written by the spend with the given ID along with the
+// lots that funded it and any reversals. The bool is false if the user has no such spend.
+func (s *PointService) GetSpend(userID, spendID string) (model.Spend, bool) {
+	ledger := s.DB.GetLedger(userID)
 
-	pointsRemaining := points
-	newTranMap := make(map[string]*model.Transaction)
-	for i := 0; i < len(transactions) && pointsRemaining > 0; i++ {
-		tran := transactions[i]
+	spend := model.Spend{
+		ID:           spendID,
+		Transactions: make([]model.Transaction, 0),
+		Funding:      make([]model.Funding, 0),
+		Reversals:    make([]model.Transaction, 0),
+	}
+	transactionIDs := make(map[string]bool)
+	lotIDs := make(map[string]bool)
+	for _, tran := range ledger.Transactions {
+		switch {
+		case tran.SpendID == spendID:
+			spend.Transactions = append(spend.Transactions, tran)
+			spend.Points -= tran.Points
+			transactionIDs[tran.ID] = true
+		case tran.ReversalOf == spendID:
+			spend.Reversals = append(spend.Reversals, tran)
+			spend.Reversed += tran.Points
+		}
+	}
+	if len(spend.Transactions) == 0 {
+		return model.Spend{}, false
+	}
 
-		balanceDiff := -tran.Points
-		if tran.Points > pointsRemaining {
-			balanceDiff = -pointsRemaining
+	for _, allocation := range ledger.Allocations {
+		if transactionIDs[allocation.TransactionID] {
+			spend.Funding = append(spend.Funding, model.Funding{
+				Lot:    model.Lot{ID: allocation.LotID},
+				Points: allocation.Points,
+			})
+			lotIDs[allocation.LotID] = true
 		}
+	}
 
-		pointsRemaining -= tran.Points
-		if _, ok := newTranMap[tran.Payer]; ok {
-			t := newTranMap[tran.Payer]
-			t.Points = t.Points + balanceDiff
-		} else {
-			newTranMap[tran.Payer] = &model.Transaction{
+	// Lots with nothing remaining are not projected, so they are read from their transactions
+	lots := make(map[string]model.Lot)
+	for _, lot := range s.openLots(s.DB.GetOpenLots(userID), s.Clock.Now()) {
+		lots[lot.ID] = lot
+	}
+	for _, tran := range ledger.Transactions {
+		if _, ok := lots[tran.ID]; lotIDs[tran.ID] && !ok {
+			lots[tran.ID] = model.Lot{
+				ID:        tran.ID,
 				Payer:     tran.Payer,
-				Points:    balanceDiff,
-				Timestamp: time.Now(),
+				Points:    tran.Points,
+				Timestamp: tran.Timestamp,
+				ExpiresAt: s.expiresAt(tran.Payer, tran.Timestamp),
 			}
 		}
 	}
+	for i := range spend.Funding {
+		spend.Funding[i].Lot = lots[spend.Funding[i].Lot.ID]
+	}
+	return spend, true
+}
 
-	var newTransactions []model.Transaction
-	for _, val := range newTranMap {
-		newTransactions = append(newTransactions, *val)
-		s.DB.AddTransaction(userID, *val)
+// GetAccounts returns all payer accounts which includes the associated balances. Points that
+// have expired or are held are not included in the balances. The balances, lots and holds all
+// come from the database's projections rather than replaying the ledger.
+func (s *PointService) GetAccounts(userID string) []model.Account {
+	return s.availableAccounts(s.DB.GetAccounts(userID), s.DB.GetOpenLots(userID), s.Clock.Now())
+}
+
+// GetAccountsAsOf returns the payer accounts as they stood at the given time, replaying only
+// the transactions at or before it. Points that had expired by then are not included in the
+// balances. Holds are not taken into account, as the ledger does not record when they were
+// voided.
+func (s *PointService) GetAccountsAsOf(userID string, asOf time.Time) []model.Account {
+	if len(s.ExpirationPolicies) == 0 {
+		return s.DB.GetAccountsAsOf(userID, asOf)
 	}
+	return s.accountsFromLedger(ledgerAsOf(s.DB.GetLedger(userID), asOf), asOf)
+}
 
-	sort.Slice(newTransactions, func(i, j int) bool {
-		return newTransactions[i].Timestamp.Before(newTransactions[j].Timestamp)
-	})
+// GetBalance returns the user's total balance across all payers. See GetAccounts.
+func (s *PointService) GetBalance(userID string) model.Balance {
+	return balanceOf(s.GetAccounts(userID), nil)
+}
 
-	return newTransactions, nil
+// GetBalanceAsOf returns the user's total balance across all payers at the given time. See
+// GetAccountsAsOf.
+func (s *PointService) GetBalanceAsOf(userID string, asOf time.Time) model.Balance {
+	return balanceOf(s.GetAccountsAsOf(userID, asOf), &asOf)
 }
 
-// GetAccounts returns all payer accounts which includes the associated balances.
-func (s *PointService) GetAccounts(userID string) []model.Account {
-	return s.DB.GetAccounts(userID)
+// availableAccounts takes the points that have expired but have not been swept yet, and the
+// points earmarked by holds authorized at the given time, off the balances of the accounts.
+// The lots and holds are read from the ledger's projections.
+func (s *PointService) availableAccounts(accounts []model.Account, ledger model.Ledger, now time.Time) []model.Account {
+	held := heldPoints(ledger, now)
+	expired := map[string]int{}
+	if len(s.ExpirationPolicies) > 0 {
+		expired = expiredPoints(s.openLots(ledger, now), now)
+	}
+	for i := range accounts {
+		accounts[i].Points -= expired[accounts[i].Payer] + held[accounts[i].Payer]
+	}
+	return accounts
 }
 
-func (s *PointService) getTotalPointsForPayer(userID string, payer string) int {
-	pointSum := 0
-	transactions := s.DB.GetTransactions(userID)
-	for _, tran := range transactions {
-		if tran.Payer == payer {
-			pointSum += tran.Points
+// accountsFromLedger sums the transactions in the ledger per payer, leaving out points that
+// have expired at the given time
+func (s *PointService) accountsFromLedger(ledger model.Ledger, now time.Time) []model.Account {
+	expired := expiredPoints(s.buildLots(ledger), now)
+
+	accountMap := make(map[string]int)
+	for _, tran := range ledger.Transactions {
+		accountMap[tran.Payer] += tran.Points
+	}
+	accounts := make([]model.Account, 0, len(accountMap))
+	for payer, points := range accountMap {
+		accounts = append(accounts, model.Account{
+			Payer:  payer,
+			Points: points - expired[payer],
+		})
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Payer < accounts[j].Payer
+	})
+	return accounts
+}
+
+// ledgerAsOf returns the part of the ledger written by transactions at or before the given
+// time, leaving out every hold
+func ledgerAsOf(ledger model.Ledger, asOf time.Time) model.Ledger {
+	result := model.Ledger{
+		Transactions: make([]model.Transaction, 0, len(ledger.Transactions)),
+		Allocations:  make([]model.Allocation, 0, len(ledger.Allocations)),
+	}
+	included := make(map[string]bool)
+	for _, tran := range ledger.Transactions {
+		if !tran.Timestamp.After(asOf) {
+			result.Transactions = append(result.Transactions, tran)
+			included[tran.ID] = true
 		}
 	}
-	return pointSum
+	for _, allocation := range ledger.Allocations {
+		if included[allocation.TransactionID] {
+			result.Allocations = append(result.Allocations, allocation)
+		}
+	}
+	return result
 }
 
-func (s *PointService) getTotalPointsForUser(userID string) int {
-	pointSum := 0
-	transactions := s.DB.GetTransactions(userID)
-	for _, tran := range transactions {
-		pointSum += tran.Points
+// balanceOf sums the accounts into a total balance
+func balanceOf(accounts []model.Account, asOf *time.Time) model.Balance {
+	balance := model.Balance{AsOf: asOf}
+	for _, account := range accounts {
+		balance.Points += account.Points
+	}
+	return balance
+}
+
+// transactionsForAllocations creates one transaction per payer, copied from template, taking
+// away the points of that payer's allocations, in the order the payers were first drawn from.
+// Each allocation is pointed at the transaction created for its payer.
+func transactionsForAllocations(allocations []model.Allocation, template model.Transaction) []model.Transaction {
+	transactions := make([]model.Transaction, 0)
+	payerIndex := make(map[string]int)
+	for i, allocation := range allocations {
+		index, ok := payerIndex[allocation.Payer]
+		if !ok {
+			index = len(transactions)
+			payerIndex[allocation.Payer] = index
+			tran := template
+			tran.ID = newID()
+			tran.Payer = allocation.Payer
+			transactions = append(transactions, tran)
+		}
+		transactions[index].Points -= allocation.Points
+		allocations[i].TransactionID = transactions[index].ID
 	}
-	return pointSum
+	return transactions
 }
@@ -0,0 +1,125 @@
+package services_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+// These tests are most useful when run with the race detector: go test -race ./...
+
+func TestPointService_concurrent_add_spend_and_read(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 100
+	)
+	users := []string{"1", "2"}
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+
+	var (
+		wg      sync.WaitGroup
+		spentMu sync.Mutex
+		spent   = map[string]int{}
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				err := service.AddPoints(users[i%len(users)], model.Transaction{
+					Payer:     test.Data[i%len(test.Data)].Payer,
+					Points:    10,
+					Timestamp: test.Data[(i+w)%len(test.Data)].Timestamp,
+				})
+				assert.NoError(t, err)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				userID := users[(i+w)%len(users)]
+				transactions, err := service.SpendPoints(userID, 5, nil)
+				if err != nil {
+					continue
+				}
+				spentMu.Lock()
+				for _, tran := range transactions {
+					spent[userID] -= tran.Points
+				}
+				spentMu.Unlock()
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				service.GetAccounts(users[(i+w)%len(users)])
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Every point added is either still in an account or was returned by a spend
+	total := 0
+	for _, userID := range users {
+		balance := 0
+		for _, account := range service.GetAccounts(userID) {
+			balance += account.Points
+		}
+		total += balance + spent[userID]
+	}
+	assert.Equal(t, workers*iterations*10, total)
+}
+
+func TestPointService_concurrent_spends_cannot_overdraw(t *testing.T) {
+	const (
+		workers    = 20
+		balance    = 1000
+		spend      = 100
+		adjustment = 50
+	)
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+
+	err := service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: balance})
+	assert.NoError(t, err)
+
+	var (
+		wg          sync.WaitGroup
+		spends      int32
+		adjustments int32
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := service.SpendPoints(userID, spend, nil); err == nil {
+				atomic.AddInt32(&spends, 1)
+			}
+		}()
+		// Negative adjustments race with the spends for the same points
+		go func() {
+			defer wg.Done()
+			err := service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: -adjustment})
+			if err == nil {
+				atomic.AddInt32(&adjustments, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, account := range service.GetAccounts(userID) {
+		total += account.Points
+	}
+	assert.GreaterOrEqual(t, total, 0)
+	assert.Equal(t, balance-int(spends)*spend-int(adjustments)*adjustment, total)
+}
@@ -18,6 +18,9 @@ func TestSpendPoints(t *testing.T) {
 		points      int
 		expected    []model.Transaction
 		errExpected bool
+		// expectedByStrategy holds the expected transactions for strategies other than FIFO.
+		// Strategies without an entry are only checked against the invariants.
+		expectedByStrategy map[string][]model.Transaction
 	}
 
 	// Create test cases
@@ -30,6 +33,28 @@ func TestSpendPoints(t *testing.T) {
 				{Payer: "UNILEVER", Points: -200},
 				{Payer: "MILLER COORS", Points: -4700},
 			},
+			expectedByStrategy: map[string][]model.Transaction{
+				services.StrategyLIFO: {
+					{Payer: "DANNON", Points: -1000},
+					{Payer: "MILLER COORS", Points: -4000},
+				},
+				services.StrategyPayerPriority: {
+					{Payer: "UNILEVER", Points: -200},
+					{Payer: "DANNON", Points: -1100},
+					{Payer: "MILLER COORS", Points: -3700},
+				},
+				services.StrategyProportional: {
+					{Payer: "DANNON", Points: -487},
+					{Payer: "UNILEVER", Points: -88},
+					{Payer: "MILLER COORS", Points: -4425},
+				},
+				// No payer has an expiration policy, so every lot expires equally late
+				services.StrategySoonestToExpire: {
+					{Payer: "DANNON", Points: -100},
+					{Payer: "UNILEVER", Points: -200},
+					{Payer: "MILLER COORS", Points: -4700},
+				},
+			},
 		},
 		"Single transaction": {
 			input: []model.Transaction{
@@ -46,6 +71,17 @@ func TestSpendPoints(t *testing.T) {
 			expected:    []model.Transaction{},
 			errExpected: true,
 		},
+		"Negative adjustment dated before the lot it drains": {
+			input: []model.Transaction{
+				{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-01T14:00:00Z")},
+				{Payer: "UNILEVER", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")},
+				{Payer: "DANNON", Points: -100, Timestamp: test.ParseTime("2020-10-31T14:00:00Z")},
+			},
+			points: 100,
+			expected: []model.Transaction{
+				{Payer: "UNILEVER", Points: -100},
+			},
+		},
 		"Insufficient points returns error": {
 			input: []model.Transaction{
 				{Payer: "DANNON", Points: 1000},
@@ -56,32 +92,167 @@ func TestSpendPoints(t *testing.T) {
 		},
 	}
 
-	// Execute tests
+	// Execute tests, checking every strategy against the same invariants
 	for name, tc := range tests {
-		t.Run(name, func(t *testing.T) {
-			userID := "1"
-			database := db.NewInMemoryDB()
-			service := services.NewPointService(database)
+		for _, strategyName := range strategyNames {
+			t.Run(name+"/"+strategyName, func(t *testing.T) {
+				userID := "1"
+				database := db.NewInMemoryDB()
+				service := services.NewPointService(database)
 
-			for _, transaction := range tc.input {
-				err := service.AddPoints(userID, transaction)
-				assert.NoError(t, err)
-			}
+				for _, transaction := range tc.input {
+					err := service.AddPoints(userID, transaction)
+					assert.NoError(t, err)
+				}
+				balanceBefore := totalPoints(service.GetAccounts(userID))
 
-			actual, err := service.SpendPoints(userID, tc.points)
-			if tc.errExpected {
-				assert.Error(t, err)
-			} else {
+				strategy, err := services.NewSpendStrategy(strategyName, []string{"UNILEVER", "DANNON"})
 				assert.NoError(t, err)
-			}
-			assert.Equal(t, len(actual), len(tc.expected))
+				actual, err := service.SpendPoints(userID, tc.points, strategy)
 
-			for i := range actual {
-				assert.Equal(t, actual[i].Payer, tc.expected[i].Payer)
-				assert.Equal(t, actual[i].Points, tc.expected[i].Points)
-			}
-		})
+				// Invariants shared by every strategy
+				if tc.errExpected {
+					assert.Error(t, err)
+					assert.Empty(t, actual)
+					assert.Equal(t, balanceBefore, totalPoints(service.GetAccounts(userID)))
+				} else {
+					assert.NoError(t, err)
+					assert.Equal(t, -tc.points, totalPoints(transactionAccounts(actual)))
+					assert.Equal(t, balanceBefore-tc.points, totalPoints(service.GetAccounts(userID)))
+					payers := make(map[string]bool)
+					for _, tran := range actual {
+						assert.Less(t, tran.Points, 0)
+						assert.False(t, payers[tran.Payer], "one transaction per payer")
+						payers[tran.Payer] = true
+					}
+					for _, account := range service.GetAccounts(userID) {
+						assert.GreaterOrEqual(t, account.Points, 0)
+					}
+				}
+
+				expected, ok := tc.expectedByStrategy[strategyName]
+				if strategyName == services.StrategyFIFO {
+					expected, ok = tc.expected, true
+				}
+				if !ok {
+					return
+				}
+				assert.Equal(t, len(actual), len(expected))
+				for i := range actual {
+					assert.Equal(t, actual[i].Payer, expected[i].Payer)
+					assert.Equal(t, actual[i].Points, expected[i].Points)
+				}
+			})
+		}
+	}
+}
+
+var strategyNames = []string{
+	services.StrategyFIFO,
+	services.StrategyLIFO,
+	services.StrategyPayerPriority,
+	services.StrategyProportional,
+	services.StrategySoonestToExpire,
+}
+
+func TestSpendPoints_soonest_to_expire(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Clock = test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+	service.ExpirationPolicies["DANNON"] = services.ExpireAfterMonths{Months: 1}
+	service.ExpirationPolicies["MILLER COORS"] = services.ExpireEndOfQuarter{}
+
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+
+	transactions, err := service.SpendPoints(userID, 5000, services.SoonestToExpireStrategy{})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 2)
+	assert.Equal(t, "DANNON", transactions[0].Payer)
+	assert.Equal(t, -1100, transactions[0].Points)
+	assert.Equal(t, "MILLER COORS", transactions[1].Payer)
+	assert.Equal(t, -3900, transactions[1].Points)
+}
+
+func TestSpendPoints_default_strategy(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.DefaultStrategy = services.LIFOStrategy{}
+
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+
+	transactions, err := service.SpendPoints(userID, 500, nil)
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, "DANNON", transactions[0].Payer)
+}
+
+func TestPreviewSpend(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Clock = test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+	service.ExpirationPolicies["MILLER COORS"] = services.ExpireEndOfQuarter{}
+
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+
+	preview, err := service.PreviewSpend(userID, 300, services.LIFOStrategy{})
+	assert.NoError(t, err)
+	assert.Len(t, preview.Transactions, 1)
+	assert.Equal(t, "DANNON", preview.Transactions[0].Payer)
+	assert.Equal(t, -300, preview.Transactions[0].Points)
+	assert.Empty(t, preview.Transactions[0].ID)
+	assert.Equal(t, 800, pointsFor(preview.Balances, "DANNON"))
+
+	// The preview matches the real spend, and wrote nothing itself
+	assert.Len(t, database.GetTransactions(userID), len(test.Data))
+	transactions, err := service.SpendPoints(userID, 300, services.LIFOStrategy{})
+	assert.NoError(t, err)
+	assert.Equal(t, preview.Transactions[0].Points, transactions[0].Points)
+	assert.Equal(t, preview.Balances, service.GetAccounts(userID))
+
+	_, err = service.PreviewSpend(userID, 0, nil)
+	assert.Error(t, err)
+}
+
+func TestNewSpendStrategy_errors(t *testing.T) {
+	_, err := services.NewSpendStrategy("random", nil)
+	assert.Error(t, err)
+
+	_, err = services.NewSpendStrategy(services.StrategyPayerPriority, nil)
+	assert.Error(t, err)
+}
+
+func TestPayerPriorityStrategy_canonical_payers(t *testing.T) {
+	lots := []model.Lot{
+		{ID: "1", Payer: "DANNON", Points: 100, Remaining: 100},
+		{ID: "2", Payer: "MILLER COORS", Points: 100, Remaining: 100},
+	}
+	allocations := services.PayerPriorityStrategy{Payers: []string{"Miller  Coors"}}.Allocate(lots, 50)
+	assert.Equal(t, []model.Allocation{{LotID: "2", Payer: "MILLER COORS", Points: 50}}, allocations)
+}
+
+func totalPoints(accounts []model.Account) int {
+	pointSum := 0
+	for _, account := range accounts {
+		pointSum += account.Points
+	}
+	return pointSum
+}
+
+func transactionAccounts(transactions []model.Transaction) []model.Account {
+	accounts := make([]model.Account, 0, len(transactions))
+	for _, tran := range transactions {
+		accounts = append(accounts, model.Account{Payer: tran.Payer, Points: tran.Points})
 	}
+	return accounts
 }
 
 func TestSpendPoints_multiple_calls_exhaust_points(t *testing.T) {
@@ -97,14 +268,77 @@ func TestSpendPoints_multiple_calls_exhaust_points(t *testing.T) {
 	err := service.AddPoints(userID, transaction)
 	assert.NoError(t, err)
 
-	transactions, err := service.SpendPoints(userID, 200)
+	transactions, err := service.SpendPoints(userID, 200, nil)
 	assert.NoError(t, err)
 	assert.Len(t, transactions, 1)
 
-	_, err = service.SpendPoints(userID, 200)
+	_, err = service.SpendPoints(userID, 200, nil)
 	assert.Error(t, err)
 }
 
+func TestSpendPoints_consumed_lots_are_not_reused(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+
+	for _, tran := range []model.Transaction{
+		{Payer: "DANNON", Points: 500, Timestamp: test.ParseTime("2020-11-01T14:00:00Z")},
+		{Payer: "UNILEVER", Points: 500, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")},
+	} {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+
+	transactions, err := service.SpendPoints(userID, 300, nil)
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, -300, transactions[0].Points)
+
+	transactions, err = service.SpendPoints(userID, 300, nil)
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 2)
+	assert.Equal(t, "DANNON", transactions[0].Payer)
+	assert.Equal(t, -200, transactions[0].Points)
+	assert.Equal(t, "UNILEVER", transactions[1].Payer)
+	assert.Equal(t, -100, transactions[1].Points)
+}
+
+func TestGetSpend(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+
+	for _, tran := range test.Data {
+		assert.NoError(t, service.AddPoints(userID, tran))
+	}
+	transactions, err := service.SpendPoints(userID, 5000, nil)
+	assert.NoError(t, err)
+	spendID := transactions[0].SpendID
+	assert.NotEmpty(t, spendID)
+
+	spend, found := service.GetSpend(userID, spendID)
+	assert.True(t, found)
+	assert.Equal(t, spendID, spend.ID)
+	assert.Equal(t, 5000, spend.Points)
+	assert.Len(t, spend.Transactions, 3)
+
+	// The DANNON adjustment of -200 already drained 200 of the oldest DANNON lot
+	assert.Len(t, spend.Funding, 3)
+	assert.Equal(t, "DANNON", spend.Funding[0].Lot.Payer)
+	assert.Equal(t, 300, spend.Funding[0].Lot.Points)
+	assert.Equal(t, 0, spend.Funding[0].Lot.Remaining)
+	assert.Equal(t, 100, spend.Funding[0].Points)
+	assert.Equal(t, "UNILEVER", spend.Funding[1].Lot.Payer)
+	assert.Equal(t, 200, spend.Funding[1].Points)
+	assert.Equal(t, "MILLER COORS", spend.Funding[2].Lot.Payer)
+	assert.Equal(t, 4700, spend.Funding[2].Points)
+	assert.Equal(t, 5300, spend.Funding[2].Lot.Remaining)
+
+	_, found = service.GetSpend(userID, "unknown")
+	assert.False(t, found)
+	_, found = service.GetSpend("2", spendID)
+	assert.False(t, found)
+}
+
 func TestAddPoints(t *testing.T) {
 	userID := "1"
 	database := db.NewInMemoryDB()
@@ -132,3 +366,136 @@ func TestAddPoints(t *testing.T) {
 	err = service.AddPoints(userID, tran)
 	assert.Error(t, err)
 }
+
+func TestAddPoints_types_and_metadata(t *testing.T) {
+	userID := "1"
+	clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Clock = clock
+
+	metadata := map[string]string{"store": "42"}
+	err := service.AddPoints(userID, model.Transaction{
+		Payer:     "DANNON",
+		Points:    1000,
+		Timestamp: test.ParseTime("2020-11-02T14:00:00Z"),
+		Reference: "receipt-1",
+		Metadata:  metadata,
+	})
+	assert.NoError(t, err)
+	metadata["store"] = "changed"
+	assert.NoError(t, service.AddPoints(userID, model.Transaction{Payer: "DANNON", Points: -100, Timestamp: clock.Now()}))
+	assert.NoError(t, service.AddPoints(userID, model.Transaction{Type: model.TransactionTransfer, Payer: "DANNON", Points: 50, Timestamp: clock.Now()}))
+
+	transactions, err := service.SpendPoints(userID, 100, nil)
+	assert.NoError(t, err)
+	_, err = service.ReverseSpend(userID, transactions[0].SpendID, 0)
+	assert.NoError(t, err)
+
+	ledger := database.GetTransactions(userID)
+	types := make([]model.TransactionType, 0, len(ledger))
+	for _, tran := range ledger {
+		assert.NotEmpty(t, tran.ID)
+		assert.Equal(t, clock.Now(), tran.CreatedAt)
+		types = append(types, tran.Type)
+	}
+	assert.Equal(t, []model.TransactionType{
+		model.TransactionEarn,
+		model.TransactionAdjustment,
+		model.TransactionTransfer,
+		model.TransactionSpend,
+		model.TransactionReversal,
+	}, types)
+	assert.Equal(t, "receipt-1", ledger[0].Reference)
+	assert.Equal(t, map[string]string{"store": "42"}, ledger[0].Metadata)
+
+	page, err := service.ListTransactions(userID, services.TransactionQuery{Reference: "receipt-1"})
+	assert.NoError(t, err)
+	assert.Len(t, page.Transactions, 1)
+	page, err = service.ListTransactions(userID, services.TransactionQuery{Type: model.TransactionSpend})
+	assert.NoError(t, err)
+	assert.Len(t, page.Transactions, 1)
+
+	tests := map[string]model.Transaction{
+		"negative earn":       {Type: model.TransactionEarn, Payer: "DANNON", Points: -1},
+		"positive adjustment": {Type: model.TransactionAdjustment, Payer: "DANNON", Points: 1},
+		"service only type":   {Type: model.TransactionSpend, Payer: "DANNON", Points: -1},
+		"unknown type":        {Type: "gift", Payer: "DANNON", Points: 1},
+	}
+	for name, tran := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, service.AddPoints(userID, tran))
+		})
+	}
+}
+
+func TestWithRequestID_retries_are_applied_once(t *testing.T) {
+	userID := "1"
+	database := db.NewInMemoryDB()
+	service := services.NewPointService(database)
+	service.Budgets = services.NewBudgetLedger(database)
+	_, err := service.Budgets.Fund("DANNON", 1000)
+	assert.NoError(t, err)
+
+	// Each operation is run twice under its own request ID, as a retry of it would be
+	earn := model.Transaction{Payer: "DANNON", Points: 500, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}
+	var spendID, holdID, voidID string
+	tests := []struct {
+		name      string
+		run       func(keyed *services.PointService) (interface{}, error)
+		written   int
+		remaining int
+	}{
+		{"add points", func(keyed *services.PointService) (interface{}, error) {
+			return nil, keyed.AddPoints(userID, earn)
+		}, 1, 500},
+		{"fund", func(keyed *services.PointService) (interface{}, error) {
+			return keyed.Budgets.WithRequestID("fund").Fund("DANNON", 100)
+		}, 0, 600},
+		{"spend", func(keyed *services.PointService) (interface{}, error) {
+			transactions, err := keyed.SpendPoints(userID, 100, nil)
+			if err == nil {
+				spendID = transactions[0].SpendID
+			}
+			return transactions, err
+		}, 1, 600},
+		{"reverse", func(keyed *services.PointService) (interface{}, error) {
+			return keyed.ReverseSpend(userID, spendID, 50)
+		}, 1, 600},
+		{"authorize hold", func(keyed *services.PointService) (interface{}, error) {
+			hold, err := keyed.AuthorizeHold(userID, 100, nil)
+			holdID = hold.ID
+			return hold, err
+		}, 0, 600},
+		{"capture hold", func(keyed *services.PointService) (interface{}, error) {
+			return keyed.CaptureHold(userID, holdID)
+		}, 1, 600},
+		{"void hold", func(keyed *services.PointService) (interface{}, error) {
+			if voidID == "" {
+				// Authorized without a request ID, so only the void is retried
+				hold, err := service.AuthorizeHold(userID, 100, nil)
+				if err != nil {
+					return nil, err
+				}
+				voidID = hold.ID
+			}
+			return keyed.VoidHold(userID, voidID)
+		}, 0, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyed := service.WithRequestID(tt.name)
+			before := len(database.GetTransactions(userID))
+
+			first, err := tt.run(keyed)
+			assert.NoError(t, err)
+			retry, err := tt.run(keyed)
+			assert.NoError(t, err)
+
+			assert.Equal(t, first, retry)
+			assert.Len(t, database.GetTransactions(userID), before+tt.written)
+			budget, _ := database.GetBudget("DANNON")
+			assert.Equal(t, tt.remaining, budget.Remaining)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package services
+
+import "fetchrewards.com/points-api/internal/model"
+
+// ErrSpendNotFound is returned when reversing a spend the user does not have
+var ErrSpendNotFound = newError(ErrNotFound, "spend_not_found", "spend not found")
+
+// ReverseSpend gives back points consumed by the spend with the given ID, for example when the
+// order it paid for is cancelled. The points are returned to the lots the spend drew them
+// from, so they keep their original expiry, with one positive transaction written per payer.
+// A points value of 0 reverses everything not reversed yet. A spend can be reversed in several
+// parts, the points drawn last being returned first, but never by more than it spent.
+func (s *PointService) ReverseSpend(userID, spendID string, points int) ([]model.Transaction, error) {
+	if points < 0 {
+		return []model.Transaction{}, errPointsNotPositive
+	}
+
+	var newTransactions []model.Transaction
+	err := s.DB.UpdateLedger(userID, func(ledger model.Ledger) (model.Ledger, error) {
+		if written, ok := s.written(ledger); ok {
+			newTransactions = written.Transactions
+			return model.Ledger{}, nil
+		}
+		outstanding, err := outstandingAllocations(ledger, spendID)
+		if err != nil {
+			return model.Ledger{}, err
+		}
+
+		reversible := 0
+		for _, allocation := range outstanding {
+			reversible += allocation.Points
+		}
+		toReverse := points
+		if toReverse == 0 {
+			toReverse = reversible
+		}
+		if toReverse == 0 {
+			return model.Ledger{}, newError(ErrConflict, "spend_reversed", "the spend has already been reversed")
+		}
+		if toReverse > reversible {
+			return model.Ledger{}, newError(ErrInvalidAmount, "invalid_amount", "only %d points of the spend can be reversed", reversible)
+		}
+
+		// Return the points drawn last first
+		allocations := make([]model.Allocation, 0)
+		for i := len(outstanding) - 1; i >= 0 && toReverse > 0; i-- {
+			returned := outstanding[i].Points
+			if returned > toReverse {
+				returned = toReverse
+			}
+			toReverse -= returned
+			allocations = append(allocations, model.Allocation{
+				LotID:  outstanding[i].LotID,
+				Payer:  outstanding[i].Payer,
+				Points: -returned,
+			})
+		}
+
+		now := s.Clock.Now()
+		newTransactions = transactionsForAllocations(allocations, model.Transaction{
+			Type:       model.TransactionReversal,
+			Timestamp:  now,
+			CreatedAt:  now,
+			ReversalOf: spendID,
+			RequestID:  s.requestID,
+		})
+		return model.Ledger{Transactions: newTransactions, Allocations: allocations}, nil
+	})
+	if err != nil {
+		return []model.Transaction{}, err
+	}
+	return newTransactions, nil
+}
+
+// outstandingAllocations returns the allocations of the spend, in the order they were drawn,
+// less the points given back by earlier reversals. Allocations that have been reversed in full
+// are left out.
+func outstandingAllocations(ledger model.Ledger, spendID string) ([]model.Allocation, error) {
+	spendTransactions := make(map[string]bool)
+	reversalTransactions := make(map[string]bool)
+	for _, tran := range ledger.Transactions {
+		switch {
+		case tran.SpendID == spendID:
+			spendTransactions[tran.ID] = true
+		case tran.ReversalOf == spendID:
+			reversalTransactions[tran.ID] = true
+		}
+	}
+	if len(spendTransactions) == 0 {
+		return nil, ErrSpendNotFound
+	}
+
+	spent := make([]model.Allocation, 0)
+	reversed := make(map[string]int)
+	for _, allocation := range ledger.Allocations {
+		switch {
+		case spendTransactions[allocation.TransactionID]:
+			spent = append(spent, allocation)
+		case reversalTransactions[allocation.TransactionID]:
+			reversed[allocation.LotID] -= allocation.Points
+		}
+	}
+
+	// Earlier reversals returned the points drawn last first, so take them off from the end
+	outstanding := make([]model.Allocation, len(spent))
+	for i := len(spent) - 1; i >= 0; i-- {
+		allocation := spent[i]
+		taken := reversed[allocation.LotID]
+		if taken > allocation.Points {
+			taken = allocation.Points
+		}
+		reversed[allocation.LotID] -= taken
+		allocation.Points -= taken
+		outstanding[i] = allocation
+	}
+
+	result := make([]model.Allocation, 0, len(outstanding))
+	for _, allocation := range outstanding {
+		if allocation.Points > 0 {
+			result = append(result, allocation)
+		}
+	}
+	return result, nil
+}
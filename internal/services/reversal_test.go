@@ -0,0 +1,119 @@
+package services_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fetchrewards.com/points-api/internal/db"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"fetchrewards.com/points-api/internal/test"
+)
+
+func TestReverseSpend(t *testing.T) {
+	userID := "1"
+	setup := func(t *testing.T) (*services.PointService, string) {
+		service := services.NewPointService(db.NewInMemoryDB())
+		for _, tran := range test.Data {
+			assert.NoError(t, service.AddPoints(userID, tran))
+		}
+		// Spends 100 DANNON, 200 UNILEVER and 4700 MILLER COORS
+		transactions, err := service.SpendPoints(userID, 5000, nil)
+		assert.NoError(t, err)
+		return service, transactions[0].SpendID
+	}
+
+	t.Run("full reversal returns the points to the same lots", func(t *testing.T) {
+		service, spendID := setup(t)
+		original, _ := service.GetSpend(userID, spendID)
+
+		reversals, err := service.ReverseSpend(userID, spendID, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 5000, totalPoints(transactionAccounts(reversals)))
+		for _, tran := range reversals {
+			assert.Equal(t, spendID, tran.ReversalOf)
+			assert.NotEmpty(t, tran.ID)
+		}
+
+		accounts := service.GetAccounts(userID)
+		assert.Equal(t, 1100, pointsFor(accounts, "DANNON"))
+		assert.Equal(t, 200, pointsFor(accounts, "UNILEVER"))
+		assert.Equal(t, 10000, pointsFor(accounts, "MILLER COORS"))
+
+		// Spending again draws from exactly the lots the first spend drew from
+		transactions, err := service.SpendPoints(userID, 5000, nil)
+		assert.NoError(t, err)
+		again, _ := service.GetSpend(userID, transactions[0].SpendID)
+		assert.Len(t, again.Funding, len(original.Funding))
+		for i := range original.Funding {
+			assert.Equal(t, original.Funding[i].Lot.ID, again.Funding[i].Lot.ID)
+			assert.Equal(t, original.Funding[i].Points, again.Funding[i].Points)
+		}
+
+		spend, _ := service.GetSpend(userID, spendID)
+		assert.Equal(t, 5000, spend.Reversed)
+		assert.Len(t, spend.Reversals, 3)
+	})
+
+	t.Run("partial reversals return the points drawn last first", func(t *testing.T) {
+		service, spendID := setup(t)
+
+		reversals, err := service.ReverseSpend(userID, spendID, 300)
+		assert.NoError(t, err)
+		assert.Equal(t, []model.Account{{Payer: "MILLER COORS", Points: 300}}, transactionAccounts(reversals))
+
+		reversals, err = service.ReverseSpend(userID, spendID, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []model.Account{
+			{Payer: "MILLER COORS", Points: 4400},
+			{Payer: "UNILEVER", Points: 200},
+			{Payer: "DANNON", Points: 100},
+		}, transactionAccounts(reversals))
+		assert.Equal(t, 11300, totalPoints(service.GetAccounts(userID)))
+	})
+
+	t.Run("cannot reverse more than was spent", func(t *testing.T) {
+		service, spendID := setup(t)
+
+		_, err := service.ReverseSpend(userID, spendID, 5001)
+		assert.Error(t, err)
+
+		_, err = service.ReverseSpend(userID, spendID, 4000)
+		assert.NoError(t, err)
+		_, err = service.ReverseSpend(userID, spendID, 1001)
+		assert.Error(t, err)
+		_, err = service.ReverseSpend(userID, spendID, 1000)
+		assert.NoError(t, err)
+		_, err = service.ReverseSpend(userID, spendID, 0)
+		assert.Error(t, err)
+		assert.Equal(t, 11300, totalPoints(service.GetAccounts(userID)))
+	})
+
+	t.Run("unknown spends are not found", func(t *testing.T) {
+		service, spendID := setup(t)
+
+		_, err := service.ReverseSpend(userID, "unknown", 0)
+		assert.Equal(t, services.ErrSpendNotFound, err)
+		_, err = service.ReverseSpend("2", spendID, 0)
+		assert.Equal(t, services.ErrSpendNotFound, err)
+	})
+
+	t.Run("returned points keep their original expiry", func(t *testing.T) {
+		clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+		service := services.NewPointService(db.NewInMemoryDB())
+		service.Clock = clock
+		service.ExpirationPolicies["DANNON"] = services.ExpireEndOfQuarter{}
+		for _, tran := range test.Data {
+			assert.NoError(t, service.AddPoints(userID, tran))
+		}
+		transactions, err := service.SpendPoints(userID, 5000, nil)
+		assert.NoError(t, err)
+
+		clock.Set(test.ParseTime("2021-01-01T00:00:00Z"))
+		_, err = service.ReverseSpend(userID, transactions[0].SpendID, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, pointsFor(service.GetAccounts(userID), "DANNON"))
+		assert.Equal(t, 10000, pointsFor(service.GetAccounts(userID), "MILLER COORS"))
+	})
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"sort"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+// Names of the spend strategies understood by NewSpendStrategy
+const (
+	StrategyFIFO            = "fifo"
+	StrategyLIFO            = "lifo"
+	StrategyPayerPriority   = "payer-priority"
+	StrategyProportional    = "proportional"
+	StrategySoonestToExpire = "soonest-to-expire"
+)
+
+// SpendStrategy decides which lots a spend draws its points from
+type SpendStrategy interface {
+	// Allocate returns allocations, without a TransactionID, drawing exactly points from the
+	// given lots. The lots are the ones that may be spent, oldest first, each with some
+	// points remaining, and together they hold at least the points requested. Allocate must
+	// not modify the lots.
+	Allocate(lots []model.Lot, points int) []model.Allocation
+}
+
+// NewSpendStrategy returns the SpendStrategy with the given name. payerPriority is only used
+// by the payer-priority strategy and lists the payers to spend first, in order.
+func NewSpendStrategy(name string, payerPriority []string) (SpendStrategy, error) {
+	switch name {
+	case StrategyFIFO:
+		return FIFOStrategy{}, nil
+	case StrategyLIFO:
+		return LIFOStrategy{}, nil
+	case StrategyPayerPriority:
+		if len(payerPriority) == 0 {
+			return nil, newError(ErrInvalidRequest, "invalid_strategy", "the %s strategy requires at least one payer", StrategyPayerPriority)
+		}
+		return PayerPriorityStrategy{Payers: payerPriority}, nil
+	case StrategyProportional:
+		return ProportionalStrategy{}, nil
+	case StrategySoonestToExpire:
+		return SoonestToExpireStrategy{}, nil
+	default:
+		return nil, newError(ErrInvalidRequest, "invalid_strategy", "unknown spend strategy %q", name)
+	}
+}
+
+// FIFOStrategy spends the oldest lots first, across all payers
+type FIFOStrategy struct{}
+
+// Allocate implements SpendStrategy
+func (FIFOStrategy) Allocate(lots []model.Lot, points int) []model.Allocation {
+	return drawInOrder(lots, points, func(a, b model.Lot) bool {
+		return a.Timestamp.Before(b.Timestamp)
+	})
+}
+
+// LIFOStrategy spends the newest lots first, across all payers
+type LIFOStrategy struct{}
+
+// Allocate implements SpendStrategy
+func (LIFOStrategy) Allocate(lots []model.Lot, points int) []model.Allocation {
+	return drawInOrder(lots, points, func(a, b model.Lot) bool {
+		return a.Timestamp.After(b.Timestamp)
+	})
+}
+
+// PayerPriorityStrategy spends the lots of the listed payers first, in the order listed,
+// and then the lots of every other payer. Lots are spent oldest first within each payer.
+// Payers are matched by their canonical ID, so "Dannon" lists the lots of DANNON.
+type PayerPriorityStrategy struct {
+	Payers []string
+}
+
+// Allocate implements SpendStrategy
+func (p PayerPriorityStrategy) Allocate(lots []model.Lot, points int) []model.Allocation {
+	rank := make(map[string]int)
+	for i, payer := range p.Payers {
+		payer = CanonicalPayerID(payer)
+		if _, ok := rank[payer]; !ok {
+			rank[payer] = i
+		}
+	}
+	rankOf := func(lot model.Lot) int {
+		if r, ok := rank[lot.Payer]; ok {
+			return r
+		}
+		return len(p.Payers)
+	}
+
+	return drawInOrder(lots, points, func(a, b model.Lot) bool {
+		return rankOf(a) < rankOf(b)
+	})
+}
+
+// ProportionalStrategy splits a spend across payers in proportion to each payer's spendable
+// balance, using the largest remainder method to hand out points left over by rounding. Lots
+// are spent oldest first within each payer.
+type ProportionalStrategy struct{}
+
+// Allocate implements SpendStrategy
+func (ProportionalStrategy) Allocate(lots []model.Lot, points int) []model.Allocation {
+	balances := make(map[string]int)
+	payers := make([]string, 0)
+	total := 0
+	for _, lot := range lots {
+		if _, ok := balances[lot.Payer]; !ok {
+			payers = append(payers, lot.Payer)
+		}
+		balances[lot.Payer] += lot.Remaining
+		total += lot.Remaining
+	}
+
+	// Each payer's exact share is points*balance/total. Give every payer the whole part and
+	// then one more point to the payers with the largest fractional parts.
+	shares := make(map[string]int)
+	fractions := make(map[string]int)
+	distributed := 0
+	for _, payer := range payers {
+		product := points * balances[payer]
+		shares[payer] = product / total
+		fractions[payer] = product % total
+		distributed += shares[payer]
+	}
+	byFraction := make([]string, len(payers))
+	copy(byFraction, payers)
+	sort.SliceStable(byFraction, func(i, j int) bool {
+		return fractions[byFraction[i]] > fractions[byFraction[j]]
+	})
+	for i := 0; distributed < points; i++ {
+		shares[byFraction[i]]++
+		distributed++
+	}
+
+	working := copyLots(lots)
+	allocations := make([]model.Allocation, 0)
+	for _, payer := range payers {
+		allocations = append(allocations, drawLots(working, shares[payer], payerLots(payer))...)
+	}
+	return allocations
+}
+
+// SoonestToExpireStrategy spends the lots that expire soonest first, followed by the lots
+// that never expire. Lots that expire at the same time are spent oldest first.
+type SoonestToExpireStrategy struct{}
+
+// Allocate implements SpendStrategy
+func (SoonestToExpireStrategy) Allocate(lots []model.Lot, points int) []model.Allocation {
+	return drawInOrder(lots, points, func(a, b model.Lot) bool {
+		if a.ExpiresAt == nil || b.ExpiresAt == nil {
+			return a.ExpiresAt != nil && b.ExpiresAt == nil
+		}
+		return a.ExpiresAt.Before(*b.ExpiresAt)
+	})
+}
+
+// drawInOrder draws points from the lots sorted by less. The sort is stable, so lots that
+// less considers equal keep their oldest first order.
+func drawInOrder(lots []model.Lot, points int, less func(a, b model.Lot) bool) []model.Allocation {
+	ordered := copyLots(lots)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return less(ordered[i], ordered[j])
+	})
+	return drawLots(ordered, points, anyLot)
+}
+
+func copyLots(lots []model.Lot) []model.Lot {
+	result := make([]model.Lot, len(lots))
+	copy(result, lots)
+	return result
+}
+
+// anyLot accepts every lot
+func anyLot(model.Lot) bool {
+	return true
+}
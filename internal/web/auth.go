@@ -0,0 +1,209 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"fetchrewards.com/points-api/internal/services"
+	"github.com/gorilla/mux"
+)
+
+// APIKeyHeader is the request header clients send their API key in
+const APIKeyHeader = "X-API-Key"
+
+// Scope is a permission granted to an API key
+type Scope string
+
+// The scopes an API key can be granted. ScopeAdmin grants every other scope as well.
+const (
+	ScopeEarn  Scope = "points:earn"
+	ScopeSpend Scope = "points:spend"
+	ScopeRead  Scope = "read"
+	ScopeAdmin Scope = "admin"
+)
+
+// Codes of authentication problems
+const (
+	codeUnauthenticated   = "unauthenticated"
+	codeInsufficientScope = "insufficient_scope"
+	codePayerNotAllowed   = "payer_not_allowed"
+)
+
+// APIKey describes a client allowed to use the API. Only the SHA-256 hash of the key is kept.
+// A key restricted to a Payer can only add points for that payer.
+type APIKey struct {
+	ID     string  `json:"id"`
+	Hash   string  `json:"hash"`
+	Scopes []Scope `json:"scopes"`
+	Payer  string  `json:"payer,omitempty"`
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of an API key, as stored in APIKey.Hash
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadAPIKeys reads the JSON array of APIKeys in the file at path
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return keys, validateAPIKeys(keys)
+}
+
+func validateAPIKeys(keys []APIKey) error {
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.ID == "" {
+			return fmt.Errorf("API key with hash %s has no id", key.Hash)
+		}
+		if _, err := hex.DecodeString(key.Hash); err != nil || len(key.Hash) != sha256.Size*2 {
+			return fmt.Errorf("API key %s must have a hex encoded SHA-256 hash", key.ID)
+		}
+		if seen[strings.ToLower(key.Hash)] {
+			return fmt.Errorf("API key %s has the same hash as another key", key.ID)
+		}
+		seen[strings.ToLower(key.Hash)] = true
+		for _, scope := range key.Scopes {
+			switch scope {
+			case ScopeEarn, ScopeSpend, ScopeRead, ScopeAdmin:
+			default:
+				return fmt.Errorf("API key %s has unknown scope %q", key.ID, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether the key was granted the scope
+func (k APIKey) allows(scope Scope) bool {
+	return grants(k.Scopes, scope)
+}
+
+// grants reports whether the scope is one of the granted scopes, or implied by one of them
+func grants(granted []Scope, scope Scope) bool {
+	for _, g := range granted {
+		if g == scope || g == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPayer reports whether the key may add points for the payer
+func (k APIKey) allowsPayer(payer string) bool {
+	return k.Payer == "" || services.CanonicalPayerID(k.Payer) == services.CanonicalPayerID(payer)
+}
+
+type clientKey struct{}
+
+type userKey struct{}
+
+// clientFrom returns the APIKey the request was authenticated with, if any
+func clientFrom(req *http.Request) (APIKey, bool) {
+	key, ok := req.Context().Value(clientKey{}).(APIKey)
+	return key, ok
+}
+
+// userFrom returns the ID of the user whose token the request was authenticated with, if any
+func userFrom(req *http.Request) (string, bool) {
+	userID, ok := req.Context().Value(userKey{}).(string)
+	return userID, ok
+}
+
+// callerID identifies who made the request, for keeping their idempotency keys apart. It is
+// empty when authentication is disabled.
+func callerID(req *http.Request) string {
+	if key, ok := clientFrom(req); ok {
+		return key.ID
+	}
+	if userID, ok := userFrom(req); ok {
+		return userIdempotencyID + userID
+	}
+	return ""
+}
+
+// authenticate rejects requests that carry neither a known API key nor a valid user token with
+// 401. The API key or user of the others is passed on in the request context. Every request is
+// let through when neither APIKeys nor UserTokenSecret is configured.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	byHash := apiKeysByHash(s.APIKeys)
+	if len(byHash) == 0 && len(s.UserTokenSecret) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if presented := req.Header.Get(APIKeyHeader); presented != "" {
+			key, ok := byHash[HashAPIKey(presented)]
+			if !ok {
+				writeProblem(w, req, http.StatusUnauthorized, codeUnauthenticated, "the "+APIKeyHeader+" is not valid")
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientKey{}, key)))
+			return
+		}
+
+		authorization := req.Header.Get("Authorization")
+		if len(s.UserTokenSecret) > 0 && strings.HasPrefix(authorization, bearerPrefix) {
+			claims, err := verifyUserToken(strings.TrimPrefix(authorization, bearerPrefix), s.UserTokenSecret, s.now(), s.TokenLeeway)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeProblem(w, req, http.StatusUnauthorized, codeInvalidToken, err.Error())
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userKey{}, claims.Subject)))
+			return
+		}
+
+		writeProblem(w, req, http.StatusUnauthorized, codeUnauthenticated, "an "+APIKeyHeader+" header or a bearer token is required")
+	})
+}
+
+// apiKeysByHash indexes the keys by their lower case hash
+func apiKeysByHash(keys []APIKey) map[string]APIKey {
+	byHash := make(map[string]APIKey, len(keys))
+	for _, key := range keys {
+		byHash[strings.ToLower(key.Hash)] = key
+	}
+	return byHash
+}
+
+// requireScope rejects requests whose API key was not granted the scope with 403. Users can
+// only make requests with one of the userScopes, and only for their own userID. Requests are
+// let through when authentication is disabled.
+func requireScope(scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if key, ok := clientFrom(req); ok && !key.allows(scope) {
+			writeProblem(w, req, http.StatusForbidden, codeInsufficientScope, fmt.Sprintf("the API key needs the %s scope", scope))
+			return
+		}
+		if userID, ok := userFrom(req); ok {
+			if !grants(userScopes, scope) {
+				writeProblem(w, req, http.StatusForbidden, codeInsufficientScope, fmt.Sprintf("user tokens do not grant the %s scope", scope))
+				return
+			}
+			pathUserID, found := mux.Vars(req)["userID"]
+			if !found {
+				writeProblem(w, req, http.StatusForbidden, codeInsufficientScope, "user tokens can only be used for user routes")
+				return
+			}
+			if pathUserID != userID {
+				writeProblem(w, req, http.StatusForbidden, codeUserMismatch, "user tokens can only be used for their own user")
+				return
+			}
+		}
+		next(w, req)
+	}
+}
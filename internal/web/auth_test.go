@@ -0,0 +1,166 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthentication(t *testing.T) {
+	keys := []APIKey{
+		{ID: "admin", Hash: HashAPIKey("admin-key"), Scopes: []Scope{ScopeAdmin}},
+		{ID: "dannon", Hash: HashAPIKey("dannon-key"), Scopes: []Scope{ScopeEarn}, Payer: "Dannon"},
+		{ID: "app", Hash: HashAPIKey("app-key"), Scopes: []Scope{ScopeRead, ScopeSpend}},
+	}
+	earn := func(payer string) model.Transaction {
+		return model.Transaction{Payer: payer, Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}
+	}
+
+	tests := map[string]struct {
+		key     string
+		method  string
+		url     string
+		payload interface{}
+		status  int
+		code    string
+	}{
+		"missing key": {
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			status: http.StatusUnauthorized,
+			code:   codeUnauthenticated,
+		},
+		"unknown key": {
+			key:    "guess",
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			status: http.StatusUnauthorized,
+			code:   codeUnauthenticated,
+		},
+		"read scope": {
+			key:    "app-key",
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			status: http.StatusOK,
+		},
+		"spend scope": {
+			key:     "app-key",
+			method:  "POST",
+			url:     "/v1/users/1/points/spend",
+			payload: spendPointsRequest{Points: 100},
+			status:  http.StatusPaymentRequired,
+		},
+		"missing earn scope": {
+			key:     "app-key",
+			method:  "POST",
+			url:     "/v1/users/1/points/add",
+			payload: earn("DANNON"),
+			status:  http.StatusForbidden,
+			code:    codeInsufficientScope,
+		},
+		"missing admin scope": {
+			key:     "app-key",
+			method:  "POST",
+			url:     "/v1/payers",
+			payload: model.Payer{ID: "DANNON"},
+			status:  http.StatusForbidden,
+			code:    codeInsufficientScope,
+		},
+		"partner adds its own points": {
+			key:     "dannon-key",
+			method:  "POST",
+			url:     "/v1/users/1/points/add",
+			payload: earn("DANNON "),
+			status:  http.StatusNoContent,
+		},
+		"partner adds another payer's points": {
+			key:     "dannon-key",
+			method:  "POST",
+			url:     "/v1/users/1/points/add",
+			payload: earn("UNILEVER"),
+			status:  http.StatusForbidden,
+			code:    codePayerNotAllowed,
+		},
+		"partner reads balances": {
+			key:    "dannon-key",
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			status: http.StatusForbidden,
+			code:   codeInsufficientScope,
+		},
+		"admin has every scope": {
+			key:     "admin-key",
+			method:  "POST",
+			url:     "/v1/users/1/points/add",
+			payload: earn("UNILEVER"),
+			status:  http.StatusNoContent,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			withEnv(t, func(env serverEnv) {
+				env.server.APIKeys = keys
+
+				resp := env.PerformRequestWithHeaders(tc.method, tc.url, tc.payload, map[string]string{APIKeyHeader: tc.key})
+				assert.Equal(t, tc.status, resp.StatusCode)
+				if tc.code != "" {
+					assert.Equal(t, tc.code, decodeProblem(t, resp).Code)
+				}
+			})
+		})
+	}
+}
+
+func TestAuthentication_idempotency_keys_are_per_client(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		env.server.APIKeys = []APIKey{
+			{ID: "a", Hash: HashAPIKey("a-key"), Scopes: []Scope{ScopeEarn}},
+			{ID: "b", Hash: HashAPIKey("b-key"), Scopes: []Scope{ScopeEarn}},
+		}
+		transaction := model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}
+
+		for _, key := range []string{"a-key", "b-key"} {
+			headers := map[string]string{APIKeyHeader: key, IdempotencyKeyHeader: "same"}
+			resp := env.PerformRequestWithHeaders("POST", "/v1/users/1/points/add", transaction, headers)
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get(idempotentReplayedHeader))
+		}
+		assert.Len(t, env.db.GetTransactions("1"), 2)
+	})
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	hash := HashAPIKey("secret")
+	keys, err := LoadAPIKeys(write("keys.json", `[{ "id": "dannon", "hash": "`+hash+`", "scopes": ["points:earn"], "payer": "DANNON" }]`))
+	assert.NoError(t, err)
+	assert.Equal(t, []APIKey{{ID: "dannon", Hash: hash, Scopes: []Scope{ScopeEarn}, Payer: "DANNON"}}, keys)
+
+	invalid := map[string]string{
+		"not json":       `{`,
+		"missing id":     `[{ "hash": "` + hash + `" }]`,
+		"plain text key": `[{ "id": "a", "hash": "secret" }]`,
+		"unknown scope":  `[{ "id": "a", "hash": "` + hash + `", "scopes": ["write"] }]`,
+		"duplicate hash": `[{ "id": "a", "hash": "` + hash + `" }, { "id": "b", "hash": "` + hash + `" }]`,
+	}
+	for name, content := range invalid {
+		_, err := LoadAPIKeys(write("invalid.json", content))
+		assert.Error(t, err, name)
+	}
+	_, err = LoadAPIKeys(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"github.com/gorilla/mux"
+)
+
+// payerBudgets is an abstraction for the budget ledger methods the web server depends on
+type payerBudgets interface {
+	GetBudget(payerID string) model.PayerBudget
+	GetEntries(payerID string) []model.BudgetEntry
+	Fund(payerID string, points int) (model.PayerBudget, error)
+	SetCaps(payerID string, caps services.BudgetCaps) (model.PayerBudget, error)
+	WithRequestID(requestID string) *services.BudgetLedger
+}
+
+type fundBudgetRequest struct {
+	Points int `json:"points"`
+}
+
+func (s *Server) getBudgetHandler(w http.ResponseWriter, req *http.Request) {
+	payerID, ok := s.registeredPayer(w, req)
+	if !ok {
+		return
+	}
+	budget := s.budgets.GetBudget(payerID)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(budget)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) listBudgetEntriesHandler(w http.ResponseWriter, req *http.Request) {
+	payerID, ok := s.registeredPayer(w, req)
+	if !ok {
+		return
+	}
+	entries := s.budgets.GetEntries(payerID)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) fundBudgetHandler(w http.ResponseWriter, req *http.Request) {
+	payerID, ok := s.registeredPayer(w, req)
+	if !ok {
+		return
+	}
+
+	// Marshal request into a struct
+	fundBudgetRequest := fundBudgetRequest{}
+	if !decodeStrict(w, req, &fundBudgetRequest, noValidation) {
+		return
+	}
+
+	budget, err := s.budgetsFor(req).Fund(payerID, fundBudgetRequest.Points)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(budget)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) setBudgetCapsHandler(w http.ResponseWriter, req *http.Request) {
+	payerID, ok := s.registeredPayer(w, req)
+	if !ok {
+		return
+	}
+
+	// Marshal request into a struct
+	caps := services.BudgetCaps{}
+	if !decodeStrict(w, req, &caps, noValidation) {
+		return
+	}
+
+	budget, err := s.budgets.SetCaps(payerID, caps)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(budget)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+// registeredPayer returns the ID of the registered payer named in the request. It writes a
+// 404 response and returns false if the payer is not registered.
+func (s *Server) registeredPayer(w http.ResponseWriter, req *http.Request) (string, bool) {
+	payer, found := s.payers.GetPayer(mux.Vars(req)["payerID"])
+	if !found {
+		writeError(w, req, services.ErrPayerNotFound)
+		return "", false
+	}
+	return payer.ID, true
+}
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudgets(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		env.service.Budgets = env.budgets
+
+		resp := env.PerformRequest("POST", "/v1/payers/DANNON/budget/fund", map[string]int{"points": 100})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+		resp = env.PerformRequest("POST", "/v1/payers", model.Payer{DisplayName: "Dannon"})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Should return status 201")
+
+		resp = env.PerformRequest("POST", "/v1/users/1/points/add", model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+		assert.Equal(t, "budget_exhausted", decodeProblem(t, resp).Code)
+
+		resp = env.PerformRequest("POST", "/v1/payers/DANNON/budget/fund", map[string]int{"points": -1})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+		resp = env.PerformRequest("POST", "/v1/payers/Dannon/budget/fund", map[string]int{"points": 1000})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		resp = env.PerformRequest("PATCH", "/v1/payers/DANNON/budget", map[string]int{"userDailyCap": 150})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+
+		resp = env.PerformRequest("POST", "/v1/users/1/points/add", model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Should return status 204")
+		resp = env.PerformRequest("POST", "/v1/users/1/points/add", model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+		assert.Equal(t, "user_daily_cap_exceeded", decodeProblem(t, resp).Code)
+
+		resp = env.PerformRequest("GET", "/v1/payers/DANNON/budget", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		budget := model.PayerBudget{}
+		err := json.NewDecoder(resp.Body).Decode(&budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1000, budget.Funded)
+		assert.Equal(t, 900, budget.Remaining)
+		assert.Equal(t, 150, budget.UserDailyCap)
+
+		resp = env.PerformRequest("GET", "/v1/payers/DANNON/budget/entries", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		entries := make([]model.BudgetEntry, 0)
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, entries, 2)
+	})
+}
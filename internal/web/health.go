@@ -0,0 +1,63 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"fetchrewards.com/points-api/internal/buildinfo"
+)
+
+const codeNotReady = "not_ready"
+
+// Lifecycle states of a Server, held in Server.state
+const (
+	stateStarting int32 = iota
+	stateServing
+	stateShuttingDown
+)
+
+type healthStatus struct {
+	Status string `json:"status"`
+}
+
+// healthzHandler reports that the process is alive and able to handle requests
+func (s *Server) healthzHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealthStatus(w, req, "ok")
+}
+
+// readyzHandler reports whether the server should be sent traffic: it is serving, not shutting
+// down, and its storage backend is ready
+func (s *Server) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	switch atomic.LoadInt32(&s.state) {
+	case stateStarting:
+		writeProblem(w, req, http.StatusServiceUnavailable, codeNotReady, "the server is starting")
+		return
+	case stateShuttingDown:
+		writeProblem(w, req, http.StatusServiceUnavailable, codeNotReady, "the server is shutting down")
+		return
+	}
+	if s.StorageReady != nil {
+		if err := s.StorageReady(); err != nil {
+			writeProblem(w, req, http.StatusServiceUnavailable, codeNotReady, "storage is not ready: "+err.Error())
+			return
+		}
+	}
+	writeHealthStatus(w, req, "ready")
+}
+
+// versionHandler reports the build of the running binary
+func (s *Server) versionHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(buildinfo.Get()); err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+func writeHealthStatus(w http.ResponseWriter, req *http.Request, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(healthStatus{Status: status}); err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
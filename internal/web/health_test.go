@@ -0,0 +1,91 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/buildinfo"
+	"github.com/stretchr/testify/assert"
+)
+
+// probeAPIKeys turn authentication on, which probes must not need
+var probeAPIKeys = []APIKey{{ID: "admin", Hash: HashAPIKey("admin-key"), Scopes: []Scope{ScopeAdmin}}}
+
+func TestHealthz(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		env.server.APIKeys = probeAPIKeys
+
+		resp := env.PerformRequest("GET", "/healthz", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		status := healthStatus{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		assert.Equal(t, "ok", status.Status)
+
+		resp = env.PerformRequest("GET", "/v1/users/1/balance", nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	tests := map[string]struct {
+		state        int32
+		storageReady func() error
+		expected     int
+	}{
+		"starting": {
+			state:    stateStarting,
+			expected: http.StatusServiceUnavailable,
+		},
+		"serving": {
+			state:    stateServing,
+			expected: http.StatusOK,
+		},
+		"storage ready": {
+			state:        stateServing,
+			storageReady: func() error { return nil },
+			expected:     http.StatusOK,
+		},
+		"storage closed": {
+			state:        stateServing,
+			storageReady: func() error { return errors.New("database is closed") },
+			expected:     http.StatusServiceUnavailable,
+		},
+		"shutting down": {
+			state:    stateShuttingDown,
+			expected: http.StatusServiceUnavailable,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			withEnv(t, func(env serverEnv) {
+				env.server.APIKeys = probeAPIKeys
+				env.server.state = tc.state
+				env.server.StorageReady = tc.storageReady
+
+				resp := env.PerformRequest("GET", "/readyz", nil)
+				assert.Equal(t, tc.expected, resp.StatusCode)
+				if tc.expected != http.StatusOK {
+					assert.Equal(t, codeNotReady, decodeProblem(t, resp).Code)
+				}
+			})
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		buildinfo.Revision = "8d6d8b6"
+		defer func() { buildinfo.Revision = "" }()
+
+		resp := env.PerformRequest("GET", "/version", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		info := buildinfo.Info{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		assert.Equal(t, "8d6d8b6", info.Revision)
+		assert.NotEmpty(t, info.Version)
+		assert.NotEmpty(t, info.GoVersion)
+	})
+}
@@ -0,0 +1,127 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"fetchrewards.com/points-api/internal/services"
+	"github.com/gorilla/mux"
+)
+
+// authorizeHoldHandler accepts the same body as a spend and earmarks the points instead of
+// spending them
+func (s *Server) authorizeHoldHandler(w http.ResponseWriter, req *http.Request) {
+	// Get and validate userID
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return
+	}
+
+	// Marshal request into a struct and validate it
+	spendPointsRequest := spendPointsRequest{}
+	valid := decodeStrict(w, req, &spendPointsRequest, func() []fieldError {
+		return spendPointsRequest.validate()
+	})
+	if !valid {
+		return
+	}
+
+	strategy, err := spendPointsRequest.strategy()
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	// Try to hold the points
+	hold, err := s.serviceFor(req).AuthorizeHold(userID, spendPointsRequest.Points, strategy)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(hold)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) getHoldHandler(w http.ResponseWriter, req *http.Request) {
+	userID, holdID, ok := holdVars(w, req)
+	if !ok {
+		return
+	}
+
+	hold, found := s.service.GetHold(userID, holdID)
+	if !found {
+		writeError(w, req, services.ErrHoldNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(hold)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) captureHoldHandler(w http.ResponseWriter, req *http.Request) {
+	userID, holdID, ok := holdVars(w, req)
+	if !ok {
+		return
+	}
+
+	newTransactions, err := s.serviceFor(req).CaptureHold(userID, holdID)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(newTransactions)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) voidHoldHandler(w http.ResponseWriter, req *http.Request) {
+	userID, holdID, ok := holdVars(w, req)
+	if !ok {
+		return
+	}
+
+	hold, err := s.serviceFor(req).VoidHold(userID, holdID)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(hold)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+// holdVars gets and validates the userID and holdID of a request, writing an error response
+// if either is missing
+func holdVars(w http.ResponseWriter, req *http.Request) (userID, holdID string, ok bool) {
+	vars := mux.Vars(req)
+	userID = vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return "", "", false
+	}
+	holdID = vars["holdID"]
+	if holdID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "holdID is required")
+		return "", "", false
+	}
+	return userID, holdID, true
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHolds(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			assert.NoError(t, err)
+		}
+
+		resp := env.PerformRequest("POST", fmt.Sprintf("/v1/users/%s/holds", userID), spendPointsRequest{Points: 5000})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		hold := model.Hold{}
+		err := json.NewDecoder(resp.Body).Decode(&hold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, model.HoldAuthorized, hold.Status)
+		assert.Equal(t, 5000, hold.Points)
+		holdURL := fmt.Sprintf("/v1/users/%s/holds/%s", userID, hold.ID)
+
+		resp = env.PerformRequest("GET", holdURL, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+
+		resp = env.PerformRequest("POST", holdURL+"/capture", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		transactions := make([]model.Transaction, 0)
+		err = json.NewDecoder(resp.Body).Decode(&transactions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, transactions, 3)
+		assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+3)
+
+		resp = env.PerformRequest("POST", holdURL+"/void", nil)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, "Should return status 409")
+
+		resp = env.PerformRequest("POST", fmt.Sprintf("/v1/users/%s/holds", userID), spendPointsRequest{Points: 100000})
+		assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "Should return status 402")
+
+		resp = env.PerformRequest("POST", fmt.Sprintf("/v1/users/%s/holds/unknown/capture", userID), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/holds/unknown", userID), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+	})
+}
@@ -0,0 +1,225 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header clients use to make a request safe to retry
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader is set on responses replayed from an earlier request
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyWindow is how long the response to a request with an Idempotency-Key
+	// is kept for replay
+	DefaultIdempotencyWindow = 24 * time.Hour
+	// DefaultIdempotencyLease is how long a request with an Idempotency-Key holds on to the key
+	// while it is being handled. It is longer than DefaultWriteTimeout so a slow request is not
+	// taken over while its client is still waiting for it.
+	DefaultIdempotencyLease = time.Minute
+
+	// maxIdempotencyKeyLength bounds the size of the keys clients can make us store
+	maxIdempotencyKeyLength = 255
+	// idempotencyPurgeInterval is how often expired idempotency records are purged
+	idempotencyPurgeInterval = time.Minute
+)
+
+// IdempotencyStore is an abstraction for the persistence of idempotency records
+type IdempotencyStore interface {
+	ReserveIdempotencyKey(record model.IdempotencyRecord) (model.IdempotencyRecord, bool, error)
+	SaveIdempotencyRecord(record model.IdempotencyRecord) error
+	PurgeIdempotencyRecords(now time.Time) error
+}
+
+// requestIDKey is the request context key of the ID given to requests with an Idempotency-Key
+type requestIDKey struct{}
+
+// idempotent makes the handler safe to retry for clients that send an Idempotency-Key header.
+// The first request with a key is handled normally and its response is stored. Later requests
+// with the same key and the same method, path and body get the stored response replayed
+// instead of being handled again. Reusing a key for a different request is rejected with 422,
+// and a retry that arrives while the first request is still being handled is rejected with 409.
+// The first request only holds the key for IdempotencyLease until its response is stored, so
+// if the server crashes while handling it a retry can take the key over once the lease lapses.
+// Responses with a 5xx status are not stored and release the key so the request can be retried
+// straight away.
+//
+// The response is stored after the handler's writes, so a retry that takes the key over may
+// run the handler again. Handlers therefore use serviceFor and budgetsFor, which tag what they
+// write with the RequestID of the key's record. A retry keeps the RequestID, so a handler run
+// again finds the records the first attempt wrote and responds with what they hold instead of
+// writing again.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, req)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeProblem(w, req, http.StatusBadRequest, codeInvalidIdempotencyKey, "Idempotency-Key is too long")
+			return
+		}
+
+		// Read the body so it can be fingerprinted, then hand the handler a fresh copy
+		body, err := readBody(req)
+		if err == errBodyTooLarge {
+			writeProblem(w, req, http.StatusRequestEntityTooLarge, codeBodyTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			writeProblem(w, req, http.StatusBadRequest, codeInvalidBody, err.Error())
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// Keys only have to be unique per caller, so one caller cannot replay another's responses
+		if caller := callerID(req); caller != "" {
+			key = caller + "/" + key
+		}
+
+		now := s.now()
+		s.purgeIdempotencyRecords(now)
+
+		record, reserved, err := s.idempotency.ReserveIdempotencyKey(model.IdempotencyRecord{
+			Key:            key,
+			Fingerprint:    fingerprint(req, body),
+			RequestID:      requestID(key, now),
+			CreatedAt:      now,
+			LeaseExpiresAt: now.Add(s.IdempotencyLease),
+			ExpiresAt:      now.Add(s.IdempotencyWindow),
+		})
+		if err != nil {
+			writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		if !reserved {
+			switch {
+			case record.Fingerprint != fingerprint(req, body):
+				writeProblem(w, req, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used for a different request")
+			case !record.Completed:
+				writeProblem(w, req, http.StatusConflict, codeIdempotencyKeyInProgress, "a request with this Idempotency-Key is still in progress")
+			default:
+				replay(w, record)
+			}
+			return
+		}
+
+		req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, record.RequestID))
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, req)
+
+		if recorder.statusCode >= http.StatusInternalServerError {
+			record.LeaseExpiresAt = now
+			if err := s.idempotency.SaveIdempotencyRecord(record); err != nil {
+				log.Printf("Unable to release Idempotency-Key %q: %v", key, err)
+			}
+			return
+		}
+		record.Completed = true
+		record.LeaseExpiresAt = time.Time{}
+		record.ExpiresAt = now.Add(s.IdempotencyWindow)
+		record.StatusCode = recorder.statusCode
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		if err := s.idempotency.SaveIdempotencyRecord(record); err != nil {
+			log.Printf("Unable to save response for Idempotency-Key %q: %v", key, err)
+		}
+	}
+}
+
+// purgeIdempotencyRecords removes expired idempotency records, at most once per
+// idempotencyPurgeInterval
+func (s *Server) purgeIdempotencyRecords(now time.Time) {
+	s.purgeMu.Lock()
+	defer s.purgeMu.Unlock()
+
+	if now.Sub(s.lastPurge) < idempotencyPurgeInterval {
+		return
+	}
+	s.lastPurge = now
+	if err := s.idempotency.PurgeIdempotencyRecords(now); err != nil {
+		log.Printf("Unable to purge expired idempotency records: %v", err)
+	}
+}
+
+// fingerprint identifies a request by its method, path and body
+func fingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(req.URL.EscapedPath()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// requestID identifies the request first made with the caller scoped Idempotency-Key at the
+// given time, so a key reused once its record has expired gets a new ID
+func requestID(key string, now time.Time) string {
+	hash := sha256.New()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write([]byte(now.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// serviceFor returns the service that handles the request. For requests with an
+// Idempotency-Key it is tagged with their ID so a retry is only ever applied once.
+func (s *Server) serviceFor(req *http.Request) pointService {
+	if id, ok := req.Context().Value(requestIDKey{}).(string); ok {
+		return s.service.WithRequestID(id)
+	}
+	return s.service
+}
+
+// budgetsFor returns the budget ledger that handles the request. See serviceFor.
+func (s *Server) budgetsFor(req *http.Request) payerBudgets {
+	if id, ok := req.Context().Value(requestIDKey{}).(string); ok {
+		return s.budgets.WithRequestID(id)
+	}
+	return s.budgets
+}
+
+// replay writes the response stored in the record
+func replay(w http.ResponseWriter, record model.IdempotencyRecord) {
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(record.StatusCode)
+	_, _ = w.Write(record.Body)
+}
+
+// responseRecorder passes a response through to the client while keeping a copy of its
+// status code and body
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,195 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentSpend(t *testing.T) {
+	userID := "1"
+	url := fmt.Sprintf("/v1/users/%s/points/spend", userID)
+	headers := map[string]string{IdempotencyKeyHeader: "spend-1"}
+
+	setup := func(env serverEnv) {
+		for _, transaction := range test.Data {
+			assert.NoError(t, env.service.AddPoints(userID, transaction))
+		}
+	}
+
+	t.Run("retries replay the first response", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+
+			first := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusOK, first.StatusCode)
+			assert.Empty(t, first.Header.Get(idempotentReplayedHeader))
+			firstBody, _ := ioutil.ReadAll(first.Body)
+
+			retry := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusOK, retry.StatusCode)
+			assert.Equal(t, "true", retry.Header.Get(idempotentReplayedHeader))
+			assert.Equal(t, first.Header.Get("Content-Type"), retry.Header.Get("Content-Type"))
+			retryBody, _ := ioutil.ReadAll(retry.Body)
+			assert.Equal(t, firstBody, retryBody)
+
+			// The points were only spent once
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+3)
+		})
+	})
+
+	t.Run("failed requests are replayed too", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+
+			first := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 100000}, headers)
+			assert.Equal(t, http.StatusPaymentRequired, first.StatusCode)
+
+			retry := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 100000}, headers)
+			assert.Equal(t, http.StatusPaymentRequired, retry.StatusCode)
+			assert.Equal(t, "true", retry.Header.Get(idempotentReplayedHeader))
+		})
+	})
+
+	t.Run("reusing a key for a different request is rejected", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+
+			first := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusOK, first.StatusCode)
+
+			retry := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 100}, headers)
+			assert.Equal(t, http.StatusUnprocessableEntity, retry.StatusCode)
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+3)
+		})
+	})
+
+	t.Run("a request in progress is not handled twice", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+
+			// Reserve the key as the first request would before handling it
+			now := env.server.now()
+			body, err := json.Marshal(spendPointsRequest{Points: 5000})
+			assert.NoError(t, err)
+			_, _, err = env.db.ReserveIdempotencyKey(model.IdempotencyRecord{
+				Key:            headers[IdempotencyKeyHeader],
+				Fingerprint:    fingerprint(httptest.NewRequest("POST", url, nil), body),
+				CreatedAt:      now,
+				LeaseExpiresAt: now.Add(time.Hour),
+				ExpiresAt:      now.Add(env.server.IdempotencyWindow),
+			})
+			assert.NoError(t, err)
+
+			resp := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusConflict, resp.StatusCode)
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data))
+		})
+	})
+
+	t.Run("a request abandoned mid-flight is taken over once its lease lapses", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+			clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+			env.server.now = clock.Now
+
+			// Reserve the key as a request that crashed before storing its response would have
+			body, err := json.Marshal(spendPointsRequest{Points: 5000})
+			assert.NoError(t, err)
+			_, _, err = env.db.ReserveIdempotencyKey(model.IdempotencyRecord{
+				Key:            headers[IdempotencyKeyHeader],
+				Fingerprint:    fingerprint(httptest.NewRequest("POST", url, nil), body),
+				CreatedAt:      clock.Now(),
+				LeaseExpiresAt: clock.Now().Add(env.server.IdempotencyLease),
+				ExpiresAt:      clock.Now().Add(env.server.IdempotencyWindow),
+			})
+			assert.NoError(t, err)
+
+			resp := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+			clock.Advance(env.server.IdempotencyLease)
+			resp = env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get(idempotentReplayedHeader))
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+3)
+
+			// The response of the retry that took over is kept for the whole window
+			clock.Advance(env.server.IdempotencyWindow - time.Second)
+			resp = env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "true", resp.Header.Get(idempotentReplayedHeader))
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+3)
+		})
+	})
+
+	t.Run("a request that crashed after spending is not spent again when taken over", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+			clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+			env.server.now = clock.Now
+
+			// Reserve the key and spend the points as a request that crashed before storing its
+			// response would have
+			body, err := json.Marshal(spendPointsRequest{Points: 5000})
+			assert.NoError(t, err)
+			record, reserved, err := env.db.ReserveIdempotencyKey(model.IdempotencyRecord{
+				Key:            headers[IdempotencyKeyHeader],
+				Fingerprint:    fingerprint(httptest.NewRequest("POST", url, nil), body),
+				RequestID:      "crashed",
+				CreatedAt:      clock.Now(),
+				LeaseExpiresAt: clock.Now().Add(env.server.IdempotencyLease),
+				ExpiresAt:      clock.Now().Add(env.server.IdempotencyWindow),
+			})
+			assert.NoError(t, err)
+			assert.True(t, reserved)
+			spent, err := env.service.WithRequestID(record.RequestID).SpendPoints(userID, 5000, nil)
+			assert.NoError(t, err)
+
+			clock.Advance(env.server.IdempotencyLease)
+			resp := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 5000}, headers)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			var transactions []model.Transaction
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&transactions))
+			assert.Len(t, transactions, len(spent))
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+3)
+		})
+	})
+
+	t.Run("keys can be reused once the window has passed", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+			clock := test.NewClock(test.ParseTime("2020-11-03T00:00:00Z"))
+			env.server.now = clock.Now
+
+			first := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 100}, headers)
+			assert.Equal(t, http.StatusOK, first.StatusCode)
+
+			clock.Advance(env.server.IdempotencyWindow)
+			retry := env.PerformRequestWithHeaders("POST", url, spendPointsRequest{Points: 100}, headers)
+			assert.Equal(t, http.StatusOK, retry.StatusCode)
+			assert.Empty(t, retry.Header.Get(idempotentReplayedHeader))
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+2)
+		})
+	})
+
+	t.Run("requests without a key are not deduplicated", func(t *testing.T) {
+		withEnv(t, func(env serverEnv) {
+			setup(env)
+
+			for i := 0; i < 2; i++ {
+				resp := env.PerformRequest("POST", url, spendPointsRequest{Points: 100})
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+			assert.Len(t, env.db.GetTransactions(userID), len(test.Data)+2)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"fetchrewards.com/points-api/internal/metrics"
+	"github.com/gorilla/mux"
+)
+
+// unmatchedRoute labels requests that did not match any route
+const unmatchedRoute = "unmatched"
+
+var (
+	httpRequests = metrics.Default.NewCounter("points_api_http_requests_total",
+		"HTTP requests served, by method, route and status", "method", "route", "status")
+	httpDuration = metrics.Default.NewHistogram("points_api_http_request_duration_seconds",
+		"How long HTTP requests took to serve, by method, route and status", metrics.DefaultBuckets, "method", "route", "status")
+)
+
+// knownMethods are the methods used as labels, any other method is counted as OTHER so clients
+// cannot create new series at will
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// metricsMiddleware counts requests and how long they took to serve. Requests are labelled
+// with the path template of the first of the routers' routes they match, so that the IDs in
+// paths do not each create a series.
+func metricsMiddleware(next http.Handler, routers ...*mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		method := req.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		route := routeTemplate(req, routers)
+		status := strconv.Itoa(recorder.statusCode)
+		httpRequests.Inc(method, route, status)
+		httpDuration.ObserveSince(start, method, route, status)
+	})
+}
+
+// routeTemplate returns the path template of the first route the request matches
+func routeTemplate(req *http.Request, routers []*mux.Router) string {
+	for _, router := range routers {
+		var match mux.RouteMatch
+		if router.Match(req, &match) && match.MatchErr == nil && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				return template
+			}
+		}
+	}
+	return unmatchedRoute
+}
+
+// statusRecorder passes a response through to the client while keeping its status code
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
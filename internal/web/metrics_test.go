@@ -0,0 +1,62 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/metrics"
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		// The metrics are shared by every server, so only how much they change is checked
+		tests := []struct {
+			method   string
+			url      string
+			route    string
+			status   int
+			previous float64
+		}{
+			{method: "POST", url: "/v1/users/1/points/add", route: "/v1/users/{userID}/points/add", status: http.StatusNoContent},
+			{method: "GET", url: "/v1/users/1/balance", route: "/v1/users/{userID}/balance", status: http.StatusOK},
+			{method: "GET", url: "/v1/users/2/balance", route: "/v1/users/{userID}/balance", status: http.StatusOK},
+			{method: "GET", url: "/v1/users/1/spends/unknown", route: "/v1/users/{userID}/spends/{spendID}", status: http.StatusNotFound},
+			{method: "GET", url: "/nowhere", route: unmatchedRoute, status: http.StatusNotFound},
+			{method: "GET", url: "/healthz", route: "/healthz", status: http.StatusOK},
+		}
+		for i, tc := range tests {
+			tests[i].previous = httpRequests.Value(tc.method, tc.route, strconv.Itoa(tc.status))
+		}
+
+		for _, tc := range tests {
+			var body interface{}
+			if tc.method == "POST" {
+				body = model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}
+			}
+			resp := env.PerformRequest(tc.method, tc.url, body)
+			assert.Equal(t, tc.status, resp.StatusCode, tc.url)
+		}
+
+		balance := httpRequests.Value("GET", "/v1/users/{userID}/balance", "200")
+		assert.Equal(t, float64(2), balance-tests[1].previous)
+		for _, tc := range tests {
+			if tc.route != "/v1/users/{userID}/balance" {
+				assert.Equal(t, float64(1), httpRequests.Value(tc.method, tc.route, strconv.Itoa(tc.status))-tc.previous, tc.url)
+			}
+		}
+
+		resp := env.PerformRequest("GET", "/metrics", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, metrics.ContentType, resp.Header.Get("Content-Type"))
+		text, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(text), `points_api_http_request_duration_seconds_count{method="GET",route="/v1/users/{userID}/balance",status="200"}`)
+		assert.Contains(t, string(text), `points_api_points_earned_total{payer="other"}`)
+		assert.Contains(t, string(text), `points_api_storage_operation_duration_seconds_count{operation="update_ledger"}`)
+	})
+}
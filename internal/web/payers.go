@@ -0,0 +1,101 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"github.com/gorilla/mux"
+)
+
+// payerRegistry is an abstraction for the payer registry methods the web server depends on
+type payerRegistry interface {
+	Register(payer model.Payer) (model.Payer, error)
+	GetPayer(payerID string) (model.Payer, bool)
+	ListPayers() []model.Payer
+	UpdatePayer(payerID string, update services.PayerUpdate) (model.Payer, error)
+	DeletePayer(payerID string) error
+}
+
+func (s *Server) listPayersHandler(w http.ResponseWriter, req *http.Request) {
+	payers := s.payers.ListPayers()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(payers)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) registerPayerHandler(w http.ResponseWriter, req *http.Request) {
+	// Marshal request into a struct and validate it
+	payer := model.Payer{}
+	valid := decodeStrict(w, req, &payer, func() []fieldError {
+		return validatePayer(payer)
+	})
+	if !valid {
+		return
+	}
+
+	payer, err := s.payers.Register(payer)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(payer)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) getPayerHandler(w http.ResponseWriter, req *http.Request) {
+	payer, found := s.payers.GetPayer(mux.Vars(req)["payerID"])
+	if !found {
+		writeError(w, req, services.ErrPayerNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(payer)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) updatePayerHandler(w http.ResponseWriter, req *http.Request) {
+	// Marshal request into a struct
+	update := services.PayerUpdate{}
+	if !decodeStrict(w, req, &update, noValidation) {
+		return
+	}
+
+	payer, err := s.payers.UpdatePayer(mux.Vars(req)["payerID"], update)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(payer)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) deletePayerHandler(w http.ResponseWriter, req *http.Request) {
+	err := s.payers.DeletePayer(mux.Vars(req)["payerID"])
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayers(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		env.payers.Permissive = false
+
+		resp := env.PerformRequest("POST", "/v1/payers", model.Payer{DisplayName: "Dannon"})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Should return status 201")
+		payer := model.Payer{}
+		err := json.NewDecoder(resp.Body).Decode(&payer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "DANNON", payer.ID)
+		assert.Equal(t, model.PayerActive, payer.Status)
+
+		resp = env.PerformRequest("POST", "/v1/payers", model.Payer{ID: "dannon "})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, "Should return status 409")
+
+		resp = env.PerformRequest("GET", "/v1/payers", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		payers := make([]model.Payer, 0)
+		err = json.NewDecoder(resp.Body).Decode(&payers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, payers, 1)
+
+		// Points are added under the canonical payer ID
+		addURL := fmt.Sprintf("/v1/users/%s/points/add", "1")
+		resp = env.PerformRequest("POST", addURL, model.Transaction{Payer: "Dannon", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Should return status 204")
+		assert.Equal(t, "DANNON", env.db.GetTransactions("1")[0].Payer)
+		resp = env.PerformRequest("POST", addURL, model.Transaction{Payer: "UNILEVER", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+
+		resp = env.PerformRequest("PATCH", "/v1/payers/DANNON", map[string]string{"status": "suspended"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		resp = env.PerformRequest("GET", "/v1/payers/Dannon", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		err = json.NewDecoder(resp.Body).Decode(&payer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, model.PayerSuspended, payer.Status)
+		resp = env.PerformRequest("POST", addURL, model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, "Should return status 409")
+
+		resp = env.PerformRequest("DELETE", "/v1/payers/DANNON", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Should return status 204")
+		resp = env.PerformRequest("GET", "/v1/payers/DANNON", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+		resp = env.PerformRequest("PATCH", "/v1/payers/DANNON", map[string]string{"status": "active"})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+	})
+}
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"fetchrewards.com/points-api/internal/services"
+)
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// Codes of the problems detected by the web server itself. Problems reported by the services
+// use the Code of their services.Error.
+const (
+	codeInvalidBody              = "invalid_body"
+	codeMissingParameter         = "missing_parameter"
+	codeInvalidQuery             = "invalid_query"
+	codeInvalidIdempotencyKey    = "invalid_idempotency_key"
+	codeIdempotencyKeyReused     = "idempotency_key_reused"
+	codeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	codeInternal                 = "internal_error"
+)
+
+// problem is an RFC 7807 problem details object. Code is an extension member holding a stable,
+// machine-readable error code for clients to branch on, and Errors lists the invalid fields of
+// a request body.
+type problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []fieldError `json:"errors,omitempty"`
+}
+
+// writeProblem writes a problem details response with the given status, code and detail
+func writeProblem(w http.ResponseWriter, req *http.Request, status int, code, detail string) {
+	encodeProblem(w, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: req.URL.Path,
+		Code:     code,
+	})
+}
+
+// writeValidationProblem writes a 422 problem details response listing the invalid fields
+func writeValidationProblem(w http.ResponseWriter, req *http.Request, errs []fieldError) {
+	encodeProblem(w, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusUnprocessableEntity),
+		Status:   http.StatusUnprocessableEntity,
+		Detail:   "the request body has invalid fields",
+		Instance: req.URL.Path,
+		Code:     codeValidationFailed,
+		Errors:   errs,
+	})
+}
+
+func encodeProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// writeError writes a problem details response for an error returned by the services. Errors
+// that are not a services.Error are unexpected and reported as internal errors.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	var serviceErr *services.Error
+	if !errors.As(err, &serviceErr) {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	writeProblem(w, req, errorStatus(serviceErr.Kind), serviceErr.Code, err.Error())
+}
+
+// errorStatus returns the status code for a kind of services.Error
+func errorStatus(kind error) int {
+	switch kind {
+	case services.ErrInsufficientFunds:
+		return http.StatusPaymentRequired
+	case services.ErrInvalidAmount, services.ErrInvalidRequest, services.ErrUnknownPayer, services.ErrLimitExceeded:
+		return http.StatusUnprocessableEntity
+	case services.ErrConflict:
+		return http.StatusConflict
+	case services.ErrNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemResponses(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		resp := env.PerformRequest("POST", fmt.Sprintf("/v1/users/%s/points/add", userID), model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Should return status 204")
+
+		tests := map[string]struct {
+			method  string
+			url     string
+			payload interface{}
+			status  int
+			code    string
+		}{
+			"insufficient points": {
+				method:  "POST",
+				url:     fmt.Sprintf("/v1/users/%s/points/spend", userID),
+				payload: spendPointsRequest{Points: 5000},
+				status:  http.StatusPaymentRequired,
+				code:    "insufficient_points",
+			},
+			"invalid amount": {
+				method:  "POST",
+				url:     "/v1/payers/DANNON/budget/fund",
+				payload: fundBudgetRequest{Points: -5},
+				status:  http.StatusUnprocessableEntity,
+				code:    "invalid_amount",
+			},
+			"invalid body": {
+				method:  "POST",
+				url:     fmt.Sprintf("/v1/users/%s/points/spend", userID),
+				payload: "points",
+				status:  http.StatusUnprocessableEntity,
+				code:    codeInvalidBody,
+			},
+			"payer not found": {
+				method: "GET",
+				url:    "/v1/payers/UNILEVER",
+				status: http.StatusNotFound,
+				code:   "payer_not_found",
+			},
+			"conflict": {
+				method:  "POST",
+				url:     "/v1/payers",
+				payload: model.Payer{ID: "dannon"},
+				status:  http.StatusConflict,
+				code:    "payer_exists",
+			},
+			"not found": {
+				method: "GET",
+				url:    fmt.Sprintf("/v1/users/%s/spends/unknown", userID),
+				status: http.StatusNotFound,
+				code:   "spend_not_found",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				resp := env.PerformRequest(tc.method, tc.url, tc.payload)
+				assert.Equal(t, tc.status, resp.StatusCode)
+				assert.Equal(t, problemContentType, resp.Header.Get("Content-Type"))
+
+				body := decodeProblem(t, resp)
+				assert.Equal(t, tc.code, body.Code)
+				assert.Equal(t, tc.status, body.Status)
+				assert.Equal(t, http.StatusText(tc.status), body.Title)
+				assert.Equal(t, tc.url, body.Instance)
+				assert.NotEmpty(t, body.Detail)
+			})
+		}
+	})
+}
+
+func TestWriteError_unexpected_errors(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/v1/payers", nil), errors.New("disk full"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	body := problem{}
+	err := json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, codeInternal, body.Code)
+	assert.Equal(t, "disk full", body.Detail)
+}
+
+// decodeProblem decodes the problem details in the body of the response
+func decodeProblem(t *testing.T, resp *http.Response) problem {
+	body := problem{}
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
@@ -0,0 +1,288 @@
+package web
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxRateLimitKeys bounds how many clients or users each rate limiter keeps a bucket for.
+	// The least recently seen are forgotten first, which at worst gives them a full bucket.
+	maxRateLimitKeys = 10000
+
+	codeRateLimited = "rate_limited"
+)
+
+// RateLimit allows Burst requests at once, refilled at Rate requests per second. A zero Rate
+// means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// String formats the limit as rate:burst, as accepted by Set
+func (l *RateLimit) String() string {
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + ":" + strconv.Itoa(l.Burst)
+}
+
+// Set parses a limit written as rate:burst, or just rate for a burst of the same size, so the
+// limit can be used as a flag.Value. A rate of 0 removes the limit.
+func (l *RateLimit) Set(value string) error {
+	rateText, burstText := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		rateText, burstText = value[:i], value[i+1:]
+	}
+	rate, err := strconv.ParseFloat(rateText, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return fmt.Errorf("invalid rate %q, expected a number of requests per second", rateText)
+	}
+	burst := int(math.Ceil(rate))
+	if burstText != "" {
+		burst, err = strconv.Atoi(burstText)
+		if err != nil || burst < 1 {
+			return fmt.Errorf("invalid burst %q, expected a positive number of requests", burstText)
+		}
+	}
+	l.Rate, l.Burst = rate, burst
+	return nil
+}
+
+// MarshalText formats the limit like String, so limits can be written to config files
+func (l RateLimit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText parses the limit like Set, so limits can be read from config files
+func (l *RateLimit) UnmarshalText(text []byte) error {
+	return l.Set(string(text))
+}
+
+// DefaultRateLimits are generous enough for well behaved clients while stopping runaway ones
+var DefaultRateLimits = RateLimits{
+	ClientReads:  RateLimit{Rate: 100, Burst: 200},
+	ClientWrites: RateLimit{Rate: 50, Burst: 100},
+	UserReads:    RateLimit{Rate: 10, Burst: 20},
+	UserWrites:   RateLimit{Rate: 5, Burst: 10},
+}
+
+// RateLimits are the limits applied to each API client and to each user, with separate limits
+// for reads (GET and HEAD requests) and writes. Clients are identified by their API key, or by
+// their IP address when they do not present a known key. Users are identified by the userID of
+// the route.
+type RateLimits struct {
+	ClientReads  RateLimit
+	ClientWrites RateLimit
+	UserReads    RateLimit
+	UserWrites   RateLimit
+}
+
+// rateLimiters holds a rateLimiter for each of the RateLimits
+type rateLimiters struct {
+	clientReads  *rateLimiter
+	clientWrites *rateLimiter
+	userReads    *rateLimiter
+	userWrites   *rateLimiter
+}
+
+func newRateLimiters(limits RateLimits) *rateLimiters {
+	return &rateLimiters{
+		clientReads:  newRateLimiter(limits.ClientReads, maxRateLimitKeys),
+		clientWrites: newRateLimiter(limits.ClientWrites, maxRateLimitKeys),
+		userReads:    newRateLimiter(limits.UserReads, maxRateLimitKeys),
+		userWrites:   newRateLimiter(limits.UserWrites, maxRateLimitKeys),
+	}
+}
+
+// limitClients rejects requests over the client's limit with 429 and a Retry-After header. It
+// runs before authentication, so clients that fail to authenticate are limited too.
+func (s *Server) limitClients(next http.Handler) http.Handler {
+	byHash := apiKeysByHash(s.APIKeys)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limiter := s.limiters.clientWrites
+		if isRead(req) {
+			limiter = s.limiters.clientReads
+		}
+
+		decision := limiter.take(clientID(req, byHash), s.now())
+		if decision.unlimited {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !decision.allowed {
+			rejectRateLimited(w, req, decision)
+			return
+		}
+		setRateLimitHeaders(w, decision)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientDecisionKey{}, decision)))
+	})
+}
+
+// limitUsers rejects requests over the limit of the user in the path with 429 and a
+// Retry-After header. Responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers for whichever of the client's and the user's limits has the fewest requests
+// remaining. It must run after routing so the userID is known.
+func (s *Server) limitUsers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userID, ok := mux.Vars(req)["userID"]
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+		limiter := s.limiters.userWrites
+		if isRead(req) {
+			limiter = s.limiters.userReads
+		}
+
+		decision := limiter.take(userID, s.now())
+		if decision.unlimited {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !decision.allowed {
+			rejectRateLimited(w, req, decision)
+			return
+		}
+		if client, ok := req.Context().Value(clientDecisionKey{}).(rateDecision); !ok || decision.remaining < client.remaining {
+			setRateLimitHeaders(w, decision)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// clientDecisionKey is the request context key of the rateDecision taken for the client
+type clientDecisionKey struct{}
+
+// isRead reports whether the request counts against the read limits
+func isRead(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// clientID identifies the client making the request for rate limiting. As it runs before
+// authentication the client is identified by its API key only if it presents one of the
+// configured keys, and by its IP address otherwise, so made up credentials do not get a fresh
+// limit.
+func clientID(req *http.Request, byHash map[string]APIKey) string {
+	if presented := req.Header.Get(APIKeyHeader); presented != "" {
+		if key, ok := byHash[HashAPIKey(presented)]; ok {
+			return key.ID
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func rejectRateLimited(w http.ResponseWriter, req *http.Request, decision rateDecision) {
+	setRateLimitHeaders(w, decision)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.retryAfter)))
+	writeProblem(w, req, http.StatusTooManyRequests, codeRateLimited, "too many requests, retry later")
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, decision rateDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateDecision is the outcome of taking a token from a bucket. reset is how long until the
+// bucket is full again and retryAfter how long until it next holds a token.
+type rateDecision struct {
+	unlimited  bool
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// rateLimiter keeps a token bucket per key, for at most maxKeys keys
+type rateLimiter struct {
+	limit   RateLimit
+	maxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// recent orders the buckets from most to least recently used
+	recent *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit, maxKeys int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// take takes a token from the key's bucket if it has one
+func (l *rateLimiter) take(key string, now time.Time) rateDecision {
+	if l.limit.Rate <= 0 {
+		return rateDecision{unlimited: true, allowed: true}
+	}
+	burst := float64(l.limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key, now, burst)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	decision := rateDecision{limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.allowed = true
+	} else {
+		decision.retryAfter = l.timeToFill(1 - b.tokens)
+	}
+	decision.remaining = int(b.tokens)
+	decision.reset = l.timeToFill(burst - b.tokens)
+	return decision
+}
+
+// bucket returns the key's bucket, creating a full one and evicting the least recently used
+// bucket if there are too many
+func (l *rateLimiter) bucket(key string, now time.Time, burst float64) *bucket {
+	if element, ok := l.buckets[key]; ok {
+		l.recent.MoveToFront(element)
+		return element.Value.(*bucket)
+	}
+	if l.recent.Len() >= l.maxKeys {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*bucket).key)
+	}
+	b := &bucket{key: key, tokens: burst, last: now}
+	l.buckets[key] = l.recent.PushFront(b)
+	return b
+}
+
+func (l *rateLimiter) timeToFill(tokens float64) time.Duration {
+	return time.Duration(tokens / l.limit.Rate * float64(time.Second))
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := test.ParseTime("2020-11-02T14:00:00Z")
+	limiter := newRateLimiter(RateLimit{Rate: 2, Burst: 3}, 2)
+
+	for i := 2; i >= 0; i-- {
+		decision := limiter.take("a", now)
+		assert.True(t, decision.allowed)
+		assert.Equal(t, i, decision.remaining)
+	}
+	decision := limiter.take("a", now)
+	assert.False(t, decision.allowed)
+	assert.Equal(t, 500*time.Millisecond, decision.retryAfter)
+	assert.Equal(t, 1500*time.Millisecond, decision.reset)
+
+	// Tokens refill at the rate, up to the burst
+	assert.True(t, limiter.take("a", now.Add(500*time.Millisecond)).allowed)
+	assert.Equal(t, 2, limiter.take("a", now.Add(time.Hour)).remaining)
+
+	// Only the most recently used keys are kept
+	limiter.take("b", now)
+	limiter.take("c", now)
+	assert.Len(t, limiter.buckets, 2)
+	assert.NotContains(t, limiter.buckets, "a")
+
+	assert.True(t, newRateLimiter(RateLimit{}, 2).take("a", now).unlimited)
+}
+
+func TestRateLimit_Set(t *testing.T) {
+	tests := map[string]struct {
+		value    string
+		expected RateLimit
+		invalid  bool
+	}{
+		"rate and burst": {value: "2.5:10", expected: RateLimit{Rate: 2.5, Burst: 10}},
+		"rate only":      {value: "2.5", expected: RateLimit{Rate: 2.5, Burst: 3}},
+		"no limit":       {value: "0", expected: RateLimit{Rate: 0, Burst: 0}},
+		"negative rate":  {value: "-1", invalid: true},
+		"zero burst":     {value: "1:0", invalid: true},
+		"not a number":   {value: "fast", invalid: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			limit := RateLimit{}
+			err := limit.Set(tc.value)
+			if tc.invalid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, limit)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		env.server.now = func() time.Time { return test.ParseTime("2020-11-02T14:00:00Z") }
+		env.server.RateLimits = RateLimits{
+			ClientReads:  RateLimit{Rate: 1, Burst: 5},
+			ClientWrites: RateLimit{Rate: 1, Burst: 3},
+			UserWrites:   RateLimit{Rate: 0.5, Burst: 2},
+		}
+		add := func(userID string) *http.Response {
+			transaction := model.Transaction{Payer: "DANNON", Points: 100, Timestamp: test.ParseTime("2020-11-02T14:00:00Z")}
+			return env.PerformRequest("POST", "/v1/users/"+userID+"/points/add", transaction)
+		}
+
+		resp := add("1")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		// The user limit has the fewest requests remaining
+		assert.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+		assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+		assert.Equal(t, "2", resp.Header.Get("RateLimit-Reset"))
+
+		assert.Equal(t, http.StatusNoContent, add("1").StatusCode)
+		resp = add("1")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+		assert.Equal(t, codeRateLimited, decodeProblem(t, resp).Code)
+
+		// The client's writes are limited across users, but its reads are limited separately
+		resp = add("2")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+		resp = env.PerformRequest("GET", "/v1/users/1/balance", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "4", resp.Header.Get("RateLimit-Remaining"))
+	})
+}
+
+func TestRateLimit_before_authentication(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		env.server.now = func() time.Time { return test.ParseTime("2020-11-02T14:00:00Z") }
+		env.server.APIKeys = []APIKey{{ID: "app", Hash: HashAPIKey("app-key"), Scopes: []Scope{ScopeRead}}}
+		env.server.RateLimits = RateLimits{ClientReads: RateLimit{Rate: 1, Burst: 2}}
+		balance := func(key string) *http.Response {
+			return env.PerformRequestWithHeaders("GET", "/v1/users/1/balance", nil, map[string]string{APIKeyHeader: key})
+		}
+
+		// Guessed keys share the limit of the address they come from
+		assert.Equal(t, http.StatusUnauthorized, balance("guess-1").StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, balance("guess-2").StatusCode)
+		resp := balance("guess-3")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, codeRateLimited, decodeProblem(t, resp).Code)
+
+		// A known key has a limit of its own
+		resp = balance("app-key")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+	})
+}
@@ -1,57 +1,268 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"fetchrewards.com/points-api/internal/metrics"
 	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
 	"github.com/gorilla/mux"
 )
 
 type spendPointsRequest struct {
 	Points int `json:"points"`
+	// Strategy optionally names the services.SpendStrategy to use instead of the default
+	Strategy string `json:"strategy,omitempty"`
+	// PayerPriority lists the payers to spend first for the payer-priority strategy
+	PayerPriority []string `json:"payerPriority,omitempty"`
+}
+
+// reverseSpendRequest is the optional body of a spend reversal. Leaving out Points reverses
+// everything not reversed yet.
+type reverseSpendRequest struct {
+	Points int `json:"points,omitempty"`
+}
+
+// strategy resolves the requested spend strategy. It returns nil, meaning the service default,
+// when the request does not name one.
+func (r spendPointsRequest) strategy() (services.SpendStrategy, error) {
+	if r.Strategy == "" {
+		return nil, nil
+	}
+	return services.NewSpendStrategy(r.Strategy, r.PayerPriority)
 }
 
 // pointService is an abstraction for the service layer methods the web server depends on
 type pointService interface {
 	AddPoints(userID string, transaction model.Transaction) error
 	GetAccounts(userID string) []model.Account
-	SpendPoints(userID string, points int) ([]model.Transaction, error)
+	GetAccountsAsOf(userID string, asOf time.Time) []model.Account
+	GetBalance(userID string) model.Balance
+	GetBalanceAsOf(userID string, asOf time.Time) model.Balance
+	SpendPoints(userID string, points int, strategy services.SpendStrategy) ([]model.Transaction, error)
+	PreviewSpend(userID string, points int, strategy services.SpendStrategy) (model.SpendPreview, error)
+	GetSpend(userID, spendID string) (model.Spend, bool)
+	ReverseSpend(userID, spendID string, points int) ([]model.Transaction, error)
+	AuthorizeHold(userID string, points int, strategy services.SpendStrategy) (model.Hold, error)
+	CaptureHold(userID, holdID string) ([]model.Transaction, error)
+	VoidHold(userID, holdID string) (model.Hold, error)
+	GetHold(userID, holdID string) (model.Hold, bool)
+	ListTransactions(userID string, query services.TransactionQuery) (model.TransactionPage, error)
+	WithRequestID(requestID string) *services.PointService
 }
 
 // Server provides functionality for starting the server and routing web requests to the
 // appropriate handlers. Handlers delegate business logic to a pointService interface
 // for executing the business logic.
 type Server struct {
-	service pointService
+	// IdempotencyWindow is how long responses to requests with an Idempotency-Key are kept
+	// for replay
+	IdempotencyWindow time.Duration
+	// IdempotencyLease is how long a request with an Idempotency-Key holds the key while it is
+	// being handled, before a retry can take it over
+	IdempotencyLease time.Duration
+
+	// APIKeys are the keys clients must authenticate with. When empty the API is open to
+	// anyone who can reach it.
+	APIKeys []APIKey
+
+	// UserTokenSecret is the HMAC secret user tokens are signed with. When empty user tokens
+	// are not accepted.
+	UserTokenSecret []byte
+	// TokenLeeway is the clock skew allowed when checking when user tokens expire
+	TokenLeeway time.Duration
+
+	// RateLimits are the limits on how often clients and users can make requests. They are
+	// read when the handlers are first set up.
+	RateLimits RateLimits
+
+	// ReadTimeout, WriteTimeout and IdleTimeout bound how long a connection can be held open
+	// reading a request, writing a response and waiting for the next request
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile are the certificate and key to serve HTTPS with. When empty
+	// the server serves plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// StorageReady reports whether the storage backend can serve requests, for the readiness
+	// probe. When nil the storage is always considered ready.
+	StorageReady func() error
+
+	service     pointService
+	payers      payerRegistry
+	budgets     payerBudgets
+	idempotency IdempotencyStore
+	now         func() time.Time
+
+	purgeMu   sync.Mutex
+	lastPurge time.Time
+
+	limitersOnce sync.Once
+	limiters     *rateLimiters
+
+	// state is the lifecycle state reported by the readiness probe
+	state int32
 }
 
-// NewServer creates a new Server configured with the given pointService
-func NewServer(service pointService) *Server {
+const (
+	// DefaultReadTimeout is how long clients have to send a request
+	DefaultReadTimeout = 10 * time.Second
+	// DefaultWriteTimeout is how long a request can take from the end of its headers until
+	// the response is written
+	DefaultWriteTimeout = 30 * time.Second
+	// DefaultIdleTimeout is how long keep-alive connections are kept open between requests
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultShutdownTimeout is how long in-flight requests are given to finish on shutdown
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// NewServer creates a new Server configured with the given pointService, payerRegistry and
+// payerBudgets, keeping the responses to requests made with an Idempotency-Key in the given
+// IdempotencyStore
+func NewServer(service pointService, payers payerRegistry, budgets payerBudgets, idempotency IdempotencyStore) *Server {
 	return &Server{
-		service: service,
+		IdempotencyWindow: DefaultIdempotencyWindow,
+		IdempotencyLease:  DefaultIdempotencyLease,
+		TokenLeeway:       DefaultTokenLeeway,
+		ReadTimeout:       DefaultReadTimeout,
+		WriteTimeout:      DefaultWriteTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		ShutdownTimeout:   DefaultShutdownTimeout,
+		service:           service,
+		payers:            payers,
+		budgets:           budgets,
+		idempotency:       idempotency,
+		now:               time.Now,
 	}
 }
 
-// Start starts the web server on the given port
-func (s *Server) Start(port int) {
-	addr := fmt.Sprintf(":%d", port)
-	log.Printf("Starting web server, listening at %s", addr)
+// Start serves on the given address until the process receives SIGINT or SIGTERM, then shuts
+// the server down gracefully
+func (s *Server) Start(addr string) error {
+	ctx, stop := signalContext(syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	err := http.ListenAndServe(addr, s.setupHandlers())
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve handles requests on the listener until ctx is done. It then stops accepting new
+// connections and waits up to ShutdownTimeout for in-flight requests to finish, so that once
+// it returns nothing more is written through the server's services.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           s.setupHandlers(),
+		ReadHeaderTimeout: s.ReadTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+	log.Printf("Starting web server, listening at %s", listener.Addr())
+
+	served := make(chan error, 1)
+	go func() {
+		if s.TLSCertFile != "" {
+			served <- server.ServeTLS(listener, s.TLSCertFile, s.TLSKeyFile)
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+	atomic.StoreInt32(&s.state, stateServing)
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&s.state, stateShuttingDown)
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", s.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("draining in-flight requests: %w", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// signalContext returns a context that is done once the process receives one of the signals
+func signalContext(signals ...os.Signal) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go func() {
+		select {
+		case sig := <-received:
+			log.Printf("Received %s", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(received)
+		cancel()
 	}
 }
 
 func (s *Server) setupHandlers() http.Handler {
+	s.limitersOnce.Do(func() {
+		s.limiters = newRateLimiters(s.RateLimits)
+	})
+
+	api := mux.NewRouter()
+	api.Use(s.limitUsers)
+	api.HandleFunc("/v1/payers", requireScope(ScopeRead, s.listPayersHandler)).Methods("GET")
+	api.HandleFunc("/v1/payers", requireScope(ScopeAdmin, s.registerPayerHandler)).Methods("POST")
+	api.HandleFunc("/v1/payers/{payerID}", requireScope(ScopeRead, s.getPayerHandler)).Methods("GET")
+	api.HandleFunc("/v1/payers/{payerID}", requireScope(ScopeAdmin, s.updatePayerHandler)).Methods("PATCH")
+	api.HandleFunc("/v1/payers/{payerID}", requireScope(ScopeAdmin, s.deletePayerHandler)).Methods("DELETE")
+	api.HandleFunc("/v1/payers/{payerID}/budget", requireScope(ScopeAdmin, s.getBudgetHandler)).Methods("GET")
+	api.HandleFunc("/v1/payers/{payerID}/budget", requireScope(ScopeAdmin, s.setBudgetCapsHandler)).Methods("PATCH")
+	api.HandleFunc("/v1/payers/{payerID}/budget/fund", requireScope(ScopeAdmin, s.idempotent(s.fundBudgetHandler))).Methods("POST")
+	api.HandleFunc("/v1/payers/{payerID}/budget/entries", requireScope(ScopeAdmin, s.listBudgetEntriesHandler)).Methods("GET")
+	api.HandleFunc("/v1/users/{userID}/points/add", requireScope(ScopeEarn, s.idempotent(s.addPointsHandler))).Methods("POST")
+	api.HandleFunc("/v1/users/{userID}/payers", requireScope(ScopeRead, s.getPayersHandler)).Methods("GET")
+	api.HandleFunc("/v1/users/{userID}/balance", requireScope(ScopeRead, s.getBalanceHandler)).Methods("GET")
+	api.HandleFunc("/v1/users/{userID}/transactions", requireScope(ScopeRead, s.listTransactionsHandler)).Methods("GET")
+	api.HandleFunc("/v1/users/{userID}/points/spend", requireScope(ScopeSpend, s.idempotent(s.spendPointsHandler))).Methods("POST")
+	api.HandleFunc("/v1/users/{userID}/points/spend/preview", requireScope(ScopeSpend, s.previewSpendHandler)).Methods("POST")
+	api.HandleFunc("/v1/users/{userID}/spends/{spendID}", requireScope(ScopeRead, s.getSpendHandler)).Methods("GET")
+	api.HandleFunc("/v1/users/{userID}/spends/{spendID}/reverse", requireScope(ScopeSpend, s.idempotent(s.reverseSpendHandler))).Methods("POST")
+	api.HandleFunc("/v1/users/{userID}/holds", requireScope(ScopeSpend, s.idempotent(s.authorizeHoldHandler))).Methods("POST")
+	api.HandleFunc("/v1/users/{userID}/holds/{holdID}", requireScope(ScopeRead, s.getHoldHandler)).Methods("GET")
+	api.HandleFunc("/v1/users/{userID}/holds/{holdID}/capture", requireScope(ScopeSpend, s.idempotent(s.captureHoldHandler))).Methods("POST")
+	api.HandleFunc("/v1/users/{userID}/holds/{holdID}/void", requireScope(ScopeSpend, s.idempotent(s.voidHoldHandler))).Methods("POST")
+
+	// Probes and metrics are answered without authentication or rate limiting
 	router := mux.NewRouter()
-	router.HandleFunc("/v1/users/{userID}/points/add", s.addPointsHandler).Methods("POST")
-	router.HandleFunc("/v1/users/{userID}/payers", s.getPayersHandler).Methods("GET")
-	router.HandleFunc("/v1/users/{userID}/points/spend", s.spendPointsHandler).Methods("POST")
-	return loggingMiddleware(router)
+	router.HandleFunc("/healthz", s.healthzHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", s.readyzHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/version", s.versionHandler).Methods("GET")
+	router.Handle("/metrics", metrics.Default.Handler()).Methods("GET")
+	router.NotFoundHandler = s.limitClients(s.authenticate(api))
+	return loggingMiddleware(metricsMiddleware(router, router, api))
 }
 
 func (s *Server) spendPointsHandler(w http.ResponseWriter, req *http.Request) {
@@ -59,22 +270,29 @@ func (s *Server) spendPointsHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	userID := vars["userID"]
 	if userID == "" {
-		http.Error(w, "userID is required", http.StatusBadRequest)
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
 		return
 	}
 
-	// Marshal request into a struct
+	// Marshal request into a struct and validate it
 	spendPointsRequest := spendPointsRequest{}
-	err := json.NewDecoder(req.Body).Decode(&spendPointsRequest)
+	valid := decodeStrict(w, req, &spendPointsRequest, func() []fieldError {
+		return spendPointsRequest.validate()
+	})
+	if !valid {
+		return
+	}
+
+	strategy, err := spendPointsRequest.strategy()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, req, err)
 		return
 	}
 
 	// Try to spend the points
-	newTransactions, err := s.service.SpendPoints(userID, spendPointsRequest.Points)
+	newTransactions, err := s.serviceFor(req).SpendPoints(userID, spendPointsRequest.Points, strategy)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, req, err)
 		return
 	}
 
@@ -82,7 +300,111 @@ func (s *Server) spendPointsHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(newTransactions)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+func (s *Server) previewSpendHandler(w http.ResponseWriter, req *http.Request) {
+	// Get and validate userID
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return
+	}
+
+	// Marshal request into a struct and validate it
+	spendPointsRequest := spendPointsRequest{}
+	valid := decodeStrict(w, req, &spendPointsRequest, func() []fieldError {
+		return spendPointsRequest.validate()
+	})
+	if !valid {
+		return
+	}
+
+	strategy, err := spendPointsRequest.strategy()
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	// Work out the spend without writing anything
+	preview, err := s.service.PreviewSpend(userID, spendPointsRequest.Points, strategy)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(preview)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+func (s *Server) getSpendHandler(w http.ResponseWriter, req *http.Request) {
+	// Get and validate userID and spendID
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return
+	}
+	spendID := vars["spendID"]
+	if spendID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "spendID is required")
+		return
+	}
+
+	spend, found := s.service.GetSpend(userID, spendID)
+	if !found {
+		writeError(w, req, services.ErrSpendNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(spend)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) reverseSpendHandler(w http.ResponseWriter, req *http.Request) {
+	// Get and validate userID and spendID
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return
+	}
+	spendID := vars["spendID"]
+	if spendID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "spendID is required")
+		return
+	}
+
+	// Marshal request into a struct and validate it, an empty body reverses the whole spend
+	reverseSpendRequest := reverseSpendRequest{}
+	valid := decodeOptional(w, req, &reverseSpendRequest, func() []fieldError {
+		return reverseSpendRequest.validate()
+	})
+	if !valid {
+		return
+	}
+
+	// Try to reverse the spend
+	newTransactions, err := s.serviceFor(req).ReverseSpend(userID, spendID, reverseSpendRequest.Points)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(newTransactions)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
 	}
 }
 
@@ -91,16 +413,59 @@ func (s *Server) getPayersHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	userID := vars["userID"]
 	if userID == "" {
-		http.Error(w, "userID is required", http.StatusBadRequest)
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return
+	}
+
+	// An optional asOf returns the balances as they stood at that time
+	asOf, err := parseTimeParam(req.URL.Query(), "asOf")
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	var accounts []model.Account
+	if asOf.IsZero() {
+		accounts = s.service.GetAccounts(userID)
+	} else {
+		accounts = s.service.GetAccountsAsOf(userID, asOf)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(accounts)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+func (s *Server) getBalanceHandler(w http.ResponseWriter, req *http.Request) {
+	// Get and validate userID
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
 		return
 	}
 
-	accounts := s.service.GetAccounts(userID)
+	// An optional asOf returns the balance as it stood at that time
+	asOf, err := parseTimeParam(req.URL.Query(), "asOf")
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	var balance model.Balance
+	if asOf.IsZero() {
+		balance = s.service.GetBalance(userID)
+	} else {
+		balance = s.service.GetBalanceAsOf(userID, asOf)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(accounts)
+	err = json.NewEncoder(w).Encode(balance)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
 		return
 	}
 }
@@ -110,22 +475,27 @@ func (s *Server) addPointsHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	userID := vars["userID"]
 	if userID == "" {
-		http.Error(w, "userID is required", http.StatusBadRequest)
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
 		return
 	}
 
-	// Marshal request into a struct
+	// Marshal request into a struct and validate it
 	transaction := model.Transaction{}
-	err := json.NewDecoder(req.Body).Decode(&transaction)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	valid := decodeStrict(w, req, &transaction, func() []fieldError {
+		return validateTransaction(transaction, s.now())
+	})
+	if !valid {
+		return
+	}
+	if client, ok := clientFrom(req); ok && !client.allowsPayer(transaction.Payer) {
+		writeProblem(w, req, http.StatusForbidden, codePayerNotAllowed, fmt.Sprintf("the API key can only add points for %s", client.Payer))
 		return
 	}
 
 	// Try to add the transaction
-	err = s.service.AddPoints(userID, transaction)
+	err := s.serviceFor(req).AddPoints(userID, transaction)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, req, err)
 		return
 	}
 
@@ -2,11 +2,15 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"fetchrewards.com/points-api/internal/db"
 	"fetchrewards.com/points-api/internal/model"
@@ -39,6 +43,49 @@ func TestGetPayers(t *testing.T) {
 	})
 }
 
+func TestGetPayers_as_of(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp := env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/payers?asOf=2020-11-01T00:00:00Z", userID), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+
+		accounts := make([]model.Account, 0)
+		err := json.NewDecoder(resp.Body).Decode(&accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []model.Account{{Payer: "DANNON", Points: 100}, {Payer: "UNILEVER", Points: 200}}, accounts)
+
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/balance?asOf=2020-11-01T00:00:00Z", userID), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		balance := model.Balance{}
+		err = json.NewDecoder(resp.Body).Decode(&balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 300, balance.Points)
+
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/balance", userID), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		balance = model.Balance{}
+		err = json.NewDecoder(resp.Body).Decode(&balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 11300, balance.Points)
+		assert.Nil(t, balance.AsOf)
+
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/payers?asOf=yesterday", userID), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Should return status 400")
+	})
+}
+
 func TestAddTransaction(t *testing.T) {
 	withEnv(t, func(env serverEnv) {
 		userID := "1"
@@ -114,6 +161,165 @@ func TestSpendPoints(t *testing.T) {
 	})
 }
 
+func TestSpendPoints_with_strategy(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			assert.NoError(t, err)
+		}
+
+		resp := env.PerformRequest(
+			"POST",
+			fmt.Sprintf("/v1/users/%s/points/spend", userID),
+			spendPointsRequest{
+				Points:        300,
+				Strategy:      "payer-priority",
+				PayerPriority: []string{"MILLER COORS"},
+			})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+
+		transactions := make([]model.Transaction, 0)
+		err := json.NewDecoder(resp.Body).Decode(&transactions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, transactions, 1)
+		assert.Equal(t, "MILLER COORS", transactions[0].Payer)
+
+		resp = env.PerformRequest(
+			"POST",
+			fmt.Sprintf("/v1/users/%s/points/spend", userID),
+			spendPointsRequest{
+				Points:   300,
+				Strategy: "random",
+			})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+	})
+}
+
+func TestPreviewSpend(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			assert.NoError(t, err)
+		}
+
+		resp := env.PerformRequest(
+			"POST",
+			fmt.Sprintf("/v1/users/%s/points/spend/preview", userID),
+			spendPointsRequest{
+				Points: 5000,
+			})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+
+		preview := model.SpendPreview{}
+		err := json.NewDecoder(resp.Body).Decode(&preview)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 5000, preview.Points)
+		assert.Len(t, preview.Transactions, 3)
+		assert.Equal(t, "DANNON", preview.Transactions[0].Payer)
+		assert.Equal(t, -100, preview.Transactions[0].Points)
+		assert.Equal(t, "UNILEVER", preview.Transactions[1].Payer)
+		assert.Equal(t, -200, preview.Transactions[1].Points)
+		assert.Equal(t, "MILLER COORS", preview.Transactions[2].Payer)
+		assert.Equal(t, -4700, preview.Transactions[2].Points)
+
+		assert.Equal(t, []model.Account{
+			{Payer: "DANNON", Points: 1000},
+			{Payer: "MILLER COORS", Points: 5300},
+			{Payer: "UNILEVER", Points: 0},
+		}, preview.Balances)
+
+		// Nothing was written
+		assert.Len(t, env.db.GetTransactions(userID), len(test.Data))
+
+		resp = env.PerformRequest(
+			"POST",
+			fmt.Sprintf("/v1/users/%s/points/spend/preview", userID),
+			spendPointsRequest{
+				Points: 50000,
+			})
+		assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "Should return status 402")
+	})
+}
+
+func TestGetSpend(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			assert.NoError(t, err)
+		}
+		transactions, err := env.service.SpendPoints(userID, 5000, nil)
+		assert.NoError(t, err)
+
+		resp := env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/spends/%s", userID, transactions[0].SpendID), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+
+		spend := model.Spend{}
+		err = json.NewDecoder(resp.Body).Decode(&spend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 5000, spend.Points)
+		assert.Len(t, spend.Funding, 3)
+		assert.Equal(t, test.ParseTime("2020-10-31T10:00:00Z"), spend.Funding[0].Lot.Timestamp)
+
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/spends/unknown", userID), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+	})
+}
+
+func TestReverseSpend(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			assert.NoError(t, err)
+		}
+		transactions, err := env.service.SpendPoints(userID, 5000, nil)
+		assert.NoError(t, err)
+		url := fmt.Sprintf("/v1/users/%s/spends/%s/reverse", userID, transactions[0].SpendID)
+
+		resp := env.PerformRequest("POST", url, reverseSpendRequest{Points: 300})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		reversals := make([]model.Transaction, 0)
+		err = json.NewDecoder(resp.Body).Decode(&reversals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, reversals, 1)
+		assert.Equal(t, "MILLER COORS", reversals[0].Payer)
+		assert.Equal(t, 300, reversals[0].Points)
+
+		resp = env.PerformRequest("POST", url, reverseSpendRequest{Points: 5000})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+
+		resp = env.PerformRequest("POST", url, map[string]interface{}{"points": -1, "reason": "refund"})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Should return status 422")
+		assert.ElementsMatch(t, []fieldError{
+			{Field: "points", Message: "must not be negative"},
+			{Field: "reason", Message: "unknown field"},
+		}, decodeProblem(t, resp).Errors)
+
+		// Without a body the rest of the spend is reversed
+		resp = env.PerformRawRequest("POST", url, "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		assert.Equal(t, []model.Account{
+			{Payer: "DANNON", Points: 1100},
+			{Payer: "MILLER COORS", Points: 10000},
+			{Payer: "UNILEVER", Points: 200},
+		}, env.db.GetAccounts(userID))
+
+		resp = env.PerformRequest("POST", fmt.Sprintf("/v1/users/%s/spends/unknown/reverse", userID), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Should return status 404")
+	})
+}
+
 func TestSpendPoints_error_conditions(t *testing.T) {
 	withEnv(t, func(env serverEnv) {
 		userID := "1"
@@ -127,10 +333,89 @@ func TestSpendPoints_error_conditions(t *testing.T) {
 
 }
 
+func TestServe_drains_in_flight_requests(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		service := &blockingService{pointService: env.service, started: make(chan struct{}), release: make(chan struct{})}
+		env.server.service = service
+		env.server.ShutdownTimeout = time.Second
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() {
+			served <- env.server.Serve(ctx, listener)
+		}()
+
+		url := fmt.Sprintf("http://%s/v1/users/1/balance", listener.Addr())
+		responses := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Get(url)
+			assert.NoError(t, err)
+			responses <- resp
+		}()
+		<-service.started
+		cancel()
+
+		// The server stops accepting connections but finishes the request already in flight
+		select {
+		case <-served:
+			t.Fatal("Serve returned before the in-flight request finished")
+		case <-time.After(50 * time.Millisecond):
+		}
+		_, err = http.Get(url)
+		assert.Error(t, err)
+		assert.Equal(t, stateShuttingDown, atomic.LoadInt32(&env.server.state))
+
+		close(service.release)
+		resp := <-responses
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+		assert.NoError(t, <-served)
+	})
+}
+
+func TestServe_shutdown_timeout(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		service := &blockingService{pointService: env.service, started: make(chan struct{}), release: make(chan struct{})}
+		defer close(service.release)
+		env.server.service = service
+		env.server.ShutdownTimeout = 10 * time.Millisecond
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() {
+			served <- env.server.Serve(ctx, listener)
+		}()
+		go http.Get(fmt.Sprintf("http://%s/v1/users/1/balance", listener.Addr()))
+		<-service.started
+		cancel()
+
+		assert.Error(t, <-served)
+	})
+}
+
+// blockingService blocks balance requests until it is released
+type blockingService struct {
+	pointService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingService) GetBalance(userID string) model.Balance {
+	close(s.started)
+	<-s.release
+	return s.pointService.GetBalance(userID)
+}
+
 // serverEnv is a struct used to house test dependencies
 type serverEnv struct {
 	db      *db.InMemoryDB
 	service *services.PointService
+	payers  *services.PayerRegistry
+	budgets *services.BudgetLedger
 	server  *Server
 	t       *testing.T
 }
@@ -139,12 +424,19 @@ type serverEnv struct {
 // to the given function
 func withEnv(t *testing.T, f func(env serverEnv)) {
 	database := db.NewInMemoryDB()
+	payers := services.NewPayerRegistry(database)
+	// Payers are registered as the tests use them, tests of the registry turn this off
+	payers.Permissive = true
 	service := services.NewPointService(database)
-	server := NewServer(service)
+	service.Payers = payers
+	budgets := services.NewBudgetLedger(database)
+	server := NewServer(service, payers, budgets, database)
 
 	env := serverEnv{
 		db:      database,
 		service: service,
+		payers:  payers,
+		budgets: budgets,
 		server:  server,
 		t:       t,
 	}
@@ -153,15 +445,26 @@ func withEnv(t *testing.T, f func(env serverEnv)) {
 }
 
 func (e *serverEnv) PerformRequest(method, url string, payloadObj interface{}) *http.Response {
+	return e.PerformRequestWithHeaders(method, url, payloadObj, nil)
+}
+
+func (e *serverEnv) PerformRequestWithHeaders(method, url string, payloadObj interface{}, headers map[string]string) *http.Response {
 	body, err := json.Marshal(payloadObj)
 	if err != nil {
 		e.t.Fatal(err)
 	}
+	return e.PerformRawRequest(method, url, string(body), headers)
+}
 
-	r, err := http.NewRequest(method, url, bytes.NewBufferString(string(body)))
+// PerformRawRequest sends the body as is, for requests that are not valid JSON
+func (e *serverEnv) PerformRawRequest(method, url string, body string, headers map[string]string) *http.Response {
+	r, err := http.NewRequest(method, url, bytes.NewBufferString(body))
 	if err != nil {
 		e.t.Fatal(err)
 	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
 
 	w := httptest.NewRecorder()
 	handler := e.server.setupHandlers()
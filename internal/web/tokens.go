@@ -0,0 +1,124 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// UserTokenSecretEnv is the environment variable holding the secret user tokens are
+	// signed with
+	UserTokenSecretEnv = "POINTS_API_USER_TOKEN_SECRET"
+
+	// DefaultTokenLeeway is how far the clocks of the server and the token issuer may drift
+	// apart before tokens are rejected as expired or not yet valid
+	DefaultTokenLeeway = time.Minute
+
+	codeInvalidToken  = "invalid_token"
+	codeUserMismatch  = "user_mismatch"
+	bearerPrefix      = "Bearer "
+	tokenAlgorithm    = "HS256"
+	tokenType         = "JWT"
+	userIdempotencyID = "user:"
+)
+
+// userScopes are the scopes granted to users authenticated with a token. Users can read and
+// spend their own points but never earn them.
+var userScopes = []Scope{ScopeRead, ScopeSpend}
+
+// UserClaims are the claims of a user token: the user it was issued to and the times, in
+// seconds since the epoch, it is valid between
+type UserClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// MintUserToken returns a JWT signed with HS256 using the secret that lets the user with the
+// given ID use the API until ttl after now. It is meant for tests and local development.
+func MintUserToken(secret []byte, userID string, now time.Time, ttl time.Duration) (string, error) {
+	if userID == "" {
+		return "", errors.New("userID is required")
+	}
+	header, err := json.Marshal(tokenHeader{Algorithm: tokenAlgorithm, Type: tokenType})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(UserClaims{Subject: userID, IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(header) + "." + encodeSegment(claims)
+	return signingInput + "." + encodeSegment(sign(secret, signingInput)), nil
+}
+
+// verifyUserToken checks the signature and validity period of a token signed with HS256 and
+// returns its claims. leeway is added to either end of the validity period.
+func verifyUserToken(token string, secret []byte, now time.Time, leeway time.Duration) (UserClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return UserClaims{}, errors.New("token is malformed")
+	}
+
+	header := tokenHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return UserClaims{}, err
+	}
+	// Checking the algorithm stops tokens claiming "none" or an algorithm we do not sign with
+	if header.Algorithm != tokenAlgorithm {
+		return UserClaims{}, fmt.Errorf("token must be signed with %s", tokenAlgorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(secret, parts[0]+"."+parts[1])) {
+		return UserClaims{}, errors.New("token signature is invalid")
+	}
+
+	claims := UserClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return UserClaims{}, err
+	}
+	switch {
+	case claims.Subject == "":
+		return UserClaims{}, errors.New("token has no subject")
+	case claims.ExpiresAt == 0:
+		return UserClaims{}, errors.New("token has no expiry")
+	case !now.Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)):
+		return UserClaims{}, errors.New("token has expired")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-leeway)):
+		return UserClaims{}, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func sign(secret []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("token is malformed")
+	}
+	if err := json.Unmarshal(data, dst); err != nil {
+		return errors.New("token is malformed")
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyUserToken(t *testing.T) {
+	secret := []byte("secret")
+	now := test.ParseTime("2020-11-02T14:00:00Z")
+	mint := func(userID string, issued time.Time, ttl time.Duration) string {
+		token, err := MintUserToken(secret, userID, issued, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := mint("1", now, time.Hour)
+	parts := strings.Split(valid, ".")
+	withHeader := func(header string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + parts[1] + "." + parts[2]
+	}
+
+	tests := map[string]struct {
+		token string
+		valid bool
+	}{
+		"valid":                        {token: valid, valid: true},
+		"expired within the leeway":    {token: mint("1", now.Add(-time.Hour-30*time.Second), time.Hour), valid: true},
+		"expired":                      {token: mint("1", now.Add(-2*time.Hour), time.Hour)},
+		"signed with another secret":   {token: strings.Join(parts[:2], ".") + "." + strings.Split(mustMint(t, []byte("other"), "1", now), ".")[2]},
+		"claims changed after signing": {token: parts[0] + "." + strings.Split(mint("2", now, time.Hour), ".")[1] + "." + parts[2]},
+		"unsigned":                     {token: withHeader(`{"alg":"none"}`)},
+		"malformed":                    {token: "not-a-token"},
+		"no subject":                   {token: signToken(secret, `{"alg":"HS256"}`, `{"exp":1604329200}`)},
+		"not valid yet":                {token: signToken(secret, `{"alg":"HS256"}`, `{"sub":"1","nbf":1604329200,"exp":1604332800}`)},
+		"no expiry":                    {token: signToken(secret, `{"alg":"HS256"}`, `{"sub":"1"}`)},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims, err := verifyUserToken(tc.token, secret, now, DefaultTokenLeeway)
+			if tc.valid {
+				assert.NoError(t, err)
+				assert.Equal(t, "1", claims.Subject)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+// signToken signs a token with the given header and claims, which MintUserToken would not
+// create
+func signToken(secret []byte, header, claims string) string {
+	signingInput := encodeSegment([]byte(header)) + "." + encodeSegment([]byte(claims))
+	return signingInput + "." + encodeSegment(sign(secret, signingInput))
+}
+
+func mustMint(t *testing.T, secret []byte, userID string, now time.Time) string {
+	token, err := MintUserToken(secret, userID, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestUserTokens(t *testing.T) {
+	secret := []byte("secret")
+	now := test.ParseTime("2020-11-02T14:00:00Z")
+	token := mustMint(t, secret, "1", now)
+
+	tests := map[string]struct {
+		method  string
+		url     string
+		token   string
+		payload interface{}
+		status  int
+		code    string
+	}{
+		"own balance": {
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			token:  token,
+			status: http.StatusOK,
+		},
+		"own spend": {
+			method:  "POST",
+			url:     "/v1/users/1/points/spend",
+			token:   token,
+			payload: spendPointsRequest{Points: 100},
+			status:  http.StatusPaymentRequired,
+		},
+		"another user's balance": {
+			method: "GET",
+			url:    "/v1/users/2/balance",
+			token:  token,
+			status: http.StatusForbidden,
+			code:   codeUserMismatch,
+		},
+		"earning points": {
+			method:  "POST",
+			url:     "/v1/users/1/points/add",
+			token:   token,
+			payload: model.Transaction{Payer: "DANNON", Points: 100, Timestamp: now},
+			status:  http.StatusForbidden,
+			code:    codeInsufficientScope,
+		},
+		"payer registry": {
+			method: "GET",
+			url:    "/v1/payers",
+			token:  token,
+			status: http.StatusForbidden,
+			code:   codeInsufficientScope,
+		},
+		"expired token": {
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			token:  mustMint(t, secret, "1", now.Add(-2*time.Hour)),
+			status: http.StatusUnauthorized,
+			code:   codeInvalidToken,
+		},
+		"no token": {
+			method: "GET",
+			url:    "/v1/users/1/balance",
+			status: http.StatusUnauthorized,
+			code:   codeUnauthenticated,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			withEnv(t, func(env serverEnv) {
+				env.server.UserTokenSecret = secret
+				env.server.now = func() time.Time { return now }
+
+				headers := map[string]string{}
+				if tc.token != "" {
+					headers["Authorization"] = "Bearer " + tc.token
+				}
+				resp := env.PerformRequestWithHeaders(tc.method, tc.url, tc.payload, headers)
+				assert.Equal(t, tc.status, resp.StatusCode)
+				if tc.code != "" {
+					assert.Equal(t, tc.code, decodeProblem(t, resp).Code)
+				}
+				if tc.code == codeInvalidToken {
+					assert.Equal(t, `Bearer error="invalid_token"`, resp.Header.Get("WWW-Authenticate"))
+				}
+			})
+		})
+	}
+}
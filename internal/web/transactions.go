@@ -0,0 +1,94 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/services"
+	"github.com/gorilla/mux"
+)
+
+// listTransactionsHandler returns a page of the user's transactions. It understands the
+// query parameters payer, kind (earn or spend), type, reference, from and to (RFC 3339
+// timestamps), order (asc or desc), limit and cursor.
+func (s *Server) listTransactionsHandler(w http.ResponseWriter, req *http.Request) {
+	// Get and validate userID
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	if userID == "" {
+		writeProblem(w, req, http.StatusBadRequest, codeMissingParameter, "userID is required")
+		return
+	}
+
+	query, err := parseTransactionQuery(req.URL.Query())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	page, err := s.service.ListTransactions(userID, query)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+}
+
+// parseTransactionQuery reads a services.TransactionQuery from the query parameters
+func parseTransactionQuery(values url.Values) (services.TransactionQuery, error) {
+	query := services.TransactionQuery{
+		Payer:     values.Get("payer"),
+		Kind:      values.Get("kind"),
+		Type:      model.TransactionType(values.Get("type")),
+		Reference: values.Get("reference"),
+		Cursor:    values.Get("cursor"),
+	}
+
+	var err error
+	if query.From, err = parseTimeParam(values, "from"); err != nil {
+		return query, err
+	}
+	if query.To, err = parseTimeParam(values, "to"); err != nil {
+		return query, err
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("order must be asc or desc, got %q", order)
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return query, fmt.Errorf("limit must be a positive integer, got %q", limit)
+		}
+	}
+	return query, nil
+}
+
+// parseTimeParam parses the RFC 3339 timestamp in the named query parameter, returning the
+// zero time if it is not set
+func parseTimeParam(values url.Values, name string) (time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp, got %q", name, value)
+	}
+	return t, nil
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"fetchrewards.com/points-api/internal/model"
+	"fetchrewards.com/points-api/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListTransactions(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		for _, transaction := range test.Data {
+			err := env.service.AddPoints(userID, transaction)
+			assert.NoError(t, err)
+		}
+
+		url := fmt.Sprintf("/v1/users/%s/transactions?payer=DANNON&order=desc&limit=2", userID)
+		resp := env.PerformRequest("GET", url, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		page := model.TransactionPage{}
+		err := json.NewDecoder(resp.Body).Decode(&page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, page.Transactions, 2)
+		assert.Equal(t, 1000, page.Transactions[0].Points)
+		assert.Equal(t, -200, page.Transactions[1].Points)
+		assert.NotEmpty(t, page.NextCursor)
+
+		resp = env.PerformRequest("GET", url+"&cursor="+page.NextCursor, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		page = model.TransactionPage{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, page.Transactions, 1)
+		assert.Equal(t, 300, page.Transactions[0].Points)
+		assert.Empty(t, page.NextCursor)
+
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/transactions?from=2020-11-01T00:00:00Z&kind=earn", userID), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		page = model.TransactionPage{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, page.Transactions, 2)
+	})
+}
+
+func TestListTransactions_error_conditions(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		tests := map[string]int{
+			"from=yesterday": http.StatusBadRequest,
+			"order=sideways": http.StatusBadRequest,
+			"limit=0":        http.StatusBadRequest,
+			"kind=refund":    http.StatusUnprocessableEntity,
+			"cursor=garbage": http.StatusUnprocessableEntity,
+		}
+		for query, expected := range tests {
+			resp := env.PerformRequest("GET", "/v1/users/1/transactions?"+query, nil)
+			assert.Equal(t, expected, resp.StatusCode, "Should return status %d for %s", expected, query)
+		}
+	})
+}
+
+func TestListTransactions_metadata(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		userID := "1"
+		resp := env.PerformRequest("POST", fmt.Sprintf("/v1/users/%s/points/add", userID), map[string]interface{}{
+			"payer":     "DANNON",
+			"points":    1000,
+			"timestamp": "2020-11-02T14:00:00Z",
+			"reference": "receipt-1",
+			"metadata":  map[string]string{"store": "42"},
+		})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Should return status 204")
+
+		resp = env.PerformRequest("GET", fmt.Sprintf("/v1/users/%s/transactions?reference=receipt-1&type=earn", userID), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return status 200")
+		page := model.TransactionPage{}
+		err := json.NewDecoder(resp.Body).Decode(&page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, page.Transactions, 1)
+		tran := page.Transactions[0]
+		assert.Len(t, tran.ID, 26)
+		assert.Equal(t, model.TransactionEarn, tran.Type)
+		assert.Equal(t, map[string]string{"store": "42"}, tran.Metadata)
+		assert.False(t, tran.CreatedAt.IsZero())
+	})
+}
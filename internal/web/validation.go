@@ -0,0 +1,237 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+)
+
+const (
+	// maxBodyBytes bounds the size of the request bodies the server reads
+	maxBodyBytes = 64 << 10
+	// maxTimestampSkew is how far in the future a transaction's timestamp may be, to allow
+	// for clients whose clocks run ahead
+	maxTimestampSkew = time.Hour
+
+	codeBodyTooLarge     = "body_too_large"
+	codeValidationFailed = "validation_failed"
+)
+
+// errBodyTooLarge is returned by readBody for bodies over maxBodyBytes
+var errBodyTooLarge = fmt.Errorf("request body must not be larger than %d bytes", maxBodyBytes)
+
+// fieldError describes what is wrong with one field of a request body
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// readBody reads the whole request body, returning errBodyTooLarge if it is over maxBodyBytes
+func readBody(req *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// decodeStrict decodes the JSON object in the request body into dst, a pointer to a struct,
+// and then checks it with validate. Every unknown field and every field validate complains
+// about is reported in a single 422 response. Bodies that are too large, are not a single JSON
+// object or do not fit dst are rejected straight away. It returns false if it wrote a response.
+func decodeStrict(w http.ResponseWriter, req *http.Request, dst interface{}, validate func() []fieldError) bool {
+	body, ok := readRequestBody(w, req)
+	return ok && decodeBody(w, req, body, dst, validate)
+}
+
+// decodeOptional is decodeStrict for requests whose body can be left out. An empty body leaves
+// dst as it is and is not validated.
+func decodeOptional(w http.ResponseWriter, req *http.Request, dst interface{}, validate func() []fieldError) bool {
+	body, ok := readRequestBody(w, req)
+	if !ok {
+		return false
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return true
+	}
+	return decodeBody(w, req, body, dst, validate)
+}
+
+// readRequestBody reads the request body for decodeStrict and decodeOptional. It returns false
+// if it wrote a response.
+func readRequestBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := readBody(req)
+	if err == errBodyTooLarge {
+		writeProblem(w, req, http.StatusRequestEntityTooLarge, codeBodyTooLarge, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, codeInvalidBody, err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+// decodeBody decodes and validates the body for decodeStrict and decodeOptional. It returns
+// false if it wrote a response.
+func decodeBody(w http.ResponseWriter, req *http.Request, body []byte, dst interface{}, validate func() []fieldError) bool {
+	var fields map[string]json.RawMessage
+	if err := decodeSingle(body, &fields); err != nil {
+		writeProblem(w, req, http.StatusUnprocessableEntity, codeInvalidBody, err.Error())
+		return false
+	}
+	if err := json.Unmarshal(body, dst); err != nil {
+		writeProblem(w, req, http.StatusUnprocessableEntity, codeInvalidBody, err.Error())
+		return false
+	}
+
+	errs := unknownFields(fields, dst)
+	errs = append(errs, validate()...)
+	if len(errs) > 0 {
+		writeValidationProblem(w, req, errs)
+		return false
+	}
+	return true
+}
+
+// noValidation is passed to decodeStrict for bodies the service layer validates on its own
+func noValidation() []fieldError {
+	return nil
+}
+
+// validatePayer checks a payer sent to be registered. The timestamps are assigned by the
+// server and must be left out.
+func validatePayer(payer model.Payer) []fieldError {
+	errs := make([]fieldError, 0)
+	if !payer.CreatedAt.IsZero() {
+		errs = append(errs, fieldError{Field: "createdAt", Message: "is assigned by the server"})
+	}
+	if !payer.UpdatedAt.IsZero() {
+		errs = append(errs, fieldError{Field: "updatedAt", Message: "is assigned by the server"})
+	}
+	return errs
+}
+
+// decodeSingle decodes body into dst and fails if anything but white space follows the value
+func decodeSingle(body []byte, dst interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(dst); err != nil {
+		if err == io.EOF {
+			return errors.New("request body must not be empty")
+		}
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// unknownFields reports the fields that do not match a field of the struct dst points to.
+// Names are matched without regard to case, like encoding/json does.
+func unknownFields(fields map[string]json.RawMessage, dst interface{}) []fieldError {
+	known := jsonFieldNames(reflect.TypeOf(dst).Elem())
+	errs := make([]fieldError, 0)
+	for name := range fields {
+		found := false
+		for _, knownName := range known {
+			if strings.EqualFold(name, knownName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fieldError{Field: name, Message: "unknown field"})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+	return errs
+}
+
+// jsonFieldNames returns the JSON names of the exported fields of a struct type
+func jsonFieldNames(structType reflect.Type) []string {
+	names := make([]string, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// validateTransaction checks a transaction sent to be added. The fields the server assigns
+// must be left out.
+func validateTransaction(transaction model.Transaction, now time.Time) []fieldError {
+	errs := make([]fieldError, 0)
+	if strings.TrimSpace(transaction.Payer) == "" {
+		errs = append(errs, fieldError{Field: "payer", Message: "is required"})
+	}
+	if transaction.Points == 0 {
+		errs = append(errs, fieldError{Field: "points", Message: "must not be zero"})
+	}
+	if transaction.Timestamp.IsZero() {
+		errs = append(errs, fieldError{Field: "timestamp", Message: "is required"})
+	} else if transaction.Timestamp.After(now.Add(maxTimestampSkew)) {
+		errs = append(errs, fieldError{Field: "timestamp", Message: "must not be in the future"})
+	}
+	if transaction.ID != "" {
+		errs = append(errs, fieldError{Field: "id", Message: "is assigned by the server"})
+	}
+	if !transaction.CreatedAt.IsZero() {
+		errs = append(errs, fieldError{Field: "createdAt", Message: "is assigned by the server"})
+	}
+	if transaction.SpendID != "" {
+		errs = append(errs, fieldError{Field: "spendId", Message: "is assigned by the server"})
+	}
+	if transaction.ReversalOf != "" {
+		errs = append(errs, fieldError{Field: "reversalOf", Message: "is assigned by the server"})
+	}
+	return errs
+}
+
+// validate checks a reversal request. Leaving points out reverses the rest of the spend.
+func (r reverseSpendRequest) validate() []fieldError {
+	errs := make([]fieldError, 0)
+	if r.Points < 0 {
+		errs = append(errs, fieldError{Field: "points", Message: "must not be negative"})
+	}
+	return errs
+}
+
+// validate checks a spend, preview or hold request
+func (r spendPointsRequest) validate() []fieldError {
+	errs := make([]fieldError, 0)
+	if r.Points <= 0 {
+		errs = append(errs, fieldError{Field: "points", Message: "must be a positive integer"})
+	}
+	for i, payer := range r.PayerPriority {
+		if strings.TrimSpace(payer) == "" {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("payerPriority[%d]", i), Message: "must not be empty"})
+		}
+	}
+	return errs
+}
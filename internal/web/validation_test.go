@@ -0,0 +1,164 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"fetchrewards.com/points-api/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidation(t *testing.T) {
+	now := time.Date(2020, 11, 3, 0, 0, 0, 0, time.UTC)
+	addURL := "/v1/users/1/points/add"
+	spendURL := "/v1/users/1/points/spend"
+
+	tests := map[string]struct {
+		method string
+		url    string
+		body   string
+		status int
+		code   string
+		errors []fieldError
+	}{
+		"valid transaction": {
+			url:    addURL,
+			body:   `{ "payer": "DANNON", "points": 100, "timestamp": "2020-11-02T14:00:00Z" }`,
+			status: http.StatusNoContent,
+		},
+		"every field error at once": {
+			url:    addURL,
+			body:   `{ "payer": " ", "points": 0, "colour": "red", "Extra": 1 }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{
+				{Field: "Extra", Message: "unknown field"},
+				{Field: "colour", Message: "unknown field"},
+				{Field: "payer", Message: "is required"},
+				{Field: "points", Message: "must not be zero"},
+				{Field: "timestamp", Message: "is required"},
+			},
+		},
+		"field names match without regard to case": {
+			url:    addURL,
+			body:   `{ "Payer": "DANNON", "POINTS": 100, "timestamp": "2020-11-02T14:00:00Z" }`,
+			status: http.StatusNoContent,
+		},
+		"timestamp far in the future": {
+			url:    addURL,
+			body:   `{ "payer": "DANNON", "points": 100, "timestamp": "2020-11-04T00:00:00Z" }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{{Field: "timestamp", Message: "must not be in the future"}},
+		},
+		"fields assigned by the server": {
+			url:    addURL,
+			body:   `{ "id": "1", "payer": "DANNON", "points": 100, "timestamp": "2020-11-02T14:00:00Z", "spendId": "2" }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{
+				{Field: "id", Message: "is assigned by the server"},
+				{Field: "spendId", Message: "is assigned by the server"},
+			},
+		},
+		"trailing garbage": {
+			url:    addURL,
+			body:   `{ "payer": "DANNON", "points": 100, "timestamp": "2020-11-02T14:00:00Z" } garbage`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeInvalidBody,
+		},
+		"empty body": {
+			url:    addURL,
+			body:   "",
+			status: http.StatusUnprocessableEntity,
+			code:   codeInvalidBody,
+		},
+		"wrong type": {
+			url:    addURL,
+			body:   `{ "payer": "DANNON", "points": "100", "timestamp": "2020-11-02T14:00:00Z" }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeInvalidBody,
+		},
+		"oversize body": {
+			url:    addURL,
+			body:   `{ "payer": "` + strings.Repeat("A", maxBodyBytes) + `" }`,
+			status: http.StatusRequestEntityTooLarge,
+			code:   codeBodyTooLarge,
+		},
+		"zero points spent": {
+			url:    spendURL,
+			body:   `{ "points": 0, "payerPriority": [""], "strategy": "fifo" }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{
+				{Field: "points", Message: "must be a positive integer"},
+				{Field: "payerPriority[0]", Message: "must not be empty"},
+			},
+		},
+		"unknown spend field": {
+			url:    spendURL,
+			body:   `{ "points": 10, "dryRun": true }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{{Field: "dryRun", Message: "unknown field"}},
+		},
+		"unknown payer field": {
+			url:    "/v1/payers",
+			body:   `{ "id": "KRAFT", "colour": "red", "createdAt": "2020-11-02T14:00:00Z" }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{
+				{Field: "colour", Message: "unknown field"},
+				{Field: "createdAt", Message: "is assigned by the server"},
+			},
+		},
+		"trailing garbage in budget funding": {
+			url:    "/v1/payers/DANNON/budget/fund",
+			body:   `{ "points": 10 } { "points": 10 }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeInvalidBody,
+		},
+		"unknown budget cap": {
+			method: "PATCH",
+			url:    "/v1/payers/DANNON/budget",
+			body:   `{ "monthlyCap": 10 }`,
+			status: http.StatusUnprocessableEntity,
+			code:   codeValidationFailed,
+			errors: []fieldError{{Field: "monthlyCap", Message: "unknown field"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			withEnv(t, func(env serverEnv) {
+				env.server.now = func() time.Time { return now }
+				if _, err := env.payers.Register(model.Payer{ID: "DANNON"}); err != nil {
+					t.Fatal(err)
+				}
+
+				method := tc.method
+				if method == "" {
+					method = "POST"
+				}
+				resp := env.PerformRawRequest(method, tc.url, tc.body, nil)
+				assert.Equal(t, tc.status, resp.StatusCode)
+				if tc.code == "" {
+					return
+				}
+				body := decodeProblem(t, resp)
+				assert.Equal(t, tc.code, body.Code)
+				assert.Equal(t, tc.errors, body.Errors)
+			})
+		})
+	}
+}
+
+func TestValidation_oversize_idempotent_request(t *testing.T) {
+	withEnv(t, func(env serverEnv) {
+		body := `{ "points": 10, "strategy": "` + strings.Repeat("A", maxBodyBytes) + `" }`
+		resp := env.PerformRawRequest("POST", "/v1/users/1/points/spend", body, map[string]string{IdempotencyKeyHeader: "key"})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+}